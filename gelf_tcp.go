@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log"
+	"net"
+
+	"github.com/ivoras/ceruleanlog/logcore"
+)
+
+const gelfTCPMaxFrameSize = 1024 * 1024
+
+var errGelfFrameTooLarge = errors.New("GELF frame too large")
+
+// Goroutine which receives null-byte delimited GELF messages over TCP
+func gelfTCPServer() {
+	listener, err := net.Listen("tcp", *gelfTCPBind)
+	if err != nil {
+		log.Panic("Cannot listen on ", *gelfTCPBind, " for GELF TCP: ", err)
+	}
+	if !trackInput(listener) {
+		listener.Close()
+		return
+	}
+	log.Println("GELF TCP server listening on", *gelfTCPBind)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if inputsClosing() {
+				return
+			}
+			log.Println("GELF TCP accept error:", err)
+			continue
+		}
+		if !trackInput(conn) {
+			conn.Close()
+			return
+		}
+		go gelfTCPHandleConnection(conn)
+	}
+}
+
+func gelfTCPHandleConnection(conn net.Conn) {
+	defer untrackInput(conn)
+	defer conn.Close()
+	addr := conn.RemoteAddr()
+	r := bufio.NewReader(conn)
+	nMessages := 0
+	nErrors := 0
+	for {
+		frame, err := readNullTerminatedFrame(r, gelfTCPMaxFrameSize)
+		if err == errGelfFrameTooLarge {
+			log.Println("GELF TCP frame from", addr, "larger than", gelfTCPMaxFrameSize, "bytes, skipped")
+			nErrors++
+			continue
+		}
+		if len(frame) > 0 {
+			msg, perr := logcore.ParseGelfMessage(frame)
+			if perr != nil {
+				log.Println("Error parsing GELF message from", addr, perr)
+				nErrors++
+			} else if perr = instance.AddMessage(msg); perr != nil {
+				log.Println("Error ingesting message:", perr)
+				nErrors++
+			} else {
+				nMessages++
+			}
+		}
+		if err != nil {
+			if err != io.EOF && !inputsClosing() {
+				log.Println("GELF TCP read error from", addr, err)
+			}
+			break
+		}
+	}
+	log.Printf("GELF TCP connection from %v closed, %d messages received, %d errors", addr, nMessages, nErrors)
+}
+
+// readNullTerminatedFrame reads bytes up to the next null byte, and returns
+// them without the terminator. Frames larger than maxSize are discarded
+// up to the next null byte, and errGelfFrameTooLarge is returned.
+// At EOF, any unterminated data is returned together with io.EOF.
+func readNullTerminatedFrame(r *bufio.Reader, maxSize int) (frame []byte, err error) {
+	tooLarge := false
+	for {
+		chunk, rerr := r.ReadSlice(0)
+		if !tooLarge {
+			if len(frame)+len(chunk) > maxSize+1 {
+				tooLarge = true
+				frame = nil
+			} else {
+				frame = append(frame, chunk...)
+			}
+		}
+		if rerr == bufio.ErrBufferFull {
+			continue
+		}
+		if tooLarge {
+			if rerr == nil {
+				rerr = errGelfFrameTooLarge
+			}
+			return nil, rerr
+		}
+		if rerr == nil {
+			frame = frame[:len(frame)-1]
+		}
+		return frame, rerr
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"log"
+	"net"
+	"time"
+
+	"github.com/ivoras/ceruleanlog/logcore"
+)
+
+const (
+	gelfUDPMaxDatagramSize = 65536
+	gelfChunkTimeout       = 5 * time.Second
+	gelfChunkMaxBytes      = 64 * 1024 * 1024
+)
+
+// Goroutine which receives GELF messages over UDP
+func gelfUDPServer() {
+	conn, err := net.ListenPacket("udp", *gelfUDPBind)
+	if err != nil {
+		log.Panic("Cannot listen on ", *gelfUDPBind, " for GELF UDP: ", err)
+	}
+	if !trackInput(conn) {
+		conn.Close()
+		return
+	}
+	log.Println("GELF UDP server listening on", *gelfUDPBind)
+
+	assembler := logcore.NewGelfChunkAssembler(gelfChunkTimeout, gelfChunkMaxBytes)
+	go func() {
+		for {
+			time.Sleep(gelfChunkTimeout)
+			if n := assembler.Expire(); n > 0 {
+				log.Printf("GELF UDP: %d incomplete chunked messages expired", n)
+			}
+		}
+	}()
+
+	buf := make([]byte, gelfUDPMaxDatagramSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if inputsClosing() {
+				return
+			}
+			log.Println("GELF UDP read error:", err)
+			continue
+		}
+		payload, err := assembler.HandleDatagram(buf[:n])
+		if err != nil {
+			log.Println("GELF UDP error from", addr, err)
+			continue
+		}
+		if payload == nil {
+			continue
+		}
+		msg, err := logcore.ParseGelfMessage(payload)
+		if err != nil {
+			log.Println("Error parsing GELF message from", addr, err)
+			continue
+		}
+		if err = instance.AddMessage(msg); err != nil {
+			log.Println("Error ingesting message:", err)
+		}
+	}
+}
@@ -4,6 +4,7 @@ go 1.14
 
 require (
 	github.com/gorilla/handlers v1.4.2
+	github.com/gorilla/websocket v1.4.2
 	github.com/mattn/go-sqlite3 v2.0.3+incompatible
 	github.com/rs/cors v1.7.0
 	github.com/snabb/isoweek v1.0.0
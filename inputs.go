@@ -0,0 +1,50 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// Listeners and connections of the message inputs are tracked here so they
+// can be closed on shutdown.
+
+var inputClosers = map[io.Closer]struct{}{}
+var inputClosersLock sync.Mutex
+var inputsClosed int32
+
+// trackInput registers a listener or a connection to be closed on shutdown.
+// It returns false if the inputs are already closed, in which case the caller
+// should close it.
+func trackInput(c io.Closer) bool {
+	inputClosersLock.Lock()
+	defer inputClosersLock.Unlock()
+	if atomic.LoadInt32(&inputsClosed) != 0 {
+		return false
+	}
+	inputClosers[c] = struct{}{}
+	return true
+}
+
+func untrackInput(c io.Closer) {
+	inputClosersLock.Lock()
+	delete(inputClosers, c)
+	inputClosersLock.Unlock()
+}
+
+// inputsClosing checks if the inputs are being closed, so that errors
+// from closed listeners can be ignored.
+func inputsClosing() bool {
+	return atomic.LoadInt32(&inputsClosed) != 0
+}
+
+// closeInputs closes all the input listeners and connections.
+func closeInputs() {
+	inputClosersLock.Lock()
+	defer inputClosersLock.Unlock()
+	atomic.StoreInt32(&inputsClosed, 1)
+	for c := range inputClosers {
+		c.Close()
+	}
+	inputClosers = map[io.Closer]struct{}{}
+}
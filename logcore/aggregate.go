@@ -0,0 +1,592 @@
+package logcore
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Aggregations are computed per shard with GROUP BY, as partial aggregates
+// (counts, totals, minimums and maximums) which are then merged by time bucket
+// and group, so that averages and buckets spanning shard boundaries are exact.
+// Percentiles and distinct counts are approximated with sketches (see sketch.go),
+// which are built from the matching rows of each shard, and merged.
+
+// Supported aggregation functions, besides percentiles
+var aggregateFuncs = []string{"count", "sum", "avg", "min", "max", "distinct"}
+
+// Percentile functions, e.g. p50, p99 or p99.9
+var rePercentileFunc = regexp.MustCompile(`^p(100|[0-9]{1,2}(\.[0-9]+)?)$`)
+
+type Aggregation struct {
+	Func  string `json:"func"`  // count, sum, avg, min, max, distinct, or a percentile like p95
+	Field string `json:"field"` // optional for count
+}
+
+type AggregateParams struct {
+	TimeFrom     int64 // microseconds
+	TimeTo       int64 // microseconds
+	Query        *QueryNode
+	GroupBy      []string
+	Interval     int64 // size of time buckets in microseconds, 0 for no time buckets
+	Aggregations []Aggregation
+	Limit        int // maximum number of result rows, 0 for unlimited (see Aggregate)
+
+	QuantileAccuracy  float64 // relative accuracy of percentiles, 0 for DefaultQuantileAccuracy
+	DistinctPrecision uint8   // HyperLogLog precision of distinct counts, 0 for DefaultDistinctPrecision
+}
+
+type AggregateRow struct {
+	Time   float64                `json:"time,omitempty"` // start of the time bucket, in seconds
+	Group  map[string]interface{} `json:"group,omitempty"`
+	Values map[string]interface{} `json:"values"` // by Aggregation.Name()
+}
+
+type AggregateResult []AggregateRow
+
+// aggregateState is the partial state of a single aggregation.
+type aggregateState struct {
+	count  int64
+	sum    float64
+	min    interface{}
+	max    interface{}
+	sketch *DDSketch    // for percentiles
+	hll    *HyperLogLog // for distinct
+}
+
+type aggregateGroup struct {
+	bucket int64
+	group  []interface{}
+	states []aggregateState
+}
+
+// ParseAggregations parses a comma-separated list of aggregations, each
+// either a function name (only for count), or "func:field", e.g. "count,avg:duration".
+func ParseAggregations(s string) (aggs []Aggregation, err error) {
+	for _, spec := range strings.Split(s, ",") {
+		spec = strings.TrimSpace(spec)
+		a := Aggregation{Func: strings.ToLower(spec)}
+		if i := strings.LastIndex(spec, ":"); i != -1 {
+			a.Func = strings.ToLower(spec[:i])
+			a.Field = strings.TrimPrefix(spec[i+1:], "_")
+		}
+		if err = a.validate(); err != nil {
+			return nil, err
+		}
+		aggs = append(aggs, a)
+	}
+	return
+}
+
+func (a Aggregation) validate() error {
+	if !InStringArray(a.Func, aggregateFuncs) && !a.isPercentile() {
+		return fmt.Errorf("Unknown aggregation function: %s", a.Func)
+	}
+	if a.Field == "" {
+		if a.Func != "count" {
+			return fmt.Errorf("Aggregation %s requires a field", a.Func)
+		}
+		return nil
+	}
+	if !reIdentifier.MatchString(a.Field) {
+		return fmt.Errorf("Invalid field name in aggregation: '%s'", a.Field)
+	}
+	return nil
+}
+
+func (a Aggregation) isPercentile() bool {
+	return rePercentileFunc.MatchString(a.Func)
+}
+
+// quantile returns the quantile (0-1) of a percentile aggregation.
+func (a Aggregation) quantile() float64 {
+	p, _ := strconv.ParseFloat(a.Func[1:], 64)
+	return p / 100
+}
+
+// usesSketch checks if the aggregation is computed from the individual values
+// instead of with SQL.
+func (a Aggregation) usesSketch() bool {
+	return a.Func == "distinct" || a.isPercentile()
+}
+
+// Name returns the key of the aggregation in AggregateRow.Values, e.g. "avg(duration)".
+func (a Aggregation) Name() string {
+	if a.Field == "" {
+		return a.Func
+	}
+	return fmt.Sprintf("%s(%s)", a.Func, a.Field)
+}
+
+// Aggregate computes the aggregations over the messages between
+// params.TimeFrom and params.TimeTo which match params.Query. If there are
+// more than params.Limit rows, truncated is true and the result has the
+// newest time buckets (only whole buckets), or without time buckets, the
+// groups with the largest values of the first aggregation.
+func (sc *DbShardCollection) Aggregate(ctx context.Context, params AggregateParams) (result AggregateResult, truncated bool, err error) {
+	if len(params.Aggregations) == 0 {
+		params.Aggregations = []Aggregation{{Func: "count"}}
+	}
+	for _, a := range params.Aggregations {
+		if err = a.validate(); err != nil {
+			return nil, false, newValidationError(err)
+		}
+	}
+	if params.Interval < 0 {
+		return nil, false, newValidationError(fmt.Errorf("Invalid interval: %d", params.Interval))
+	}
+	if params.QuantileAccuracy == 0 {
+		params.QuantileAccuracy = DefaultQuantileAccuracy
+	}
+	if params.DistinctPrecision == 0 {
+		params.DistinctPrecision = DefaultDistinctPrecision
+	}
+	// Check the sketch parameters
+	if _, err = newAggregateGroup(params, 0, nil); err != nil {
+		return nil, false, newValidationError(err)
+	}
+	shards, err := sc.queryShards(params.TimeFrom, params.TimeTo)
+	if err != nil {
+		return
+	}
+	if len(shards) > 0 {
+		knownFields := knownFieldTypes(shards)
+		if err = params.Query.Validate(knownFields); err != nil {
+			return nil, false, newValidationError(err)
+		}
+		fields := append([]string{}, params.GroupBy...)
+		for _, a := range params.Aggregations {
+			if a.Field != "" {
+				fields = append(fields, a.Field)
+			}
+		}
+		for _, f := range fields {
+			if _, found := knownFields[f]; !found {
+				return nil, false, newValidationError(fmt.Errorf("Unknown field: %s", f))
+			}
+		}
+	}
+
+	groups := map[string]*aggregateGroup{}
+	for _, shard := range shards {
+		shardGroups, err := shard.aggregate(ctx, params)
+		if ctx.Err() != nil {
+			// Timed out, or the client went away
+			return nil, false, fmt.Errorf("Aggregation interrupted: %w", ctx.Err())
+		} else if err != nil {
+			return nil, false, fmt.Errorf("Aggregation error on shard %s: %w", shard.name, err)
+		}
+		for key, g := range shardGroups {
+			if existing, found := groups[key]; found {
+				if err = existing.merge(g, params.Aggregations); err != nil {
+					return nil, false, err
+				}
+			} else {
+				groups[key] = g
+			}
+		}
+	}
+
+	list := make([]*aggregateGroup, 0, len(groups))
+	first := map[*aggregateGroup]interface{}{}
+	for _, g := range groups {
+		list = append(list, g)
+		first[g] = g.states[0].value(params.Aggregations[0])
+	}
+	// Ordered by time, then by the first aggregation, descending
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].bucket != list[j].bucket {
+			return list[i].bucket < list[j].bucket
+		}
+		if c := compareSQLValues(first[list[i]], first[list[j]]); c != 0 {
+			return c > 0
+		}
+		return aggregateGroupKey(0, list[i].group) < aggregateGroupKey(0, list[j].group)
+	})
+	if params.Limit > 0 && len(list) > params.Limit {
+		truncated = true
+		if params.Interval > 0 {
+			first := len(list) - params.Limit
+			for first < len(list) && list[first].bucket == list[first-1].bucket {
+				first++
+			}
+			if first == len(list) {
+				// The newest bucket alone has more rows than the limit
+				first = len(list) - params.Limit
+			}
+			list = list[first:]
+		} else {
+			list = list[:params.Limit]
+		}
+	}
+
+	result = make(AggregateResult, len(list))
+	for i, g := range list {
+		row := AggregateRow{Values: map[string]interface{}{}}
+		if params.Interval > 0 {
+			row.Time = float64(g.bucket) / 1000000
+		}
+		if len(params.GroupBy) > 0 {
+			row.Group = map[string]interface{}{}
+			for j, f := range params.GroupBy {
+				row.Group[f] = aggregateFieldValue(f, g.group[j])
+			}
+		}
+		for j, a := range params.Aggregations {
+			v := g.states[j].value(a)
+			if a.Func != "count" && a.Func != "distinct" {
+				v = aggregateFieldValue(a.Field, v)
+			}
+			row.Values[a.Name()] = v
+		}
+		result[i] = row
+	}
+	return
+}
+
+func newAggregateGroup(params AggregateParams, bucket int64, group []interface{}) (g *aggregateGroup, err error) {
+	g = &aggregateGroup{bucket: bucket, group: group, states: make([]aggregateState, len(params.Aggregations))}
+	for i, a := range params.Aggregations {
+		if a.Func == "distinct" {
+			g.states[i].hll, err = NewHyperLogLog(params.DistinctPrecision)
+		} else if a.isPercentile() {
+			g.states[i].sketch, err = NewDDSketch(params.QuantileAccuracy)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return
+}
+
+// merge merges the partial aggregates of another group into this one.
+func (g *aggregateGroup) merge(o *aggregateGroup, aggs []Aggregation) (err error) {
+	for i, a := range aggs {
+		s, os := &g.states[i], &o.states[i]
+		switch {
+		case a.Func == "count", a.Func == "sum", a.Func == "avg":
+			s.count += os.count
+			s.sum += os.sum
+		case a.Func == "min":
+			if os.min != nil && (s.min == nil || compareSQLValues(os.min, s.min) < 0) {
+				s.min = os.min
+			}
+		case a.Func == "max":
+			if os.max != nil && (s.max == nil || compareSQLValues(os.max, s.max) > 0) {
+				s.max = os.max
+			}
+		case a.Func == "distinct":
+			err = s.hll.Merge(os.hll)
+		case a.isPercentile():
+			err = s.sketch.Merge(os.sketch)
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// aggregate runs the aggregation on the shard, returning the partial results by group key.
+func (shard *DbShard) aggregate(ctx context.Context, params AggregateParams) (groups map[string]*aggregateGroup, err error) {
+	fieldTypes := shard.getFieldTypes()
+	column := func(f string) string {
+		if _, found := fieldTypes[f]; found {
+			return quoteSQLIdentifier(f)
+		}
+		return "NULL"
+	}
+	// Aggregated values: rows which existed before a text field was added have it set to ''
+	valueColumn := func(f string) string {
+		if fieldTypes[f] == "TEXT" {
+			return fmt.Sprintf("NULLIF(%s, '')", quoteSQLIdentifier(f))
+		}
+		return column(f)
+	}
+	where, whereArgs, err := params.Query.ToSQL(fieldTypes, shard.getFullTextFields())
+	if err != nil {
+		return
+	}
+
+	columns := []string{}
+	args := []interface{}{}
+	if params.Interval > 0 {
+		columns = append(columns, "(timestamp / ?) * ?")
+		args = append(args, params.Interval, params.Interval)
+	} else {
+		columns = append(columns, "0")
+	}
+	for _, f := range params.GroupBy {
+		columns = append(columns, column(f))
+	}
+	nGroupColumns := len(columns)
+	groupColumns := append([]string{}, columns...)
+	groupArgs := append([]interface{}{}, args...)
+	for _, a := range params.Aggregations {
+		switch a.Func {
+		case "count":
+			if a.Field == "" {
+				columns = append(columns, "COUNT(*)")
+			} else {
+				columns = append(columns, fmt.Sprintf("COUNT(%s)", valueColumn(a.Field)))
+			}
+		case "sum", "avg":
+			columns = append(columns, fmt.Sprintf("COUNT(%s)", valueColumn(a.Field)), fmt.Sprintf("TOTAL(%s)", valueColumn(a.Field)))
+		case "min":
+			columns = append(columns, fmt.Sprintf("MIN(%s)", valueColumn(a.Field)))
+		case "max":
+			columns = append(columns, fmt.Sprintf("MAX(%s)", valueColumn(a.Field)))
+		}
+	}
+	groupBy := make([]string, nGroupColumns)
+	for i := range groupBy {
+		groupBy[i] = fmt.Sprint(i + 1)
+	}
+	args = append(args, params.TimeFrom, params.TimeTo)
+	args = append(args, whereArgs...)
+	sqlString := fmt.Sprintf("SELECT %s FROM data WHERE timestamp BETWEEN ? AND ? AND %s GROUP BY %s",
+		strings.Join(columns, ", "), where, strings.Join(groupBy, ", "))
+
+	groups = map[string]*aggregateGroup{}
+	// getGroup returns the group for a row whose first nGroupColumns values are the bucket and group
+	getGroup := func(values []interface{}) (g *aggregateGroup, err error) {
+		bucket, _ := values[0].(int64)
+		group := values[1:nGroupColumns]
+		key := aggregateGroupKey(bucket, group)
+		g, found := groups[key]
+		if !found {
+			g, err = newAggregateGroup(params, bucket, group)
+			if err != nil {
+				return
+			}
+			groups[key] = g
+		}
+		return
+	}
+
+	err = shard.scanAggregateRows(ctx, sqlString, args, len(columns), func(values []interface{}) (err error) {
+		g, err := getGroup(values)
+		if err != nil {
+			return
+		}
+		col := nGroupColumns
+		for i, a := range params.Aggregations {
+			s := &g.states[i]
+			switch a.Func {
+			case "count":
+				s.count += toInt64(values[col])
+				col++
+			case "sum", "avg":
+				s.count += toInt64(values[col])
+				s.sum += toFloat64(values[col+1])
+				col += 2
+			case "min":
+				if values[col] != nil && (s.min == nil || compareSQLValues(values[col], s.min) < 0) {
+					s.min = values[col]
+				}
+				col++
+			case "max":
+				if values[col] != nil && (s.max == nil || compareSQLValues(values[col], s.max) > 0) {
+					s.max = values[col]
+				}
+				col++
+			}
+		}
+		return
+	})
+	if err != nil {
+		return
+	}
+
+	// Sketches need the individual values
+	sketchColumns := append([]string{}, groupColumns...)
+	for _, a := range params.Aggregations {
+		if a.usesSketch() {
+			sketchColumns = append(sketchColumns, valueColumn(a.Field))
+		}
+	}
+	if len(sketchColumns) == nGroupColumns {
+		return
+	}
+	args = append(groupArgs, params.TimeFrom, params.TimeTo)
+	args = append(args, whereArgs...)
+	sqlString = fmt.Sprintf("SELECT %s FROM data WHERE timestamp BETWEEN ? AND ? AND %s",
+		strings.Join(sketchColumns, ", "), where)
+	err = shard.scanAggregateRows(ctx, sqlString, args, len(sketchColumns), func(values []interface{}) (err error) {
+		g, err := getGroup(values)
+		if err != nil {
+			return
+		}
+		col := nGroupColumns
+		for i, a := range params.Aggregations {
+			if !a.usesSketch() {
+				continue
+			}
+			v := values[col]
+			col++
+			if v == nil {
+				continue
+			}
+			if a.Func == "distinct" {
+				g.states[i].hll.AddString(distinctKey(v))
+			} else if f, ok := v.(float64); ok {
+				g.states[i].sketch.Add(f)
+			} else if n, ok := v.(int64); ok {
+				g.states[i].sketch.Add(float64(n))
+			}
+		}
+		return
+	})
+	return
+}
+
+// scanAggregateRows runs the SQL query, calling f with the values of each row.
+func (shard *DbShard) scanAggregateRows(ctx context.Context, sqlString string, args []interface{}, nColumns int, f func(values []interface{}) error) (err error) {
+	rows, err := shard.db.QueryContext(ctx, sqlString, args...)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		values := make([]interface{}, nColumns)
+		dest := make([]interface{}, nColumns)
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		if err = rows.Scan(dest...); err != nil {
+			return
+		}
+		for i, v := range values {
+			if b, ok := v.([]byte); ok {
+				values[i] = string(b)
+			}
+		}
+		if err = f(values); err != nil {
+			return
+		}
+	}
+	return rows.Err()
+}
+
+// distinctKey converts a value to the string counted by distinct, so that
+// equal numbers are counted once regardless of their type.
+func distinctKey(v interface{}) string {
+	switch n := v.(type) {
+	case int64:
+		return "n" + strconv.FormatFloat(float64(n), 'g', -1, 64)
+	case float64:
+		return "n" + strconv.FormatFloat(n, 'g', -1, 64)
+	}
+	return "s" + fmt.Sprint(v)
+}
+
+// value returns the final value of the aggregation.
+func (s aggregateState) value(a Aggregation) interface{} {
+	switch a.Func {
+	case "count":
+		return s.count
+	case "sum":
+		if s.count == 0 {
+			return nil
+		}
+		return s.sum
+	case "avg":
+		if s.count == 0 {
+			return nil
+		}
+		return s.sum / float64(s.count)
+	case "min":
+		return s.min
+	case "max":
+		return s.max
+	case "distinct":
+		return s.hll.Count()
+	}
+	if a.isPercentile() {
+		if v, ok := s.sketch.Quantile(a.quantile()); ok {
+			return v
+		}
+	}
+	return nil
+}
+
+// aggregateFieldValue converts a value of the field for output. Timestamps
+// are returned in seconds.
+func aggregateFieldValue(field string, v interface{}) interface{} {
+	if field != "timestamp" {
+		return v
+	}
+	switch n := v.(type) {
+	case int64:
+		return float64(n) / 1000000
+	case float64:
+		return n / 1000000
+	}
+	return v
+}
+
+func aggregateGroupKey(bucket int64, group []interface{}) string {
+	var b strings.Builder
+	fmt.Fprint(&b, bucket)
+	for _, v := range group {
+		fmt.Fprintf(&b, "\x00%T:%v", v, v)
+	}
+	return b.String()
+}
+
+func toInt64(v interface{}) int64 {
+	switch n := v.(type) {
+	case int64:
+		return n
+	case uint64:
+		return int64(n)
+	case float64:
+		return int64(n)
+	}
+	return 0
+}
+
+func toFloat64(v interface{}) float64 {
+	switch n := v.(type) {
+	case int64:
+		return float64(n)
+	case uint64:
+		return float64(n)
+	case float64:
+		return n
+	}
+	return 0
+}
+
+// compareSQLValues compares two values like SQLite does: NULL is less than
+// numbers, which are less than strings.
+func compareSQLValues(a, b interface{}) int {
+	rank := func(v interface{}) int {
+		switch v.(type) {
+		case nil:
+			return 0
+		case int64, uint64, float64:
+			return 1
+		}
+		return 2
+	}
+	ra, rb := rank(a), rank(b)
+	if ra != rb {
+		return ra - rb
+	}
+	switch ra {
+	case 1:
+		fa, fb := toFloat64(a), toFloat64(b)
+		if fa < fb {
+			return -1
+		} else if fa > fb {
+			return 1
+		}
+	case 2:
+		return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+	}
+	return 0
+}
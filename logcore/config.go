@@ -25,6 +25,14 @@ type CeruleanConfig struct {
 	ShardTimeSpec           ShardTimeSpecType `json:"-"`
 	MemoryBufferTimeSeconds uint32            `json:"memory_buffer_time_seconds"`
 	IndexFieldList          []string          `json:"index_field_list"`
+	FullTextFieldList       []string          `json:"full_text_field_list"`   // Text fields searchable with MATCH, besides short_message and full_message
+	JournalDisabled         bool              `json:"journal_disabled"`       // Don't write buffered messages to the on-disk journal
+	RetentionMaxAgeDays     uint32            `json:"retention_max_age_days"` // 0 for unlimited
+	RetentionMaxSizeMB      uint64            `json:"retention_max_size_mb"`  // 0 for unlimited
+	RetentionMaxShards      uint32            `json:"retention_max_shards"`   // 0 for unlimited
+	QueryWorkers            uint32            `json:"query_workers"`          // Shards queried in parallel, 0 for the number of CPUs
+	QueryTimeoutSeconds     uint32            `json:"query_timeout_seconds"`  // Maximum query execution time, 0 for unlimited
+	QueryMaxRowsScanned     uint64            `json:"query_max_rows_scanned"` // Maximum rows examined by a query, 0 for unlimited
 }
 
 type spanNameID struct {
@@ -51,7 +59,7 @@ func ReadCeruleanConfig(fileName string) (cfg CeruleanConfig, err error) {
 	case "day":
 		cfg.ShardTimeSpec = ShardTimeSpecDay
 	default:
-		err = fmt.Errorf("Invalid shard_time_spec: %s", cfg.ShardTimeSpec)
+		err = fmt.Errorf("Invalid shard_time_spec: %s", cfg.ShardTimeSpecString)
 		return
 	}
 	if !InStringArray(cfg.SQLiteJournalMode, []string{"wal", "delete", "memory"}) {
@@ -91,6 +99,29 @@ func (c CeruleanConfig) ShardNameToTsID(name string) (ts, id uint32, err error)
 	return
 }
 
+// ShardNameToTimeSpan returns the start and the end time of the data
+// contained in the named shard.
+func (c CeruleanConfig) ShardNameToTimeSpan(name string) (start, end time.Time, err error) {
+	ts, _, err := c.ShardNameToTsID(name)
+	if err != nil {
+		return
+	}
+	start = unixTimeStampToUTCTime(ts).UTC()
+	switch c.ShardTimeSpec {
+	case ShardTimeSpecYear:
+		end = start.AddDate(1, 0, 0)
+	case ShardTimeSpecMonth:
+		end = start.AddDate(0, 1, 0)
+	case ShardTimeSpecWeek:
+		end = start.AddDate(0, 0, 7)
+	case ShardTimeSpecDay:
+		end = start.AddDate(0, 0, 1)
+	default:
+		log.Panicln("Invalid ShardTimeSpec:", c.ShardTimeSpec)
+	}
+	return
+}
+
 // GetShardName returns a name and a unique ID
 // (the name and the ID are locally unique and date-based)
 // for a shard which contains data for the given timestamp.
@@ -154,5 +185,7 @@ func NewCeruleanConfig() (cfg CeruleanConfig) {
 	cfg.ShardTimeSpec = ShardTimeSpecWeek
 	cfg.MemoryBufferTimeSeconds = 30
 	cfg.IndexFieldList = []string{}
+	cfg.FullTextFieldList = []string{}
+	cfg.QueryTimeoutSeconds = 60
 	return
 }
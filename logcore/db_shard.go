@@ -1,23 +1,41 @@
 package logcore
 
 import (
+	"container/heap"
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"math"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 )
 
 // Shards are always time-based.
 
+// shardSchemaVersion is stored in PRAGMA user_version of each shard database.
+// Version 0 stored timestamps in seconds, version 1 stores them in microseconds.
+const shardSchemaVersion = 1
+
+// ErrShardNotFound is returned when opening a shard which doesn't exist for reading
+var ErrShardNotFound = errors.New("Shard not found")
+
 type DbShard struct {
-	db            *sql.DB
-	id            uint32
-	name          string
-	dataFields    SortedStringSlice // Must be kept sorted for binary search
-	indexedFields SortedStringSlice // Must be kept sorted for binary search
+	WithRWMutex    // Protects the field and index metadata below
+	db             *sql.DB
+	id             uint32
+	name           string
+	dataFields     SortedStringSlice   // Must be kept sorted for binary search
+	dataFieldTypes map[string]string   // field name -> SQL type
+	indexedFields  SortedStringSlice   // Must be kept sorted for binary search
+	indexes        map[string][]string // index name -> indexed fields
+	fullTextFields []string            // columns of the data_fts table, nil if full-text search isn't available
+	ready          chan struct{}       // closed when the shard is opened, or opening it failed
+	openErr        error
 }
 
 type DbShardQueryResult []map[string]interface{}
@@ -42,21 +60,77 @@ func NewDbShardCollection(i *CeruleanInstance) (sc DbShardCollection, err error)
 	return
 }
 
-func (sc *DbShardCollection) GetShard(ts uint32) (shard *DbShard, err error) {
-	shardName, shardID := sc.instance.config.GetShardNameID(ts)
-	return sc.getShardByNameID(shardName, shardID)
+// GetShard returns the shard for the given timestamp in microseconds,
+// creating it if it doesn't exist.
+func (sc *DbShardCollection) GetShard(ts int64) (shard *DbShard, err error) {
+	shardName, shardID := sc.instance.config.GetShardNameID(uint32(ts / 1000000))
+	return sc.getShardByNameID(shardName, shardID, true)
 }
 
-func (sc *DbShardCollection) getShardByNameID(shardName string, shardID uint32) (shard *DbShard, err error) {
-	var found bool
-	sc.WithRLock(func() {
-		shard, found = sc.shards[shardID]
-	})
-	if found {
+// getShardByNameID returns the shard, opening it if needed. If it doesn't
+// exist, it's created only if create is true, otherwise ErrShardNotFound is
+// returned, so that reading doesn't re-create shards deleted by the janitor.
+func (sc *DbShardCollection) getShardByNameID(shardName string, shardID uint32, create bool) (shard *DbShard, err error) {
+	for {
+		var found bool
+		sc.WithRLock(func() {
+			shard, found = sc.shards[shardID]
+		})
+		if !found {
+			// The shard is registered with the collection locked, so that it's
+			// opened (and created or migrated) only once, but opened without
+			// it, so that opening a large shard doesn't block the others
+			sc.WithWLock(func() {
+				if shard, found = sc.shards[shardID]; !found {
+					shard = &DbShard{id: shardID, name: shardName, ready: make(chan struct{})}
+					sc.shards[shardID] = shard
+				}
+			})
+			if !found {
+				shard.openErr = sc.openShard(shard, create)
+				if shard.openErr != nil {
+					sc.WithWLock(func() {
+						delete(sc.shards, shardID)
+					})
+				}
+				close(shard.ready)
+			}
+		}
+		<-shard.ready
+		if shard.openErr == ErrShardNotFound && create {
+			// Another goroutine tried to open it for reading
+			continue
+		}
+		if shard.openErr != nil {
+			return nil, shard.openErr
+		}
 		return
 	}
+}
 
+// isOpen checks if the shard is opened, without waiting.
+func (shard *DbShard) isOpen() bool {
+	select {
+	case <-shard.ready:
+		return shard.openErr == nil
+	default:
+		return false
+	}
+}
+
+// openShard opens (or creates, if create is true) the shard's database. It
+// must be called only by the goroutine which registered the shard.
+func (sc *DbShardCollection) openShard(shard *DbShard, create bool) (err error) {
+	shardName := shard.name
 	shardDir := fmt.Sprintf("%s/%s", sc.instance.getShardsDir(), shardName)
+	if !create {
+		if _, err = os.Stat(fmt.Sprintf("%s/shard.db", shardDir)); os.IsNotExist(err) {
+			err = ErrShardNotFound
+		}
+		if err != nil {
+			return
+		}
+	}
 	if _, err = os.Stat(shardDir); err != nil {
 		err = os.MkdirAll(shardDir, 0755)
 		if err != nil {
@@ -70,11 +144,15 @@ func (sc *DbShardCollection) getShardByNameID(shardName string, shardID uint32)
 	}
 	err = nil
 
-	db, err := sql.Open("sqlite3", shardDbFileName)
+	db, err := sql.Open(shardSQLDriver, shardDbFileName)
 	if err != nil {
 		return
 	}
-	shard = &DbShard{}
+	defer func() {
+		if err != nil {
+			db.Close()
+		}
+	}()
 	if !shardDbExists {
 		_, err = db.Exec(fmt.Sprintf("PRAGMA journal_mode=%s", sc.instance.config.SQLiteJournalMode))
 		if err != nil {
@@ -92,90 +170,214 @@ func (sc *DbShardCollection) getShardByNameID(shardName string, shardID uint32)
 		CREATE INDEX idx_data_timestamp ON data(timestamp);
 		CREATE INDEX idx_data_host ON data(host);
 		CREATE INDEX idx_data_facility ON data(facility);
-		`)
+		` + fmt.Sprintf("PRAGMA user_version=%d;", shardSchemaVersion))
 		if err != nil {
 			return
 		}
 		shard.dataFields = []string{"facility", "full_message", "host", "short_message", "timestamp"}
+		shard.dataFieldTypes = map[string]string{
+			"facility":      "TEXT",
+			"full_message":  "TEXT",
+			"host":          "TEXT",
+			"short_message": "TEXT",
+			"timestamp":     "INTEGER",
+		}
 		shard.indexedFields = []string{"facility", "host", "timestamp"}
+		shard.indexes = map[string][]string{
+			"idx_data_timestamp": {"timestamp"},
+			"idx_data_host":      {"host"},
+			"idx_data_facility":  {"facility"},
+		}
 		log.Println("Created new shard database", shardDbFileName)
-		sc.shardNames = append(sc.shardNames, shardName)
-		sc.shardNames.Sort()
+		sc.WithWLock(func() {
+			sc.shardNames = append(sc.shardNames, shardName)
+			sc.shardNames.Sort()
+		})
 	} else {
-		// Load dataFields and indexedFields from database
-		shard.dataFields = []string{}
-		var rows *sql.Rows
-		rows, err = db.Query("PRAGMA table_info(data)")
+		err = migrateShardSchema(db, shardName)
+		if err != nil {
+			return
+		}
+		err = shard.loadSchema(db)
 		if err != nil {
 			return
 		}
+	}
+	shard.db = db
+	err = shard.ensureIndexes(db, sc.instance.getIndexSpecs())
+	if err != nil {
+		return
+	}
+	err = shard.ensureFullText(db, sc.instance.getFullTextFieldList())
+	return
+}
+
+// loadSchema loads the fields and indexes of the shard from the database.
+func (shard *DbShard) loadSchema(db *sql.DB) (err error) {
+	dataFields := SortedStringSlice{}
+	dataFieldTypes := map[string]string{}
+	var rows *sql.Rows
+	rows, err = db.Query("PRAGMA table_info(data)")
+	if err != nil {
+		return
+	}
+	for rows.Next() {
+		var col struct {
+			idx      int
+			name     string
+			type_    string
+			notnull  int
+			default_ sql.NullString
+			ispk     int
+		}
+		err = rows.Scan(&col.idx, &col.name, &col.type_, &col.notnull, &col.default_, &col.ispk)
+		if err != nil {
+			return
+		}
+		if col.name == "id" {
+			continue
+		}
+		dataFields = InsertSortedString(col.name, dataFields)
+		dataFieldTypes[col.name] = strings.ToUpper(col.type_)
+	}
+	indexes := map[string][]string{}
+	rows, err = db.Query("PRAGMA index_list(data)")
+	if err != nil {
+		return
+	}
+	indexList := []string{}
+	for rows.Next() {
+		var idx struct {
+			seq     int
+			name    string
+			unique  int
+			how     string
+			partial int
+		}
+		err = rows.Scan(&idx.seq, &idx.name, &idx.unique, &idx.how, &idx.partial)
+		if err != nil {
+			return
+		}
+		indexList = append(indexList, idx.name)
+	}
+	for _, idxName := range indexList {
+		rows, err = db.Query("PRAGMA index_info(" + quoteSQLIdentifier(idxName) + ")")
+		if err != nil {
+			return
+		}
+		indexes[idxName] = []string{}
 		for rows.Next() {
 			var col struct {
-				idx      int
-				name     string
-				type_    string
-				notnull  int
-				default_ sql.NullString
-				ispk     int
+				seq  int
+				cid  int
+				name string
 			}
-			err = rows.Scan(&col.idx, &col.name, &col.type_, &col.notnull, &col.default_, &col.ispk)
+			err = rows.Scan(&col.seq, &col.cid, &col.name)
 			if err != nil {
 				return
 			}
-			if col.name == "id" {
-				continue
-			}
-			shard.dataFields = InsertSortedString(col.name, shard.dataFields)
+			indexes[idxName] = append(indexes[idxName], col.name)
 		}
-		shard.indexedFields = []string{}
-		rows, err = db.Query("PRAGMA index_list(data)")
+	}
+	shard.WithWLock(func() {
+		shard.dataFields = dataFields
+		shard.dataFieldTypes = dataFieldTypes
+		shard.indexes = indexes
+		shard.updateIndexedFields()
+	})
+	return
+}
+
+// migrateShardSchema upgrades shard databases created by older versions.
+// The schema version is checked in an immediate transaction, so that the
+// database is migrated only once even if other processes have it open.
+func migrateShardSchema(db *sql.DB, shardName string) (err error) {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	_, err = conn.ExecContext(ctx, "BEGIN IMMEDIATE")
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			conn.ExecContext(ctx, "ROLLBACK")
+		}
+	}()
+	var version int
+	err = conn.QueryRowContext(ctx, "PRAGMA user_version").Scan(&version)
+	if err != nil {
+		return
+	}
+	if version < shardSchemaVersion {
+		log.Println("Migrating shard", shardName, "from schema version", version, "to", shardSchemaVersion)
+	}
+	if version < 1 {
+		// Timestamps were in seconds
+		_, err = conn.ExecContext(ctx, "UPDATE data SET timestamp = timestamp * 1000000")
+		if err != nil {
+			return fmt.Errorf("Cannot migrate timestamps in shard %s: %w", shardName, err)
+		}
+	}
+	if version < shardSchemaVersion {
+		_, err = conn.ExecContext(ctx, fmt.Sprintf("PRAGMA user_version=%d", shardSchemaVersion))
 		if err != nil {
 			return
 		}
-		indexList := []string{}
-		for rows.Next() {
-			var idx struct {
-				seq     int
-				name    string
-				unique  int
-				how     string
-				partial int
+	}
+	_, err = conn.ExecContext(ctx, "COMMIT")
+	return
+}
+
+// Close closes all the open shard databases.
+func (sc *DbShardCollection) Close() (err error) {
+	sc.WithWLock(func() {
+		for id, shard := range sc.shards {
+			if !shard.isOpen() {
+				continue
 			}
-			err = rows.Scan(&idx.seq, &idx.name, &idx.unique, &idx.how, &idx.partial)
-			if err != nil {
-				return
+			if cerr := shard.db.Close(); cerr != nil {
+				log.Println("Error closing shard", shard.name, cerr)
+				err = cerr
 			}
-			indexList = append(indexList, idx.name)
+			delete(sc.shards, id)
 		}
-		for _, idxName := range indexList {
-			rows, err = db.Query("PRAGMA index_info(" + idxName + ")")
-			if err != nil {
-				return
-			}
-			for rows.Next() {
-				var col struct {
-					seq  int
-					cid  int
-					name string
+	})
+	return
+}
+
+// removeShard closes the named shard if it's open, and deletes its directory.
+func (sc *DbShardCollection) removeShard(shardName string) (err error) {
+	sc.WithWLock(func() {
+		for id, shard := range sc.shards {
+			if shard.name == shardName {
+				if !shard.isOpen() {
+					err = fmt.Errorf("Shard %s is being opened", shardName)
+					return
 				}
-				err = rows.Scan(&col.seq, &col.cid, &col.name)
-				if err != nil {
+				if err = shard.db.Close(); err != nil {
 					return
 				}
-				shard.indexedFields.Insert(col.name)
+				delete(sc.shards, id)
+				break
 			}
 		}
-	}
-	shard.db = db
-	shard.name = shardName
-	shard.id = shardID
-	sc.WithWLock(func() {
-		sc.shards[shardID] = shard
+		names := SortedStringSlice{}
+		for _, name := range sc.shardNames {
+			if name != shardName {
+				names = append(names, name)
+			}
+		}
+		sc.shardNames = names
+		err = os.RemoveAll(fmt.Sprintf("%s/%s", sc.instance.getShardsDir(), shardName))
 	})
 	return
 }
 
-func (sc DbShardCollection) getShardNames() (names []string, err error) {
+func (sc *DbShardCollection) getShardNames() (names []string, err error) {
 	shardsDir := sc.instance.getShardsDir()
 	dirs, err := ioutil.ReadDir(shardsDir)
 	if err != nil {
@@ -190,11 +392,15 @@ func (sc DbShardCollection) getShardNames() (names []string, err error) {
 	return
 }
 
-func (sc DbShardCollection) EarlieastShard() (name string, ts, id uint32, err error) {
-	if len(sc.shardNames) == 0 {
+func (sc *DbShardCollection) EarlieastShard() (name string, ts, id uint32, err error) {
+	sc.WithRLock(func() {
+		if len(sc.shardNames) > 0 {
+			name = sc.shardNames[0]
+		}
+	})
+	if name == "" {
 		return "", 0, 0, fmt.Errorf("No shards")
 	}
-	name = sc.shardNames[0]
 	ts, id, err = sc.instance.config.ShardNameToTsID(name)
 	if err != nil {
 		return "", 0, 0, err
@@ -202,34 +408,52 @@ func (sc DbShardCollection) EarlieastShard() (name string, ts, id uint32, err er
 	return name, ts, id, nil
 }
 
+// CommitMessagesToShards commits the messages to shards, in a transaction
+// per shard. If committing fails, the messages which were committed (to other
+// shards) are removed from the messages, and if a message failed, the error
+// is a *messageCommitError.
 func (sc *DbShardCollection) CommitMessagesToShards(messages *[]BasicGelfMessage) (err error) {
 	var tx *sql.Tx
-	oldShardID := uint32(0)
+	var txShard *DbShard
+	txStart := 0 // index of the first message in tx
+	defer func() {
+		if err == nil {
+			return
+		}
+		if tx != nil {
+			tx.Rollback()
+			// Columns and indexes added in the transaction are gone
+			if lerr := txShard.loadSchema(txShard.db); lerr != nil {
+				log.Println("Cannot reload the schema of shard", txShard.name, lerr)
+			}
+		}
+		*messages = (*messages)[txStart:]
+	}()
 
-	for _, msg := range *messages {
-		shard, err := sc.GetShard(msg.Timestamp)
+	for i := range *messages {
+		msg := &(*messages)[i]
+		var shard *DbShard
+		shard, err = sc.GetShard(msg.Timestamp)
 		if err != nil {
-			return err
+			return
 		}
-		if tx == nil {
-			oldShardID = shard.id
-			tx, err = shard.db.Begin()
-			if err != nil {
-				return err
-			}
-		} else if oldShardID != shard.id {
-			err = tx.Commit()
-			if err != nil {
-				return err
+		if tx != nil && txShard.id != shard.id {
+			if err = tx.Commit(); err != nil {
+				return
 			}
+			tx = nil
+			txStart = i
+		}
+		if tx == nil {
 			tx, err = shard.db.Begin()
 			if err != nil {
-				return err
+				return
 			}
-			oldShardID = shard.id
+			txShard = shard
+		}
+		if err = sc.CommitMessageToShard(tx, msg); err != nil {
+			return &messageCommitError{index: i - txStart, err: fmt.Errorf("Cannot commit message to shard %s: %w", shard.name, err)}
 		}
-
-		sc.CommitMessageToShard(tx, &msg)
 	}
 	if tx != nil {
 		err = tx.Commit()
@@ -242,40 +466,67 @@ func (sc *DbShardCollection) CommitMessageToShard(tx *sql.Tx, msg *BasicGelfMess
 	if err != nil {
 		return
 	}
-	/*
-		fields := make([]string, len(shard.dataFields))
-		for i, fn := range shard.dataFields {
-			fields[i] = fn
-		}*/
-	fields := shard.dataFields
+	var fields []string
+	shard.WithRLock(func() {
+		fields = append([]string{}, shard.dataFields...)
+	})
+	// SQLite column names are case-insensitive, so the message's fields are
+	// matched to the columns by their lower-case names
+	columns := map[string]bool{}
+	for _, fn := range fields {
+		columns[strings.ToLower(fn)] = true
+	}
+	numbers := map[string]float64{}
+	strs := map[string]string{}
 	// Step 1: find out if the message has additional fields which are not present in the database
 	newFields := map[string]string{}
-	for fn := range msg.AdditionalNumbers {
-		if !InStringArraySorted(fn, fields) {
+	for fn, v := range msg.AdditionalNumbers {
+		numbers[strings.ToLower(fn)] = v
+		if !columns[strings.ToLower(fn)] {
 			newFields[fn] = "NUMERIC"
+			columns[strings.ToLower(fn)] = true
 		}
 	}
-	for fn := range msg.AdditionalStrings {
-		if !InStringArraySorted(fn, fields) {
+	for fn, v := range msg.AdditionalStrings {
+		strs[strings.ToLower(fn)] = v
+		if !columns[strings.ToLower(fn)] {
 			newFields[fn] = "TEXT"
+			columns[strings.ToLower(fn)] = true
 		}
 	}
 	for fn, fnType := range newFields {
 		fields = InsertSortedString(fn, fields)
 		log.Printf("Adding column %s %s to %s", fn, fnType, shard.name)
-		_, err = tx.Exec(fmt.Sprintf("ALTER TABLE data ADD COLUMN %s %s", fn, fnType))
+		_, err = tx.Exec(fmt.Sprintf("ALTER TABLE data ADD COLUMN %s %s", quoteSQLIdentifier(fn), fnType))
 		if err != nil {
 			return
 		}
 		if fnType == "TEXT" {
-			_, err = tx.Exec(fmt.Sprintf("UPDATE data SET %s=''", fn))
+			_, err = tx.Exec(fmt.Sprintf("UPDATE data SET %s=''", quoteSQLIdentifier(fn)))
 		} else if fnType == "NUMERIC" {
-			_, err = tx.Exec(fmt.Sprintf("UPDATE data SET %s=0", fn))
+			_, err = tx.Exec(fmt.Sprintf("UPDATE data SET %s=0", quoteSQLIdentifier(fn)))
+		}
+		if err != nil {
+			return
+		}
+	}
+	if len(newFields) > 0 {
+		shard.WithWLock(func() {
+			shard.dataFields = fields
+			for fn, fnType := range newFields {
+				shard.dataFieldTypes[fn] = fnType
+			}
+		})
+		// Configured indexes may now be possible on this shard
+		err = shard.ensureIndexes(tx, sc.instance.getIndexSpecs())
+		if err != nil {
+			return
 		}
 	}
-	shard.dataFields = fields
+	quotedFields := make([]string, len(fields))
 	values := make([]string, len(fields))
 	for i, fn := range fields {
+		quotedFields[i] = quoteSQLIdentifier(fn)
 		switch fn {
 		case "full_message":
 			values[i] = quoteSQLString(msg.FullMessage)
@@ -284,15 +535,15 @@ func (sc *DbShardCollection) CommitMessageToShard(tx *sql.Tx, msg *BasicGelfMess
 		case "short_message":
 			values[i] = quoteSQLString(msg.ShortMessage)
 		case "timestamp":
-			values[i] = strconv.Itoa(int(msg.Timestamp))
+			values[i] = strconv.FormatInt(msg.Timestamp, 10)
 		case "facility":
 			values[i] = quoteSQLString(msg.Facility)
 		default:
-			if v, found := msg.AdditionalNumbers[fn]; found {
+			if v, found := numbers[strings.ToLower(fn)]; found {
 				values[i] = strconv.FormatFloat(v, 'f', -1, 64)
 			} else {
 				// This accidentally works for fields which are not present in this message
-				s := msg.AdditionalStrings[fn]
+				s := strs[strings.ToLower(fn)]
 				if len(s) > 0 {
 					values[i] = quoteSQLString(s)
 				} else {
@@ -301,12 +552,40 @@ func (sc *DbShardCollection) CommitMessageToShard(tx *sql.Tx, msg *BasicGelfMess
 			}
 		}
 	}
-	sqlString := fmt.Sprintf("INSERT INTO data(%s) VALUES(%s)", strings.Join(fields, ","), strings.Join(values, ","))
-	_, err = tx.Exec(sqlString)
+	sqlString := fmt.Sprintf("INSERT INTO data(%s) VALUES(%s)", strings.Join(quotedFields, ","), strings.Join(values, ","))
+	res, err := tx.Exec(sqlString)
 	if err != nil {
 		log.Println(sqlString)
+		return
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return
+	}
+	err = shard.addFullText(tx, id, msg)
+
+	return
+}
+
+// hasField checks if the shard has the field, including the id field.
+func (shard *DbShard) hasField(field string) (found bool) {
+	if field == "id" {
+		return true
 	}
+	shard.WithRLock(func() {
+		_, found = shard.dataFieldTypes[field]
+	})
+	return
+}
 
+// getFieldTypes returns a copy of the field name -> SQL type map, including the id field.
+func (shard *DbShard) getFieldTypes() (types map[string]string) {
+	types = map[string]string{"id": "INTEGER"}
+	shard.WithRLock(func() {
+		for fn, fnType := range shard.dataFieldTypes {
+			types[fn] = fnType
+		}
+	})
 	return
 }
 
@@ -314,43 +593,562 @@ func quoteSQLString(s string) string {
 	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
 }
 
-func (sc *DbShardCollection) Query(timeFrom, timeTo, limit uint32, query string) (result DbShardQueryResult, err error) {
+func quoteSQLIdentifier(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
+
+// queryShards returns the existing shards which overlap the time range
+// between timeFrom and timeTo (in microseconds), newest first.
+func (sc *DbShardCollection) queryShards(timeFrom, timeTo int64) (shards []*DbShard, err error) {
 	_, firstTs, _, err := sc.EarlieastShard()
 	if err != nil {
 		return
 	}
-	if timeFrom < firstTs {
-		timeFrom = firstTs
+	if timeFrom < int64(firstTs)*1000000 {
+		timeFrom = int64(firstTs) * 1000000
 	}
-	if len(query) == 0 {
-		query = "1"
+	if timeFrom > timeTo {
+		return
 	}
-	sqlQuery := fmt.Sprintf("SELECT * FROM data WHERE timestamp BETWEEN %d and %d AND %s ORDER BY timestamp DESC", timeFrom, timeTo, query)
-	result = DbShardQueryResult{}
-	shardList := sc.instance.config.GetShardNameIDsTimeSpan(timeFrom, timeTo)
+	shardList := sc.instance.config.GetShardNameIDsTimeSpan(uint32(timeFrom/1000000), uint32(timeTo/1000000))
 	for i := len(shardList) - 1; i >= 0; i-- {
 		s := shardList[i]
-		shard, err := sc.getShardByNameID(s.name, s.id)
-		if err != nil {
+		exists := false
+		sc.WithRLock(func() {
+			exists = InStringArraySorted(s.name, sc.shardNames)
+		})
+		if !exists {
+			continue
+		}
+		shard, err := sc.getShardByNameID(s.name, s.id, false)
+		if err == ErrShardNotFound {
+			// Deleted by the janitor in the meantime
+			continue
+		} else if err != nil {
 			return nil, err
 		}
-		res, err := shard.sqlQuery(fmt.Sprintf("%s LIMIT %d", sqlQuery, int(limit)-len(result)))
-		if err != nil {
-			log.Println("Query error on shard", s.name, err)
+		shards = append(shards, shard)
+	}
+	return
+}
+
+// knownFieldTypes returns the union of the fields of the shards, with their types.
+func knownFieldTypes(shards []*DbShard) (types map[string]string) {
+	types = map[string]string{}
+	for _, shard := range shards {
+		for fn, fnType := range shard.getFieldTypes() {
+			types[fn] = fnType
+		}
+	}
+	return
+}
+
+// QueryParams describes a query for messages. Times are in microseconds.
+type QueryParams struct {
+	TimeFrom  int64
+	TimeTo    int64
+	Limit     uint32
+	Query     *QueryNode   // nil matches all messages
+	Ascending bool         // oldest messages first
+	Cursor    *QueryCursor // continue after the previous page
+
+	Fields         []string // fields to return besides id and timestamp, nil for all fields
+	SortField      string   // indexed field by which messages with the same timestamp are sorted
+	SortDescending bool     // order of the sort field
+}
+
+// Reasons for a partial query result
+const (
+	QueryPartialTimeout        = "timeout"
+	QueryPartialCancelled      = "cancelled"
+	QueryPartialMaxRowsScanned = "max_rows_scanned"
+	QueryPartialError          = "error"
+)
+
+// QueryResult holds the messages found by a query. If some shards which
+// could contain matching messages weren't fully searched, Partial is set,
+// and the shards are listed in IncompleteShards.
+type QueryResult struct {
+	Rows             DbShardQueryResult
+	Partial          bool
+	PartialReason    string
+	IncompleteShards []string
+	RowsScanned      uint64       // Only counted with a limit on the rows scanned
+	NextCursor       *QueryCursor // nil if there are no more messages
+}
+
+// prepareQuery narrows the query's time range to the part after the cursor,
+// and returns the shards to query, in the query order, with the query
+// validated against their fields.
+func (sc *DbShardCollection) prepareQuery(params QueryParams) (_ QueryParams, shards []*DbShard, err error) {
+	if params.Cursor != nil {
+		if params.Cursor.Ascending != params.Ascending || params.Cursor.SortField != params.SortField || params.Cursor.SortDescending != params.SortDescending {
+			return params, nil, newValidationError(fmt.Errorf("The cursor is for a different sort order"))
+		}
+		if params.Ascending && params.TimeFrom < params.Cursor.Timestamp {
+			params.TimeFrom = params.Cursor.Timestamp
+		} else if !params.Ascending && params.TimeTo > params.Cursor.Timestamp {
+			params.TimeTo = params.Cursor.Timestamp
+		}
+	}
+	shards, err = sc.queryShards(params.TimeFrom, params.TimeTo)
+	if err != nil || len(shards) == 0 {
+		return params, nil, err
+	}
+	if params.Ascending {
+		for i, j := 0, len(shards)-1; i < j; i, j = i+1, j-1 {
+			shards[i], shards[j] = shards[j], shards[i]
+		}
+	}
+	knownFields := knownFieldTypes(shards)
+	if err = params.Query.Validate(knownFields); err != nil {
+		return params, nil, newValidationError(err)
+	}
+	for _, f := range params.Fields {
+		if _, found := knownFields[f]; !found {
+			return params, nil, newValidationError(fmt.Errorf("Unknown field: %s", f))
+		}
+	}
+	if params.SortField != "" {
+		if err = validateSortField(params.SortField, shards); err != nil {
+			return params, nil, newValidationError(err)
+		}
+	}
+	return params, shards, nil
+}
+
+// validateSortField checks that messages can be sorted by the field: it must
+// be indexed in all the shards which have it.
+func validateSortField(field string, shards []*DbShard) error {
+	if field == "timestamp" || field == "id" {
+		return fmt.Errorf("Messages are always sorted by %s", field)
+	}
+	found := false
+	for _, shard := range shards {
+		if !shard.hasField(field) {
 			continue
-			//return nil, err
 		}
-		result = append(result, res...)
-		if len(result) >= int(limit) {
-			break
+		found = true
+		indexed := false
+		shard.WithRLock(func() {
+			indexed = InStringArraySorted(field, shard.indexedFields)
+		})
+		if !indexed {
+			return fmt.Errorf("Can only sort by indexed fields, %s isn't indexed in shard %s", field, shard.name)
+		}
+	}
+	if !found {
+		return fmt.Errorf("Unknown field: %s", field)
+	}
+	return nil
+}
+
+// Query runs the query on all shards in the time range. Shards are queried in
+// parallel, and the queries on shards which can no longer contribute to the
+// first params.Limit messages are cancelled. If maxRowsScanned is not 0, at
+// most that many rows in the time range are examined, in the query order.
+func (sc *DbShardCollection) Query(ctx context.Context, params QueryParams, maxRowsScanned uint64) (result QueryResult, err error) {
+	params, shards, err := sc.prepareQuery(params)
+	if err != nil {
+		return
+	}
+	if len(shards) == 0 {
+		return QueryResult{Rows: DbShardQueryResult{}}, nil
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	tasks := make([]*shardQueryTask, len(shards))
+	for i, shard := range shards {
+		tasks[i] = &shardQueryTask{shard: shard, budgetTaken: make(chan struct{})}
+		tasks[i].ctx, tasks[i].cancel = context.WithCancel(ctx)
+		if i > 0 {
+			tasks[i].prevBudgetTaken = tasks[i-1].budgetTaken
+		}
+		start, end, err := sc.instance.config.ShardNameToTimeSpan(shard.name)
+		switch {
+		case params.Ascending && err == nil:
+			tasks[i].first = TimeToMicro(start)
+		case params.Ascending:
+			tasks[i].first = math.MinInt64
+		case err == nil:
+			tasks[i].first = TimeToMicro(end)
+		default:
+			tasks[i].first = math.MaxInt64
 		}
 	}
+
+	var lock sync.Mutex
+	scanRemaining := maxRowsScanned
+	queue := make(chan *shardQueryTask, len(tasks))
+	for _, t := range tasks {
+		queue <- t
+	}
+	close(queue)
+	var wg sync.WaitGroup
+	for w := 0; w < sc.instance.queryWorkers() && w < len(tasks); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range queue {
+				scanLimit, unscannedTime := int64(-1), int64(0)
+				var err error
+				if maxRowsScanned > 0 {
+					// The scan budget is taken by the shards in order, newest first
+					if t.prevBudgetTaken != nil {
+						<-t.prevBudgetTaken
+					}
+					if t.ctx.Err() == nil {
+						scanLimit, unscannedTime, err = t.shard.takeScanBudget(t.ctx, params, &scanRemaining)
+					}
+				}
+				close(t.budgetTaken)
+				if t.ctx.Err() != nil {
+					continue
+				}
+				var res DbShardQueryResult
+				if err == nil {
+					res, err = t.shard.query(t.ctx, params, scanLimit)
+				}
+				t.cancel()
+				lock.Lock()
+				if err != nil {
+					if !t.cancelled {
+						t.err = err
+						if ctx.Err() == nil {
+							log.Println("Query error on shard", t.shard.name, err)
+						}
+					}
+					lock.Unlock()
+					continue
+				}
+				t.result = res
+				t.done = true
+				if scanLimit >= 0 {
+					t.truncated = true
+					t.first = unscannedTime
+				}
+				cancelUnneededShardQueries(tasks, params.Limit, params.Ascending)
+				lock.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	results := []DbShardQueryResult{}
+	for _, t := range tasks {
+		if t.done {
+			results = append(results, t.result)
+		}
+	}
+	result.Rows = mergeShardResults(results, int(params.Limit), params.Ascending)
+	if maxRowsScanned > 0 {
+		result.RowsScanned = maxRowsScanned - scanRemaining
+	}
+
+	// The result is partial if a shard which could contain messages before
+	// the last returned one wasn't fully searched.
+	var last map[string]interface{}
+	if len(result.Rows) == int(params.Limit) {
+		last = result.Rows[len(result.Rows)-1]
+		result.NextCursor = sc.newQueryCursor(last, params)
+	}
+	projectRows(result.Rows, params)
+	var firstErr error
+	for _, t := range tasks {
+		reason := ""
+		switch {
+		case t.cancelled:
+			continue
+		case t.truncated:
+			reason = QueryPartialMaxRowsScanned
+		case t.done:
+			continue
+		case ctx.Err() == context.DeadlineExceeded:
+			reason = QueryPartialTimeout
+		case ctx.Err() != nil:
+			reason = QueryPartialCancelled
+		default:
+			reason = QueryPartialError
+			if firstErr == nil {
+				firstErr = t.err
+			}
+		}
+		if t.after(last, params.Ascending) {
+			continue
+		}
+		if !result.Partial || reason == QueryPartialTimeout {
+			result.PartialReason = reason
+		}
+		result.Partial = true
+		result.IncompleteShards = append(result.IncompleteShards, t.shard.name)
+	}
+	if len(results) == 0 && firstErr != nil {
+		return QueryResult{}, firstErr
+	}
 	return
 }
 
-func (shard *DbShard) sqlQuery(query string) (result DbShardQueryResult, err error) {
-	log.Println(shard.name, "SQL:", query)
-	rows, err := shard.db.Query(query)
+type shardQueryTask struct {
+	shard     *DbShard
+	first     int64 // first possible timestamp of the shard's messages in the query order, in microseconds
+	ctx       context.Context
+	cancel    context.CancelFunc
+	cancelled bool
+	done      bool
+	truncated bool // not all rows were scanned
+	err       error
+	result    DbShardQueryResult
+
+	budgetTaken     chan struct{} // closed when the shard has taken its part of the scan budget
+	prevBudgetTaken chan struct{}
+}
+
+// after checks if all of the shard's messages (which haven't been scanned)
+// come after the row in the query order. A nil row comes after everything.
+func (t *shardQueryTask) after(row map[string]interface{}, ascending bool) bool {
+	if row == nil {
+		return false
+	}
+	ts, _ := row["timestamp"].(float64)
+	if ascending {
+		return float64(t.first)/1000000 >= ts
+	}
+	return float64(t.first)/1000000 <= ts
+}
+
+// cancelUnneededShardQueries cancels the queries on shards whose messages
+// all come after the first limit messages found so far.
+func cancelUnneededShardQueries(tasks []*shardQueryTask, limit uint32, ascending bool) {
+	results := []DbShardQueryResult{}
+	for _, t := range tasks {
+		if t.done {
+			results = append(results, t.result)
+		}
+	}
+	merged := mergeShardResults(results, int(limit), ascending)
+	if len(merged) < int(limit) {
+		return
+	}
+	last := merged[len(merged)-1]
+	for _, t := range tasks {
+		if !t.done && !t.cancelled && t.after(last, ascending) {
+			t.cancelled = true
+			t.cancel()
+		}
+	}
+}
+
+// takeScanBudget takes the rows in the time range from the remaining rows
+// which can be scanned. If there aren't enough, it returns the number of rows
+// which can be scanned in the shard, and the timestamp of the first row (in
+// the query order) which won't be scanned. Otherwise, scanLimit is -1.
+func (shard *DbShard) takeScanBudget(ctx context.Context, params QueryParams, remaining *uint64) (scanLimit, unscannedTime int64, err error) {
+	cond, args := shard.rangeCondition(params)
+	var n uint64
+	err = shard.db.QueryRowContext(ctx, fmt.Sprintf("SELECT COUNT(*) FROM (SELECT 1 FROM data WHERE %s LIMIT ?)", cond),
+		append(args, int64(*remaining)+1)...).Scan(&n)
+	if err != nil {
+		return
+	}
+	if n <= *remaining {
+		*remaining -= n
+		return -1, 0, nil
+	}
+	scanLimit = int64(*remaining)
+	*remaining = 0
+	err = shard.db.QueryRowContext(ctx, fmt.Sprintf("SELECT timestamp FROM data WHERE %s ORDER BY %s LIMIT 1 OFFSET ?", cond, shard.orderSQL(params)),
+		append(args, scanLimit)...).Scan(&unscannedTime)
+	return
+}
+
+// rangeCondition returns the SQL condition for the query's time range, and
+// its position after the cursor.
+func (shard *DbShard) rangeCondition(params QueryParams) (cond string, args []interface{}) {
+	cond = "timestamp BETWEEN ? AND ?"
+	args = []interface{}{params.TimeFrom, params.TimeTo}
+	if params.Cursor != nil {
+		cursorCond, cursorArgs := params.Cursor.sqlCondition(shard.name, shard.sortColumn(params.SortField))
+		cond += " AND " + cursorCond
+		args = append(args, cursorArgs...)
+	}
+	return
+}
+
+// orderSQL returns the ORDER BY clause for the query order: by timestamp,
+// then by the sort field, if the shard has it, then by id.
+func (shard *DbShard) orderSQL(params QueryParams) string {
+	dir := "DESC"
+	if params.Ascending {
+		dir = "ASC"
+	}
+	order := "timestamp " + dir
+	if column := shard.sortColumn(params.SortField); column != "" {
+		sortDir := "ASC"
+		if params.SortDescending {
+			sortDir = "DESC"
+		}
+		order += fmt.Sprintf(", %s %s", column, sortDir)
+	}
+	return order + ", id " + dir
+}
+
+// sortColumn returns the quoted column of the sort field, or "" if there's no
+// sort field or the shard doesn't have it.
+func (shard *DbShard) sortColumn(field string) string {
+	if field == "" || !shard.hasField(field) {
+		return ""
+	}
+	return quoteSQLIdentifier(field)
+}
+
+// selectColumns returns the columns to select for the query: all of them, or
+// id, timestamp, the requested fields and the sort field, of those the shard has.
+func (shard *DbShard) selectColumns(params QueryParams) string {
+	if params.Fields == nil {
+		return "*"
+	}
+	fields := append([]string{"id", "timestamp"}, params.Fields...)
+	if params.SortField != "" {
+		fields = append(fields, params.SortField)
+	}
+	columns := []string{}
+	selected := map[string]bool{}
+	for _, f := range fields {
+		if selected[f] || !shard.hasField(f) {
+			continue
+		}
+		selected[f] = true
+		columns = append(columns, quoteSQLIdentifier(f))
+	}
+	return strings.Join(columns, ", ")
+}
+
+// projectRows adds the requested fields which the rows don't have (because
+// their shards don't have them) as nil, and removes the sort field if it
+// wasn't requested.
+func projectRows(rows DbShardQueryResult, params QueryParams) {
+	if params.Fields == nil {
+		return
+	}
+	removeSortField := params.SortField != "" && !InStringArray(params.SortField, params.Fields)
+	for _, row := range rows {
+		for _, f := range params.Fields {
+			if _, found := row[f]; !found {
+				row[f] = nil
+			}
+		}
+		if removeSortField {
+			delete(row, params.SortField)
+		}
+	}
+}
+
+// query returns at most params.Limit messages from the shard, in the query
+// order. If scanLimit is not negative, only that many of the first messages
+// in the time range are examined.
+func (shard *DbShard) query(ctx context.Context, params QueryParams, scanLimit int64) (result DbShardQueryResult, err error) {
+	where, whereArgs, err := params.Query.ToSQL(shard.getFieldTypes(), shard.getFullTextFields())
+	if err != nil {
+		return
+	}
+	cond, args := shard.rangeCondition(params)
+	order := shard.orderSQL(params)
+	from := "data WHERE " + cond
+	if scanLimit >= 0 {
+		from = fmt.Sprintf("(SELECT * FROM data WHERE %s ORDER BY %s LIMIT ?) WHERE 1", cond, order)
+		args = append(args, scanLimit)
+	}
+	args = append(args, whereArgs...)
+	args = append(args, params.Limit)
+	result, err = shard.sqlQuery(ctx, fmt.Sprintf("SELECT %s FROM %s AND %s ORDER BY %s LIMIT ?", shard.selectColumns(params), from, where, order), args...)
+	if err != nil {
+		return
+	}
+	shard.addMessageIDs(result)
+	if err := shard.addFullTextSnippets(ctx, result, params.Query); err != nil {
+		log.Println("Full-text snippet error on shard", shard.name, err)
+	}
+	return
+}
+
+// shardResultHeap is used for the k-way merge of shard results, each sorted
+// by timestamp and id.
+type shardResultHeap struct {
+	ascending bool
+	results   []DbShardQueryResult
+	pos       []int // index of the next row in each result
+	heap      []int // indexes into results
+}
+
+func (h *shardResultHeap) row(i int) map[string]interface{} {
+	return h.results[h.heap[i]][h.pos[h.heap[i]]]
+}
+
+func (h *shardResultHeap) Len() int { return len(h.heap) }
+
+func (h *shardResultHeap) Less(i, j int) bool {
+	a, b := h.row(i), h.row(j)
+	ta, _ := a["timestamp"].(float64)
+	tb, _ := b["timestamp"].(float64)
+	if ta != tb {
+		return (ta < tb) == h.ascending
+	}
+	ia, _ := a["id"].(int64)
+	ib, _ := b["id"].(int64)
+	return (ia < ib) == h.ascending
+}
+
+func (h *shardResultHeap) Swap(i, j int) { h.heap[i], h.heap[j] = h.heap[j], h.heap[i] }
+
+func (h *shardResultHeap) Push(x interface{}) { h.heap = append(h.heap, x.(int)) }
+
+func (h *shardResultHeap) Pop() interface{} {
+	x := h.heap[len(h.heap)-1]
+	h.heap = h.heap[:len(h.heap)-1]
+	return x
+}
+
+// mergeShardResults merges the results, up to limit rows.
+func mergeShardResults(results []DbShardQueryResult, limit int, ascending bool) (merged DbShardQueryResult) {
+	merged = DbShardQueryResult{}
+	h := &shardResultHeap{ascending: ascending, results: results, pos: make([]int, len(results))}
+	for i, r := range results {
+		if len(r) > 0 {
+			h.heap = append(h.heap, i)
+		}
+	}
+	heap.Init(h)
+	for h.Len() > 0 && len(merged) < limit {
+		i := h.heap[0]
+		merged = append(merged, results[i][h.pos[i]])
+		h.pos[i]++
+		if h.pos[i] < len(results[i]) {
+			heap.Fix(h, 0)
+		} else {
+			heap.Pop(h)
+		}
+	}
+	return
+}
+
+func (shard *DbShard) sqlQuery(ctx context.Context, query string, args ...interface{}) (result DbShardQueryResult, err error) {
+	result = DbShardQueryResult{}
+	err = shard.sqlQueryEach(ctx, query, func(row map[string]interface{}) error {
+		result = append(result, row)
+		return nil
+	}, args...)
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+// sqlQueryEach runs the query and calls fn for each row, as it's read. It
+// stops at the first error returned by fn.
+func (shard *DbShard) sqlQueryEach(ctx context.Context, query string, fn func(row map[string]interface{}) error, args ...interface{}) (err error) {
+	log.Println(shard.name, "SQL:", query, args)
+	rows, err := shard.db.QueryContext(ctx, query, args...)
 	if err != nil {
 		return
 	}
@@ -363,32 +1161,55 @@ func (shard *DbShard) sqlQuery(query string) (result DbShardQueryResult, err err
 	if err != nil {
 		return
 	}
-	result = DbShardQueryResult{}
 	for rows.Next() {
 		row := make([]interface{}, len(columns))
 		for i := range row {
 			switch strings.ToUpper(columnTypes[i].DatabaseTypeName()) {
 			case "TEXT":
-				row[i] = new(string)
+				row[i] = new(sql.NullString)
 			case "INTEGER":
-				row[i] = new(int)
+				row[i] = new(sql.NullInt64)
 			case "NUMERIC":
-				row[i] = new(float64)
+				row[i] = new(sql.NullFloat64)
 			default:
 				log.Println("Unknown type:", columnTypes[i].DatabaseTypeName())
-				return nil, fmt.Errorf("Unknown type: %s", columnTypes[i].DatabaseTypeName())
+				return fmt.Errorf("Unknown type: %s", columnTypes[i].DatabaseTypeName())
 			}
 		}
 		err = rows.Scan(row...)
 		if err != nil {
-			return nil, fmt.Errorf("Error scanning row: %w", err)
+			return fmt.Errorf("Error scanning row: %w", err)
 		}
 		mrow := map[string]interface{}{}
 		for i := range row {
-			mrow[columns[i]] = row[i]
+			switch v := row[i].(type) {
+			case *sql.NullString:
+				if v.Valid {
+					mrow[columns[i]] = v.String
+				} else {
+					mrow[columns[i]] = nil
+				}
+			case *sql.NullInt64:
+				if !v.Valid {
+					mrow[columns[i]] = nil
+				} else if columns[i] == "timestamp" {
+					// Timestamps are returned in (fractional) seconds, as in GELF
+					mrow[columns[i]] = float64(v.Int64) / 1000000
+				} else {
+					mrow[columns[i]] = v.Int64
+				}
+			case *sql.NullFloat64:
+				if v.Valid {
+					mrow[columns[i]] = v.Float64
+				} else {
+					mrow[columns[i]] = nil
+				}
+			}
 		}
 		//log.Println(mrow)
-		result = append(result, mrow)
+		if err = fn(mrow); err != nil {
+			return
+		}
 	}
-	return
+	return rows.Err()
 }
@@ -0,0 +1,107 @@
+package logcore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+// Messages which can't be committed to shards because of their content, e.g.
+// a field name which SQLite rejects, are moved to dead_letters.json in the
+// data directory, one JSON document per line with the error and the GELF
+// message, so that they don't block the other messages. Other errors, e.g. a
+// full disk, are retried.
+
+const deadLettersFile = "dead_letters.json"
+
+type deadLetter struct {
+	Time    time.Time       `json:"time"`
+	Error   string          `json:"error"`
+	Message json.RawMessage `json:"message"`
+}
+
+// messageCommitError is returned by CommitMessagesToShards when committing a
+// message fails, with the index of the message in the messages it leaves.
+type messageCommitError struct {
+	index int
+	err   error
+}
+
+func (e *messageCommitError) Error() string {
+	return e.err.Error()
+}
+
+func (e *messageCommitError) Unwrap() error {
+	return e.err
+}
+
+// failedMessageIndex returns the index of the message which caused the commit
+// error, if the error is caused by the message and retrying won't help.
+func failedMessageIndex(err error) (index int, ok bool) {
+	var mErr *messageCommitError
+	var sqlErr sqlite3.Error
+	if !errors.As(err, &mErr) || !errors.As(err, &sqlErr) {
+		return 0, false
+	}
+	switch sqlErr.Code {
+	case sqlite3.ErrError, sqlite3.ErrTooBig, sqlite3.ErrConstraint, sqlite3.ErrMismatch, sqlite3.ErrRange:
+		return mErr.index, true
+	}
+	return 0, false
+}
+
+func (ci *CeruleanInstance) getDeadLettersFileName() string {
+	return fmt.Sprintf("%s/%s", ci.dataDir, deadLettersFile)
+}
+
+// commitMessages commits the messages to shards, moving those which can't be
+// committed because of their content to the dead letters file. If it fails,
+// the messages which weren't committed are left in messages.
+func (ci *CeruleanInstance) commitMessages(messages *[]BasicGelfMessage) (err error) {
+	for {
+		err = ci.shardCollection.CommitMessagesToShards(messages)
+		if err == nil {
+			return
+		}
+		i, ok := failedMessageIndex(err)
+		if !ok {
+			return
+		}
+		log.Println("Moving a message which can't be committed to", deadLettersFile+":", err)
+		if err = ci.writeDeadLetter(&(*messages)[i], err); err != nil {
+			return fmt.Errorf("Cannot write to %s: %w", deadLettersFile, err)
+		}
+		*messages = append((*messages)[:i:i], (*messages)[i+1:]...)
+	}
+}
+
+// writeDeadLetter appends the message and the error to the dead letters file.
+func (ci *CeruleanInstance) writeDeadLetter(msg *BasicGelfMessage, cause error) (err error) {
+	data, err := msg.MarshalGelf()
+	if err != nil {
+		return
+	}
+	line, err := json.Marshal(deadLetter{Time: time.Now().UTC(), Error: cause.Error(), Message: data})
+	if err != nil {
+		return
+	}
+	ci.deadLetters.WithLock(func() {
+		var f *os.File
+		f, err = os.OpenFile(ci.getDeadLettersFileName(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return
+		}
+		if _, err = f.Write(append(line, '\n')); err == nil {
+			err = f.Sync()
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	})
+	return
+}
@@ -0,0 +1,201 @@
+package logcore
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// The field catalog lists the fields of the shards in a time range. The counts
+// of messages having each field, and the most common values, are computed
+// from a sample of the newest messages of each shard, and extrapolated to all
+// the messages of the shard in the time range.
+
+const (
+	DefaultFieldsSampleRows = 10000
+	DefaultFieldsTopValues  = 5
+	// Maximum number of distinct values counted per field, to limit the
+	// memory used with large samples. Values first seen after that aren't
+	// counted, so the top values of fields with many distinct values are
+	// only approximate.
+	fieldsMaxDistinctValues = 1000
+)
+
+// Fields whose values are (nearly) unique, so their top values aren't listed
+var fieldsNoTopValues = []string{"id", "timestamp", "short_message", "full_message"}
+
+type FieldsParams struct {
+	TimeFrom   int64 // microseconds
+	TimeTo     int64 // microseconds
+	SampleRows int   // messages sampled per shard, 0 for DefaultFieldsSampleRows
+	TopValues  int   // number of top values per field, 0 for DefaultFieldsTopValues
+}
+
+type FieldValueCount struct {
+	Value interface{} `json:"value"`
+	Count int64       `json:"count"` // approximate
+}
+
+type FieldInfo struct {
+	Name      string            `json:"name"`
+	Type      string            `json:"type"`    // TEXT or NUMERIC, INTEGER for id and timestamp
+	Indexed   bool              `json:"indexed"` // in all the shards which have the field
+	Shards    []string          `json:"shards"`  // newest first
+	Count     int64             `json:"count"`   // approximate number of messages with a value
+	TopValues []FieldValueCount `json:"top_values,omitempty"`
+}
+
+// FieldsResult holds the field catalog. If reading the fields was aborted,
+// e.g. it timed out, Partial is set and the shards which weren't fully read
+// are listed in IncompleteShards.
+type FieldsResult struct {
+	Fields           []FieldInfo `json:"fields"`
+	Messages         int64       `json:"messages"`    // in the time range
+	Approximate      bool        `json:"approximate"` // if the counts were extrapolated from samples
+	Partial          bool        `json:"partial"`
+	PartialReason    string      `json:"partial_reason,omitempty"` // timeout or cancelled
+	IncompleteShards []string    `json:"incomplete_shards,omitempty"`
+}
+
+type fieldStats struct {
+	info   FieldInfo
+	values map[string]*FieldValueCount // by distinctKey
+}
+
+// Fields returns the fields of the shards overlapping the time range, sorted by
+// name. When ctx is done, the fields read so far are returned as a partial
+// result.
+func (sc *DbShardCollection) Fields(ctx context.Context, params FieldsParams) (result FieldsResult, err error) {
+	if params.SampleRows <= 0 {
+		params.SampleRows = DefaultFieldsSampleRows
+	}
+	if params.TopValues <= 0 {
+		params.TopValues = DefaultFieldsTopValues
+	}
+	shards, err := sc.queryShards(params.TimeFrom, params.TimeTo)
+	if err != nil {
+		return
+	}
+	stats := map[string]*fieldStats{}
+	for i, shard := range shards {
+		var sampled bool
+		sampled, err = shard.fieldStats(ctx, params, stats, &result.Messages)
+		if err != nil && ctx.Err() != nil {
+			result.Partial = true
+			result.PartialReason = QueryPartialCancelled
+			if ctx.Err() == context.DeadlineExceeded {
+				result.PartialReason = QueryPartialTimeout
+			}
+			for _, s := range shards[i:] {
+				result.IncompleteShards = append(result.IncompleteShards, s.name)
+			}
+			err = nil
+			break
+		}
+		if err != nil {
+			return result, fmt.Errorf("Error reading fields of shard %s: %w", shard.name, err)
+		}
+		result.Approximate = result.Approximate || sampled
+	}
+
+	result.Fields = make([]FieldInfo, 0, len(stats))
+	for _, fs := range stats {
+		info := fs.info
+		for _, vc := range fs.values {
+			info.TopValues = append(info.TopValues, *vc)
+		}
+		sort.Slice(info.TopValues, func(i, j int) bool {
+			if info.TopValues[i].Count != info.TopValues[j].Count {
+				return info.TopValues[i].Count > info.TopValues[j].Count
+			}
+			return compareSQLValues(info.TopValues[i].Value, info.TopValues[j].Value) < 0
+		})
+		if len(info.TopValues) > params.TopValues {
+			info.TopValues = info.TopValues[:params.TopValues]
+		}
+		result.Fields = append(result.Fields, info)
+	}
+	sort.Slice(result.Fields, func(i, j int) bool { return result.Fields[i].Name < result.Fields[j].Name })
+	return
+}
+
+// fieldStats adds the shard's fields, and their counts and values in a sample
+// of the shard's newest messages in the time range, to stats. It returns true
+// if the sample didn't include all of the shard's messages in the time range.
+func (shard *DbShard) fieldStats(ctx context.Context, params FieldsParams, stats map[string]*fieldStats, messages *int64) (sampled bool, err error) {
+	fieldTypes := shard.getFieldTypes()
+	var indexedFields []string
+	shard.WithRLock(func() {
+		indexedFields = append(indexedFields, shard.indexedFields...)
+	})
+	for fn, fnType := range fieldTypes {
+		fs, found := stats[fn]
+		if !found {
+			// Shards are read newest first, so the type is the one in the newest shard
+			fs = &fieldStats{info: FieldInfo{Name: fn, Type: fnType, Indexed: true}, values: map[string]*FieldValueCount{}}
+			stats[fn] = fs
+		}
+		fs.info.Shards = append(fs.info.Shards, shard.name)
+		// id is the primary key
+		fs.info.Indexed = fs.info.Indexed && (fn == "id" || InStringArraySorted(fn, indexedFields))
+	}
+
+	var total int64
+	err = shard.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM data WHERE timestamp BETWEEN ? AND ?", params.TimeFrom, params.TimeTo).Scan(&total)
+	if err != nil || total == 0 {
+		return
+	}
+	*messages += total
+
+	counts := map[string]int64{}
+	values := map[string]map[string]*FieldValueCount{}
+	var rowCount int64
+	err = shard.sqlQueryEach(ctx, "SELECT * FROM data WHERE timestamp BETWEEN ? AND ? ORDER BY timestamp DESC LIMIT ?", func(row map[string]interface{}) error {
+		rowCount++
+		for fn, v := range row {
+			if _, known := fieldTypes[fn]; !known {
+				// Added by a commit since fieldTypes was read
+				continue
+			}
+			if s, isString := v.(string); v == nil || isString && s == "" {
+				// Rows which existed before a text field was added have it set to ''
+				continue
+			}
+			counts[fn]++
+			if InStringArray(fn, fieldsNoTopValues) {
+				continue
+			}
+			if values[fn] == nil {
+				values[fn] = map[string]*FieldValueCount{}
+			}
+			key := distinctKey(v)
+			if vc, found := values[fn][key]; found {
+				vc.Count++
+			} else if len(values[fn]) < fieldsMaxDistinctValues {
+				values[fn][key] = &FieldValueCount{Value: v, Count: 1}
+			}
+		}
+		return nil
+	}, params.TimeFrom, params.TimeTo, params.SampleRows)
+	if err != nil || rowCount == 0 {
+		return
+	}
+
+	scale := float64(total) / float64(rowCount)
+	for fn, count := range counts {
+		stats[fn].info.Count += int64(math.Round(float64(count) * scale))
+	}
+	for fn, fieldValues := range values {
+		fs := stats[fn]
+		for key, vc := range fieldValues {
+			vc.Count = int64(math.Round(float64(vc.Count) * scale))
+			if existing, found := fs.values[key]; found {
+				existing.Count += vc.Count
+			} else if len(fs.values) < fieldsMaxDistinctValues {
+				fs.values[key] = vc
+			}
+		}
+	}
+	return rowCount < total, nil
+}
@@ -0,0 +1,323 @@
+package logcore
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"unicode"
+)
+
+// Each shard has an FTS5 table, data_fts, which indexes short_message,
+// full_message and the fields from full_text_field_list, with the data table
+// as its external content. It's created when the shard is opened, and kept up
+// to date in CommitMessageToShard. Changes to full_text_field_list only apply
+// to new shards.
+//
+// The go-sqlite3 driver only includes FTS5 when built with the sqlite_fts5
+// tag. Without it, full-text queries fall back to LIKE substring searches.
+
+const fullTextTable = "data_fts"
+
+// Fields which are always full-text indexed
+var fullTextBuiltinFields = []string{"short_message", "full_message"}
+
+const (
+	fullTextHighlightStart = "<mark>"
+	fullTextHighlightEnd   = "</mark>"
+	fullTextSnippetTokens  = 16
+)
+
+var fullTextUnavailableLogged int32
+
+// getFullTextFieldList returns the builtin and the configured full-text indexed fields.
+func (ci *CeruleanInstance) getFullTextFieldList() (fields []string) {
+	fields = append(fields, fullTextBuiltinFields...)
+	ci.configLock.WithRLock(func() {
+		for _, f := range ci.config.FullTextFieldList {
+			f = strings.TrimPrefix(f, "_")
+			if !reIdentifier.MatchString(f) {
+				log.Println("Ignoring invalid full_text_field_list entry:", f)
+				continue
+			}
+			if !InStringArray(f, fields) {
+				fields = append(fields, f)
+			}
+		}
+	})
+	return
+}
+
+// ensureFullText creates the full-text table if it doesn't exist, indexing
+// the existing data, or loads its list of fields.
+func (shard *DbShard) ensureFullText(db *sql.DB, fields []string) (err error) {
+	var name string
+	err = db.QueryRow("SELECT name FROM sqlite_master WHERE type='table' AND name=?", fullTextTable).Scan(&name)
+	if err == nil {
+		return shard.loadFullTextFields(db)
+	}
+	if err != sql.ErrNoRows {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+	dataFields := SortedStringSlice{}
+	shard.WithRLock(func() {
+		dataFields = append(dataFields, shard.dataFields...)
+	})
+	// The indexed fields must exist in the data table
+	newFields := []string{}
+	for _, f := range fields {
+		if InStringArraySorted(f, dataFields) {
+			continue
+		}
+		log.Printf("Adding column %s TEXT to %s", f, shard.name)
+		_, err = tx.Exec(fmt.Sprintf("ALTER TABLE data ADD COLUMN %s TEXT", quoteSQLIdentifier(f)))
+		if err == nil {
+			_, err = tx.Exec(fmt.Sprintf("UPDATE data SET %s=''", quoteSQLIdentifier(f)))
+		}
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		dataFields.Insert(f)
+		newFields = append(newFields, f)
+	}
+	quotedFields := make([]string, len(fields))
+	for i, f := range fields {
+		quotedFields[i] = quoteSQLIdentifier(f)
+	}
+	_, err = tx.Exec(fmt.Sprintf("CREATE VIRTUAL TABLE %s USING fts5(%s, content='data', content_rowid='id')", fullTextTable, strings.Join(quotedFields, ", ")))
+	if err != nil {
+		tx.Rollback()
+		if strings.Contains(err.Error(), "no such module: fts5") {
+			if atomic.CompareAndSwapInt32(&fullTextUnavailableLogged, 0, 1) {
+				log.Println("SQLite FTS5 is not available (build with -tags sqlite_fts5), full-text queries will be slow")
+			}
+			return nil
+		}
+		return fmt.Errorf("Cannot create full-text table on shard %s: %w", shard.name, err)
+	}
+	log.Printf("Creating full-text index on %s for shard %s", strings.Join(fields, ","), shard.name)
+	_, err = tx.Exec(fmt.Sprintf("INSERT INTO %s(%s) VALUES('rebuild')", fullTextTable, fullTextTable))
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("Cannot build full-text index on shard %s: %w", shard.name, err)
+	}
+	if err = tx.Commit(); err != nil {
+		return
+	}
+	shard.WithWLock(func() {
+		shard.dataFields = dataFields
+		for _, f := range newFields {
+			shard.dataFieldTypes[f] = "TEXT"
+		}
+		shard.fullTextFields = fields
+	})
+	return
+}
+
+func (shard *DbShard) loadFullTextFields(db *sql.DB) (err error) {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", fullTextTable))
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	fields := []string{}
+	for rows.Next() {
+		var col struct {
+			idx      int
+			name     string
+			type_    string
+			notnull  int
+			default_ sql.NullString
+			ispk     int
+		}
+		err = rows.Scan(&col.idx, &col.name, &col.type_, &col.notnull, &col.default_, &col.ispk)
+		if err != nil {
+			return
+		}
+		fields = append(fields, col.name)
+	}
+	shard.WithWLock(func() {
+		shard.fullTextFields = fields
+	})
+	return rows.Err()
+}
+
+// getFullTextFields returns the list of full-text indexed fields, or nil if
+// the shard doesn't have a full-text index.
+func (shard *DbShard) getFullTextFields() (fields []string) {
+	shard.WithRLock(func() {
+		fields = shard.fullTextFields
+	})
+	return
+}
+
+// addFullText indexes the message, which has been inserted into the data table with the given id.
+func (shard *DbShard) addFullText(tx *sql.Tx, id int64, msg *BasicGelfMessage) (err error) {
+	fields := shard.getFullTextFields()
+	if len(fields) == 0 {
+		return
+	}
+	quotedFields := make([]string, len(fields))
+	placeholders := make([]string, len(fields))
+	args := []interface{}{id}
+	for i, f := range fields {
+		quotedFields[i] = quoteSQLIdentifier(f)
+		placeholders[i] = "?"
+		args = append(args, messageFieldValue(msg, f))
+	}
+	_, err = tx.Exec(fmt.Sprintf("INSERT INTO %s(rowid, %s) VALUES(?, %s)", fullTextTable, strings.Join(quotedFields, ", "), strings.Join(placeholders, ", ")), args...)
+	return
+}
+
+// messageFieldValue returns the value of the field as stored in the data
+// table, or nil if the message doesn't have it.
+func messageFieldValue(msg *BasicGelfMessage, field string) interface{} {
+	switch field {
+	case "timestamp":
+		return msg.Timestamp
+	case "short_message":
+		return msg.ShortMessage
+	case "full_message":
+		return msg.FullMessage
+	case "host":
+		return msg.Host
+	case "facility":
+		return msg.Facility
+	}
+	if v, found := msg.AdditionalNumbers[field]; found {
+		return v
+	}
+	if s := msg.AdditionalStrings[field]; len(s) > 0 {
+		return s
+	}
+	return nil
+}
+
+// fullTextFallbackPattern converts a full-text query into a LIKE pattern
+// which matches its words in order, used when FTS5 isn't available.
+func fullTextFallbackPattern(expr string) string {
+	words := []string{}
+	for _, w := range strings.FieldsFunc(expr, func(c rune) bool {
+		return unicode.IsSpace(c) || strings.ContainsRune(`"*^():{}+`, c)
+	}) {
+		if w == "AND" || w == "OR" || w == "NOT" || w == "NEAR" {
+			continue
+		}
+		words = append(words, escapeLike(w))
+	}
+	return "%" + strings.Join(words, "%") + "%"
+}
+
+// fullTextQuote quotes a string as an FTS5 phrase.
+func fullTextQuote(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
+
+// NewQueryMatch returns a node matching the full-text query expr on the
+// field, or on all the full-text indexed fields if field is empty.
+func NewQueryMatch(field, expr string) *QueryNode {
+	return &QueryNode{Type: QueryMatch, Field: field, Values: []QueryValue{NewQueryString(expr), NewQueryString(fullTextFallbackPattern(expr))}}
+}
+
+// fullTextExpr returns the FTS5 query for a QueryMatch node.
+func (n *QueryNode) fullTextExpr() string {
+	if n.Field == "" {
+		return n.Values[0].Str
+	}
+	return fmt.Sprintf("{%s} : (%s)", n.Field, n.Values[0].Str)
+}
+
+// fullTextMatch returns an FTS5 query which matches any of the full-text
+// conditions in the query which aren't negated, or "" if there are none.
+func (n *QueryNode) fullTextMatch(fullTextFields []string) string {
+	if n == nil {
+		return ""
+	}
+	switch n.Type {
+	case QueryNot:
+		return ""
+	case QueryMatch:
+		if n.Field == "" || InStringArray(n.Field, fullTextFields) {
+			return n.fullTextExpr()
+		}
+		return ""
+	}
+	parts := []string{}
+	for _, c := range n.Children {
+		if m := c.fullTextMatch(fullTextFields); m != "" {
+			parts = append(parts, "("+m+")")
+		}
+	}
+	return strings.Join(parts, " OR ")
+}
+
+// addFullTextSnippets adds the relevance score (_score, higher is better),
+// a snippet of the best matching field (_snippet), and the highlighted
+// matching fields (_highlight) to the rows matched by the full-text
+// conditions in the query.
+func (shard *DbShard) addFullTextSnippets(ctx context.Context, rows DbShardQueryResult, query *QueryNode) (err error) {
+	fields := shard.getFullTextFields()
+	if len(fields) == 0 || len(rows) == 0 {
+		return
+	}
+	match := query.fullTextMatch(fields)
+	if match == "" {
+		return
+	}
+	rowsByID := map[int64]map[string]interface{}{}
+	ids := []string{}
+	for _, row := range rows {
+		if id, ok := row["id"].(int64); ok {
+			rowsByID[id] = row
+			ids = append(ids, strconv.FormatInt(id, 10))
+		}
+	}
+	start, end := quoteSQLString(fullTextHighlightStart), quoteSQLString(fullTextHighlightEnd)
+	highlights := ""
+	for i := range fields {
+		highlights += fmt.Sprintf(", highlight(%s, %d, %s, %s)", fullTextTable, i, start, end)
+	}
+	sqlString := fmt.Sprintf("SELECT rowid, bm25(%s), snippet(%s, -1, %s, %s, '…', %d)%s FROM %s WHERE %s MATCH ? AND rowid IN (%s)",
+		fullTextTable, fullTextTable, start, end, fullTextSnippetTokens, highlights, fullTextTable, fullTextTable, strings.Join(ids, ","))
+	res, err := shard.db.QueryContext(ctx, sqlString, match)
+	if err != nil {
+		return
+	}
+	defer res.Close()
+	for res.Next() {
+		var id int64
+		var score float64
+		var snippet sql.NullString
+		highlighted := make([]sql.NullString, len(fields))
+		dest := []interface{}{&id, &score, &snippet}
+		for i := range highlighted {
+			dest = append(dest, &highlighted[i])
+		}
+		if err = res.Scan(dest...); err != nil {
+			return
+		}
+		row := rowsByID[id]
+		if row == nil {
+			continue
+		}
+		row["_score"] = -score
+		row["_snippet"] = snippet.String
+		hl := map[string]string{}
+		for i, h := range highlighted {
+			if strings.Contains(h.String, fullTextHighlightStart) {
+				hl[fields[i]] = h.String
+			}
+		}
+		row["_highlight"] = hl
+	}
+	return res.Err()
+}
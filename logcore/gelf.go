@@ -3,6 +3,7 @@ package logcore
 import (
 	"encoding/json"
 	"fmt"
+	"math"
 	"regexp"
 )
 
@@ -14,7 +15,7 @@ type BasicGelfMessage struct {
 	Facility          string             `json:"facility"`
 	ShortMessage      string             `json:"short_message"`
 	FullMessage       string             `json:"full_message"`
-	Timestamp         uint32             `json:"timestamp"`
+	Timestamp         int64              `json:"timestamp"` // Microseconds since the Unix epoch
 	AdditionalStrings map[string]string  `json:"-"`
 	AdditionalNumbers map[string]float64 `json:"-"`
 }
@@ -68,7 +69,7 @@ func ParseGelfMessage(data []byte) (msg BasicGelfMessage, err error) {
 				err = fmt.Errorf("Number expected at %s", k)
 				return
 			}
-			msg.Timestamp = uint32(v2)
+			msg.Timestamp = int64(math.Round(v2 * 1e6))
 		default:
 			if len(k) == 0 {
 				err = fmt.Errorf("0-length key")
@@ -100,3 +101,30 @@ func ParseGelfMessage(data []byte) (msg BasicGelfMessage, err error) {
 	}
 	return
 }
+
+// MarshalGelf converts the message back to a GELF JSON document, which can
+// be parsed by ParseGelfMessage.
+func (msg *BasicGelfMessage) MarshalGelf() ([]byte, error) {
+	generic := map[string]interface{}{
+		"version":       msg.Version,
+		"host":          msg.Host,
+		"short_message": msg.ShortMessage,
+		"timestamp":     float64(msg.Timestamp) / 1000000,
+	}
+	if msg.Version == "" {
+		generic["version"] = "1.1"
+	}
+	if msg.Facility != "" {
+		generic["facility"] = msg.Facility
+	}
+	if msg.FullMessage != "" {
+		generic["full_message"] = msg.FullMessage
+	}
+	for k, v := range msg.AdditionalStrings {
+		generic["_"+k] = v
+	}
+	for k, v := range msg.AdditionalNumbers {
+		generic["_"+k] = v
+	}
+	return json.Marshal(generic)
+}
@@ -0,0 +1,191 @@
+package logcore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"time"
+)
+
+// GELF chunked messages are described at https://go2docs.graylog.org/current/getting_in_log_data/gelf.html .
+// Each chunk starts with a 12-byte header:
+// - 2 bytes of magic (0x1e 0x0f)
+// - 8 bytes of message ID
+// - 1 byte sequence number (starting at 0)
+// - 1 byte sequence count (max 128)
+
+const (
+	gelfChunkHeaderSize = 12
+	gelfMaxChunks       = 128
+)
+
+type gelfChunkedMessage struct {
+	chunks    [][]byte
+	received  int
+	size      int
+	firstSeen time.Time
+}
+
+// GelfChunkAssembler reassembles chunked GELF datagrams. Incomplete messages
+// are discarded after Timeout, and the total size of all incomplete messages
+// is kept below MaxBytes.
+type GelfChunkAssembler struct {
+	WithMutex
+	Timeout  time.Duration
+	MaxBytes int
+	pending  map[[8]byte]*gelfChunkedMessage
+	size     int
+}
+
+func NewGelfChunkAssembler(timeout time.Duration, maxBytes int) *GelfChunkAssembler {
+	return &GelfChunkAssembler{
+		Timeout:  timeout,
+		MaxBytes: maxBytes,
+		pending:  map[[8]byte]*gelfChunkedMessage{},
+	}
+}
+
+// IsGelfChunk checks if the datagram starts with the GELF chunk magic bytes.
+func IsGelfChunk(data []byte) bool {
+	return len(data) >= 2 && data[0] == 0x1e && data[1] == 0x0f
+}
+
+// HandleDatagram accepts a single GELF datagram, which can be a plain, compressed
+// or chunked message. If the datagram completes a message, its decompressed
+// payload is returned, otherwise the payload is nil.
+func (a *GelfChunkAssembler) HandleDatagram(data []byte) (payload []byte, err error) {
+	if IsGelfChunk(data) {
+		data, err = a.addChunk(data)
+		if err != nil || data == nil {
+			return
+		}
+	}
+	return DecompressGelfPayload(data, a.MaxBytes)
+}
+
+func (a *GelfChunkAssembler) addChunk(data []byte) (msg []byte, err error) {
+	if len(data) < gelfChunkHeaderSize {
+		return nil, fmt.Errorf("GELF chunk too short: %d bytes", len(data))
+	}
+	var msgID [8]byte
+	copy(msgID[:], data[2:10])
+	seqNum := int(data[10])
+	seqCount := int(data[11])
+	if seqCount == 0 || seqCount > gelfMaxChunks {
+		return nil, fmt.Errorf("Invalid GELF chunk count: %d", seqCount)
+	}
+	if seqNum >= seqCount {
+		return nil, fmt.Errorf("Invalid GELF chunk sequence number %d of %d", seqNum, seqCount)
+	}
+	chunk := make([]byte, len(data)-gelfChunkHeaderSize)
+	copy(chunk, data[gelfChunkHeaderSize:])
+
+	a.WithLock(func() {
+		m, found := a.pending[msgID]
+		if !found {
+			m = &gelfChunkedMessage{
+				chunks:    make([][]byte, seqCount),
+				firstSeen: time.Now(),
+			}
+			a.pending[msgID] = m
+		} else if len(m.chunks) != seqCount {
+			err = fmt.Errorf("GELF chunk count mismatch for message %x: %d vs %d", msgID, seqCount, len(m.chunks))
+			return
+		}
+		if m.chunks[seqNum] != nil {
+			// Duplicate chunk, ignore it
+			return
+		}
+		if a.size+len(chunk) > a.MaxBytes {
+			a.evictOldest(len(chunk))
+			if _, found = a.pending[msgID]; !found {
+				// This message was the oldest one, and was evicted
+				err = fmt.Errorf("GELF chunk buffer full, dropping message %x", msgID)
+				return
+			}
+			if a.size+len(chunk) > a.MaxBytes {
+				a.remove(msgID)
+				err = fmt.Errorf("GELF chunk buffer full, dropping message %x", msgID)
+				return
+			}
+		}
+		m.chunks[seqNum] = chunk
+		m.received++
+		m.size += len(chunk)
+		a.size += len(chunk)
+		if m.received == seqCount {
+			msg = bytes.Join(m.chunks, nil)
+			a.remove(msgID)
+		}
+	})
+	return
+}
+
+func (a *GelfChunkAssembler) remove(msgID [8]byte) {
+	if m, found := a.pending[msgID]; found {
+		a.size -= m.size
+		delete(a.pending, msgID)
+	}
+}
+
+// evictOldest drops the oldest incomplete messages until there's room for
+// at least the given number of bytes. Must be called with the lock held.
+func (a *GelfChunkAssembler) evictOldest(needed int) {
+	for a.size+needed > a.MaxBytes && len(a.pending) > 0 {
+		var oldestID [8]byte
+		var oldest *gelfChunkedMessage
+		for id, m := range a.pending {
+			if oldest == nil || m.firstSeen.Before(oldest.firstSeen) {
+				oldestID = id
+				oldest = m
+			}
+		}
+		log.Printf("GELF chunk buffer full, dropping incomplete message %x (%d of %d chunks)", oldestID, oldest.received, len(oldest.chunks))
+		a.remove(oldestID)
+	}
+}
+
+// Expire drops incomplete messages older than Timeout, and returns the number
+// of dropped messages.
+func (a *GelfChunkAssembler) Expire() (expired int) {
+	a.WithLock(func() {
+		for id, m := range a.pending {
+			if time.Since(m.firstSeen) > a.Timeout {
+				a.remove(id)
+				expired++
+			}
+		}
+	})
+	return
+}
+
+// DecompressGelfPayload detects gzip and zlib compressed GELF payloads and
+// decompresses them, up to maxBytes of output. Uncompressed payloads are
+// returned as-is.
+func DecompressGelfPayload(data []byte, maxBytes int) (payload []byte, err error) {
+	var r io.ReadCloser
+	switch {
+	case len(data) >= 2 && data[0] == 0x1f && data[1] == 0x8b:
+		r, err = gzip.NewReader(bytes.NewReader(data))
+	case len(data) >= 2 && data[0]&0x0f == 0x08 && (uint16(data[0])<<8|uint16(data[1]))%31 == 0:
+		r, err = zlib.NewReader(bytes.NewReader(data))
+	default:
+		return data, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Cannot decompress GELF payload: %w", err)
+	}
+	defer r.Close()
+	payload, err = ioutil.ReadAll(io.LimitReader(r, int64(maxBytes)+1))
+	if err != nil {
+		return nil, fmt.Errorf("Cannot decompress GELF payload: %w", err)
+	}
+	if len(payload) > maxBytes {
+		return nil, fmt.Errorf("Decompressed GELF payload larger than %d bytes", maxBytes)
+	}
+	return
+}
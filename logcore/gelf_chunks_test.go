@@ -0,0 +1,176 @@
+package logcore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"testing"
+	"time"
+)
+
+func gelfChunk(id byte, seqNum, seqCount int, payload string) []byte {
+	chunk := []byte{0x1e, 0x0f, id, 0, 0, 0, 0, 0, 0, 0, byte(seqNum), byte(seqCount)}
+	return append(chunk, payload...)
+}
+
+func gzipData(t *testing.T, data string) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestGelfChunkAssembler(t *testing.T) {
+	tests := []struct {
+		name      string
+		maxBytes  int
+		datagrams [][]byte
+		payloads  []string // expected payload for each datagram, "" for none
+		errs      []bool   // if an error is expected for each datagram
+	}{
+		{
+			name:      "plain message",
+			maxBytes:  100,
+			datagrams: [][]byte{[]byte(`{"a":1}`)},
+			payloads:  []string{`{"a":1}`},
+			errs:      []bool{false},
+		},
+		{
+			name:      "single chunk",
+			maxBytes:  100,
+			datagrams: [][]byte{gelfChunk(1, 0, 1, "abc")},
+			payloads:  []string{"abc"},
+			errs:      []bool{false},
+		},
+		{
+			name:      "chunks out of order",
+			maxBytes:  100,
+			datagrams: [][]byte{gelfChunk(1, 2, 3, "ghi"), gelfChunk(1, 0, 3, "abc"), gelfChunk(1, 1, 3, "def")},
+			payloads:  []string{"", "", "abcdefghi"},
+			errs:      []bool{false, false, false},
+		},
+		{
+			name:      "duplicate chunk",
+			maxBytes:  100,
+			datagrams: [][]byte{gelfChunk(1, 0, 2, "abc"), gelfChunk(1, 0, 2, "xyz"), gelfChunk(1, 1, 2, "def")},
+			payloads:  []string{"", "", "abcdef"},
+			errs:      []bool{false, false, false},
+		},
+		{
+			name:      "interleaved messages",
+			maxBytes:  100,
+			datagrams: [][]byte{gelfChunk(1, 0, 2, "abc"), gelfChunk(2, 0, 2, "123"), gelfChunk(2, 1, 2, "456"), gelfChunk(1, 1, 2, "def")},
+			payloads:  []string{"", "", "123456", "abcdef"},
+			errs:      []bool{false, false, false, false},
+		},
+		{
+			name:      "too short",
+			maxBytes:  100,
+			datagrams: [][]byte{{0x1e, 0x0f, 1, 2, 3}},
+			payloads:  []string{""},
+			errs:      []bool{true},
+		},
+		{
+			name:      "zero chunk count",
+			maxBytes:  100,
+			datagrams: [][]byte{gelfChunk(1, 0, 0, "abc")},
+			payloads:  []string{""},
+			errs:      []bool{true},
+		},
+		{
+			name:      "too many chunks",
+			maxBytes:  100,
+			datagrams: [][]byte{gelfChunk(1, 0, gelfMaxChunks+1, "abc")},
+			payloads:  []string{""},
+			errs:      []bool{true},
+		},
+		{
+			name:      "sequence number out of range",
+			maxBytes:  100,
+			datagrams: [][]byte{gelfChunk(1, 2, 2, "abc")},
+			payloads:  []string{""},
+			errs:      []bool{true},
+		},
+		{
+			name:      "chunk count mismatch",
+			maxBytes:  100,
+			datagrams: [][]byte{gelfChunk(1, 0, 2, "abc"), gelfChunk(1, 1, 3, "def")},
+			payloads:  []string{"", ""},
+			errs:      []bool{false, true},
+		},
+		{
+			name:      "oldest message evicted",
+			maxBytes:  6,
+			datagrams: [][]byte{gelfChunk(1, 0, 2, "abc"), gelfChunk(2, 0, 2, "123"), gelfChunk(2, 1, 2, "456"), gelfChunk(1, 1, 2, "def")},
+			payloads:  []string{"", "", "123456", ""},
+			errs:      []bool{false, false, false, false},
+		},
+		{
+			// The message of the chunk is the oldest one, so it's evicted to
+			// make room for its own chunk, which must then be dropped too.
+			name:      "own message evicted",
+			maxBytes:  5,
+			datagrams: [][]byte{gelfChunk(1, 0, 2, "abc"), gelfChunk(1, 1, 2, "def"), gelfChunk(1, 0, 2, "ab"), gelfChunk(1, 1, 2, "de")},
+			payloads:  []string{"", "", "", "abde"},
+			errs:      []bool{false, true, false, false},
+		},
+		{
+			name:      "chunk larger than the buffer",
+			maxBytes:  2,
+			datagrams: [][]byte{gelfChunk(1, 0, 2, "abc")},
+			payloads:  []string{""},
+			errs:      []bool{true},
+		},
+		{
+			name:      "compressed chunks",
+			maxBytes:  1000,
+			datagrams: [][]byte{gelfChunk(1, 0, 1, string(gzipData(t, `{"a":1}`)))},
+			payloads:  []string{`{"a":1}`},
+			errs:      []bool{false},
+		},
+		{
+			name:      "decompressed payload too large",
+			maxBytes:  100,
+			datagrams: [][]byte{gzipData(t, string(make([]byte, 101)))},
+			payloads:  []string{""},
+			errs:      []bool{true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := NewGelfChunkAssembler(time.Minute, tt.maxBytes)
+			for i, data := range tt.datagrams {
+				// So that the oldest message is well defined
+				time.Sleep(time.Millisecond)
+				payload, err := a.HandleDatagram(data)
+				if (err != nil) != tt.errs[i] {
+					t.Fatalf("datagram %d: unexpected error: %v", i, err)
+				}
+				if string(payload) != tt.payloads[i] {
+					t.Fatalf("datagram %d: expected payload %q, got %q", i, tt.payloads[i], payload)
+				}
+				if a.size < 0 || a.size > a.MaxBytes {
+					t.Fatalf("datagram %d: buffer size %d out of range", i, a.size)
+				}
+			}
+		})
+	}
+}
+
+func TestGelfChunkAssemblerExpire(t *testing.T) {
+	a := NewGelfChunkAssembler(time.Millisecond, 100)
+	if _, err := a.HandleDatagram(gelfChunk(1, 0, 2, "abc")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if expired := a.Expire(); expired != 1 {
+		t.Fatalf("expected 1 expired message, got %d", expired)
+	}
+	if a.size != 0 || len(a.pending) != 0 {
+		t.Fatalf("expected an empty buffer, got %d bytes in %d messages", a.size, len(a.pending))
+	}
+}
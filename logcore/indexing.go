@@ -0,0 +1,304 @@
+package logcore
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Entries in index_field_list are field names, or comma-separated lists of
+// field names for composite indexes, e.g. "host,facility". Indexes are created
+// on each shard as soon as all their fields exist in it.
+
+// Indexes which are always created with the shard and cannot be dropped
+var builtinIndexFields = []string{"facility", "host", "timestamp"}
+
+type sqlExecer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// IndexJob describes a background operation which creates or drops an index on all shards.
+type IndexJob struct {
+	ID          int       `json:"id"`
+	Operation   string    `json:"operation"` // "create" or "drop"
+	Fields      []string  `json:"fields"`
+	TotalShards int       `json:"total_shards"`
+	DoneShards  int       `json:"done_shards"`
+	Errors      []string  `json:"errors"`
+	Started     time.Time `json:"started"`
+	Finished    bool      `json:"finished"`
+}
+
+type indexJobList struct {
+	WithMutex
+	jobs    []*IndexJob
+	nextID  int
+	runLock sync.Mutex // Jobs are run one at a time
+}
+
+// ParseIndexSpec parses an index_field_list entry into a list of field names.
+func ParseIndexSpec(spec string) (fields []string, err error) {
+	for _, f := range strings.Split(spec, ",") {
+		f = strings.TrimPrefix(strings.TrimSpace(f), "_")
+		if !reIdentifier.MatchString(f) {
+			return nil, fmt.Errorf("Invalid field name in index spec: '%s'", f)
+		}
+		if InStringArray(f, fields) {
+			return nil, fmt.Errorf("Duplicate field in index spec: '%s'", f)
+		}
+		fields = append(fields, f)
+	}
+	return
+}
+
+func indexSpecString(fields []string) string {
+	return strings.Join(fields, ",")
+}
+
+func indexNameForFields(fields []string) string {
+	return "idx_data_" + strings.Join(fields, "__")
+}
+
+// ensureIndexes creates the indexes from the given specs which are possible
+// on this shard, i.e. whose fields all exist.
+func (shard *DbShard) ensureIndexes(db sqlExecer, specs [][]string) (err error) {
+	for _, fields := range specs {
+		if _, err = shard.createIndex(db, fields); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// createIndex creates an index on the given fields if they all exist in the
+// shard and the index doesn't exist yet.
+func (shard *DbShard) createIndex(db sqlExecer, fields []string) (created bool, err error) {
+	name := indexNameForFields(fields)
+	possible := true
+	shard.WithRLock(func() {
+		if _, exists := shard.indexes[name]; exists {
+			possible = false
+			return
+		}
+		for _, f := range fields {
+			if !InStringArraySorted(f, shard.dataFields) {
+				possible = false
+				return
+			}
+		}
+	})
+	if !possible {
+		return
+	}
+	quotedFields := make([]string, len(fields))
+	for i, f := range fields {
+		quotedFields[i] = quoteSQLIdentifier(f)
+	}
+	log.Printf("Creating index %s on shard %s", name, shard.name)
+	_, err = db.Exec(fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON data(%s)", quoteSQLIdentifier(name), strings.Join(quotedFields, ",")))
+	if err != nil {
+		return false, fmt.Errorf("Cannot create index %s on shard %s: %w", name, shard.name, err)
+	}
+	shard.WithWLock(func() {
+		shard.indexes[name] = fields
+		shard.updateIndexedFields()
+	})
+	return true, nil
+}
+
+// dropIndex drops the index on the given fields, if it exists.
+func (shard *DbShard) dropIndex(db sqlExecer, fields []string) (dropped bool, err error) {
+	name := indexNameForFields(fields)
+	var exists bool
+	shard.WithRLock(func() {
+		_, exists = shard.indexes[name]
+	})
+	if !exists {
+		return
+	}
+	log.Printf("Dropping index %s on shard %s", name, shard.name)
+	_, err = db.Exec(fmt.Sprintf("DROP INDEX IF EXISTS %s", quoteSQLIdentifier(name)))
+	if err != nil {
+		return false, fmt.Errorf("Cannot drop index %s on shard %s: %w", name, shard.name, err)
+	}
+	shard.WithWLock(func() {
+		delete(shard.indexes, name)
+		shard.updateIndexedFields()
+	})
+	return true, nil
+}
+
+// updateIndexedFields rebuilds indexedFields from indexes. Must be called with the lock held.
+func (shard *DbShard) updateIndexedFields() {
+	indexedFields := SortedStringSlice{}
+	for _, fields := range shard.indexes {
+		for _, f := range fields {
+			if !InStringArraySorted(f, indexedFields) {
+				indexedFields.Insert(f)
+			}
+		}
+	}
+	shard.indexedFields = indexedFields
+}
+
+// getIndexSpecs returns the parsed list of configured indexes.
+func (ci *CeruleanInstance) getIndexSpecs() (specs [][]string) {
+	ci.configLock.WithRLock(func() {
+		for _, spec := range ci.config.IndexFieldList {
+			fields, err := ParseIndexSpec(spec)
+			if err != nil {
+				log.Println("Ignoring index_field_list entry:", err)
+				continue
+			}
+			specs = append(specs, fields)
+		}
+	})
+	return
+}
+
+// IndexFieldList returns the list of configured indexes.
+func (ci *CeruleanInstance) IndexFieldList() (list []string) {
+	ci.configLock.WithRLock(func() {
+		list = append([]string{}, ci.config.IndexFieldList...)
+	})
+	return
+}
+
+// AddIndex adds an index on the given fields to the configuration, and starts
+// a background job which creates it on all existing shards.
+func (ci *CeruleanInstance) AddIndex(fields []string) (job IndexJob, err error) {
+	fields, err = ParseIndexSpec(indexSpecString(fields))
+	if err != nil {
+		return
+	}
+	spec := indexSpecString(fields)
+	ci.configLock.WithWLock(func() {
+		if InStringArray(spec, ci.config.IndexFieldList) {
+			return
+		}
+		ci.config.IndexFieldList = append(ci.config.IndexFieldList, spec)
+		err = WriteCeruleanConfig(ci.getConfigFileName(), ci.config)
+	})
+	if err != nil {
+		return
+	}
+	return ci.startIndexJob("create", fields), nil
+}
+
+// DropIndex removes an index on the given fields from the configuration, and
+// starts a background job which drops it from all existing shards.
+func (ci *CeruleanInstance) DropIndex(fields []string) (job IndexJob, err error) {
+	fields, err = ParseIndexSpec(indexSpecString(fields))
+	if err != nil {
+		return
+	}
+	if len(fields) == 1 && InStringArray(fields[0], builtinIndexFields) {
+		return job, fmt.Errorf("Cannot drop the built-in index on %s", fields[0])
+	}
+	spec := indexSpecString(fields)
+	ci.configLock.WithWLock(func() {
+		list := []string{}
+		for _, s := range ci.config.IndexFieldList {
+			if s != spec {
+				list = append(list, s)
+			}
+		}
+		if len(list) != len(ci.config.IndexFieldList) {
+			ci.config.IndexFieldList = list
+			err = WriteCeruleanConfig(ci.getConfigFileName(), ci.config)
+		}
+	})
+	if err != nil {
+		return
+	}
+	return ci.startIndexJob("drop", fields), nil
+}
+
+// IndexJobs returns the state of all the index jobs started since startup.
+func (ci *CeruleanInstance) IndexJobs() (jobs []IndexJob) {
+	jobs = []IndexJob{}
+	ci.indexJobs.WithLock(func() {
+		for _, job := range ci.indexJobs.jobs {
+			jobs = append(jobs, job.copy())
+		}
+	})
+	return
+}
+
+func (job *IndexJob) copy() IndexJob {
+	j := *job
+	j.Fields = append([]string{}, job.Fields...)
+	j.Errors = append([]string{}, job.Errors...)
+	return j
+}
+
+func (ci *CeruleanInstance) startIndexJob(operation string, fields []string) IndexJob {
+	var job *IndexJob
+	ci.indexJobs.WithLock(func() {
+		ci.indexJobs.nextID++
+		job = &IndexJob{
+			ID:        ci.indexJobs.nextID,
+			Operation: operation,
+			Fields:    fields,
+			Errors:    []string{},
+			Started:   time.Now(),
+		}
+		ci.indexJobs.jobs = append(ci.indexJobs.jobs, job)
+	})
+	go ci.runIndexJob(job)
+	return job.copy()
+}
+
+func (ci *CeruleanInstance) runIndexJob(job *IndexJob) {
+	ci.indexJobs.runLock.Lock()
+	defer ci.indexJobs.runLock.Unlock()
+
+	var shardNames []string
+	ci.shardCollection.WithRLock(func() {
+		shardNames = append(shardNames, ci.shardCollection.shardNames...)
+	})
+	ci.indexJobs.WithLock(func() {
+		job.TotalShards = len(shardNames)
+	})
+	log.Printf("Starting index job %d: %s index on %s for %d shards", job.ID, job.Operation, indexSpecString(job.Fields), len(shardNames))
+
+	for _, name := range shardNames {
+		err := ci.runIndexJobOnShard(job, name)
+		ci.indexJobs.WithLock(func() {
+			job.DoneShards++
+			if err != nil {
+				job.Errors = append(job.Errors, err.Error())
+			}
+		})
+		if err != nil {
+			log.Println("Index job", job.ID, "error:", err)
+		}
+	}
+	ci.indexJobs.WithLock(func() {
+		job.Finished = true
+	})
+	log.Printf("Finished index job %d", job.ID)
+}
+
+func (ci *CeruleanInstance) runIndexJobOnShard(job *IndexJob, shardName string) (err error) {
+	_, id, err := ci.config.ShardNameToTsID(shardName)
+	if err != nil {
+		return
+	}
+	shard, err := ci.shardCollection.getShardByNameID(shardName, id, false)
+	if err == ErrShardNotFound {
+		// Deleted by the janitor since the job started
+		return nil
+	} else if err != nil {
+		return
+	}
+	if job.Operation == "drop" {
+		_, err = shard.dropIndex(shard.db, job.Fields)
+	} else {
+		_, err = shard.createIndex(shard.db, job.Fields)
+	}
+	return
+}
@@ -0,0 +1,255 @@
+package logcore
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// The journal is an append-only on-disk copy of the messages in the memory
+// buffer, so they can be recovered after a crash. It's split into segments:
+// a new segment is started every time the memory buffer is swapped, and the
+// old segments are deleted once their messages are committed to shards.
+// Each segment file contains one GELF JSON document per line.
+//
+// Writers share fsync calls: whoever finds no fsync in progress performs one
+// for all the data written so far, while the others wait for it.
+
+const journalSegmentSuffix = ".journal"
+
+type MsgJournal struct {
+	WithMutex
+	dir      string
+	file     *os.File
+	w        *bufio.Writer
+	segment  uint64
+	written  uint64 // sequence number of the last write
+	synced   uint64 // sequence number of the last write which is fsynced
+	syncing  bool
+	syncCond *sync.Cond
+}
+
+func NewMsgJournal(dir string) (j *MsgJournal, err error) {
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return
+	}
+	j = &MsgJournal{dir: dir}
+	j.syncCond = sync.NewCond(&j.Mutex)
+	return
+}
+
+func (j *MsgJournal) segmentFileName(segment uint64) string {
+	return fmt.Sprintf("%s/%016d%s", j.dir, segment, journalSegmentSuffix)
+}
+
+// listSegments returns the numbers of segments present on disk, sorted.
+func (j *MsgJournal) listSegments() (segments []uint64, err error) {
+	files, err := ioutil.ReadDir(j.dir)
+	if err != nil {
+		return
+	}
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), journalSegmentSuffix) {
+			continue
+		}
+		var segment uint64
+		if _, err := fmt.Sscanf(f.Name(), "%d", &segment); err != nil {
+			log.Println("Ignoring unknown file in journal directory:", f.Name())
+			continue
+		}
+		segments = append(segments, segment)
+	}
+	sort.Slice(segments, func(a, b int) bool { return segments[a] < segments[b] })
+	return
+}
+
+// Replay reads all the messages from the segments left over from the last
+// run, passes them to the commit function, and deletes the segments if the
+// commit succeeds. Otherwise, the segments are kept and the messages which
+// weren't committed are returned. It also opens a new segment for writing,
+// and must be called before Write.
+func (j *MsgJournal) Replay(commit func(msgs *[]BasicGelfMessage) error) (uncommitted []BasicGelfMessage, err error) {
+	segments, err := j.listSegments()
+	if err != nil {
+		return
+	}
+	msgs := []BasicGelfMessage{}
+	for _, segment := range segments {
+		data, err := ioutil.ReadFile(j.segmentFileName(segment))
+		if err != nil {
+			return nil, err
+		}
+		for n, line := range bytes.Split(data, []byte{'\n'}) {
+			if len(line) == 0 {
+				continue
+			}
+			msg, err := ParseGelfMessage(line)
+			if err != nil {
+				// Most likely a partially written last line
+				log.Printf("Skipping unreadable journal entry in segment %d line %d: %v", segment, n+1, err)
+				continue
+			}
+			msgs = append(msgs, msg)
+		}
+	}
+	if len(msgs) > 0 {
+		log.Printf("Replaying %d messages from %d journal segment(s)", len(msgs), len(segments))
+		if cerr := commit(&msgs); cerr != nil {
+			log.Println("Cannot commit journal messages:", cerr)
+			uncommitted = msgs
+		}
+	}
+	if len(segments) > 0 {
+		j.segment = segments[len(segments)-1]
+		if len(uncommitted) == 0 {
+			if err = j.Remove(j.segment); err != nil {
+				return
+			}
+		}
+	}
+	return uncommitted, j.openSegment(j.segment + 1)
+}
+
+// openSegment starts writing to a new segment. Must be called with the lock held,
+// or before the journal is in use.
+func (j *MsgJournal) openSegment(segment uint64) (err error) {
+	f, err := os.OpenFile(j.segmentFileName(segment), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return
+	}
+	j.file = f
+	j.w = bufio.NewWriter(f)
+	j.segment = segment
+	return
+}
+
+// Write appends the messages to the current segment and returns a sequence
+// number which can be passed to WaitSync to wait until the messages are on disk.
+func (j *MsgJournal) Write(msgs []BasicGelfMessage) (seq uint64, err error) {
+	j.WithLock(func() {
+		if j.w == nil {
+			err = fmt.Errorf("Journal is closed")
+			return
+		}
+		for i := range msgs {
+			var data []byte
+			data, err = msgs[i].MarshalGelf()
+			if err != nil {
+				return
+			}
+			j.w.Write(data)
+			if err = j.w.WriteByte('\n'); err != nil {
+				return
+			}
+		}
+		j.written++
+		seq = j.written
+	})
+	return
+}
+
+// WaitSync waits until the write with the given sequence number is fsynced.
+func (j *MsgJournal) WaitSync(seq uint64) (err error) {
+	j.Lock()
+	defer j.Unlock()
+	for j.synced < seq {
+		if j.syncing {
+			j.syncCond.Wait()
+			continue
+		}
+		err = j.syncLocked()
+		if err != nil {
+			return
+		}
+	}
+	return nil
+}
+
+// syncLocked flushes and fsyncs the current segment. The lock is released
+// during fsync so other writers can continue writing.
+func (j *MsgJournal) syncLocked() (err error) {
+	target := j.written
+	f := j.file
+	j.syncing = true
+	err = j.w.Flush()
+	if err == nil {
+		j.Unlock()
+		err = f.Sync()
+		j.Lock()
+	}
+	j.syncing = false
+	if err == nil {
+		j.synced = target
+	}
+	j.syncCond.Broadcast()
+	return
+}
+
+// Rotate syncs and closes the current segment and starts a new one. It returns
+// the number of the closed segment, which contains all the messages written so far.
+func (j *MsgJournal) Rotate() (segment uint64, err error) {
+	j.Lock()
+	defer j.Unlock()
+	for j.syncing {
+		j.syncCond.Wait()
+	}
+	if j.w == nil {
+		return 0, fmt.Errorf("Journal is closed")
+	}
+	if err = j.syncLocked(); err != nil {
+		return
+	}
+	if err = j.file.Close(); err != nil {
+		return
+	}
+	segment = j.segment
+	err = j.openSegment(segment + 1)
+	return
+}
+
+// Remove deletes all segments up to and including the given one.
+func (j *MsgJournal) Remove(upTo uint64) (err error) {
+	segments, err := j.listSegments()
+	if err != nil {
+		return
+	}
+	for _, segment := range segments {
+		if segment > upTo {
+			break
+		}
+		if err = os.Remove(j.segmentFileName(segment)); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Close syncs and closes the current segment. If removeAll is true, all
+// segments are deleted, as their messages are committed.
+func (j *MsgJournal) Close(removeAll bool) (err error) {
+	j.Lock()
+	defer j.Unlock()
+	for j.syncing {
+		j.syncCond.Wait()
+	}
+	if j.w == nil {
+		return nil
+	}
+	if err = j.syncLocked(); err != nil {
+		return
+	}
+	err = j.file.Close()
+	j.file = nil
+	j.w = nil
+	if err == nil && removeAll {
+		err = j.Remove(j.segment)
+	}
+	return
+}
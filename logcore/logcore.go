@@ -1,35 +1,86 @@
 package logcore
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
+	"runtime"
+	"sync/atomic"
+	"time"
 )
 
+// ErrInstanceClosed is returned when adding messages to a closed instance
+var ErrInstanceClosed = errors.New("CeruleanLog instance is closed")
+
+// ValidationError is returned when a query or its parameters are invalid,
+// e.g. with an unknown field, as opposed to errors reading the data.
+type ValidationError struct {
+	Err error
+}
+
+func (e *ValidationError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+// newValidationError returns err as a *ValidationError, or nil if it's nil.
+func newValidationError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &ValidationError{Err: err}
+}
+
+// IsValidationError checks if the error is (or wraps) a *ValidationError.
+func IsValidationError(err error) bool {
+	var vErr *ValidationError
+	return errors.As(err, &vErr)
+}
+
 type CeruleanInstance struct {
-	dataDir         string
-	configFile      string
-	config          CeruleanConfig
-	msgBuffer       MsgBuffer
-	shardCollection DbShardCollection
-	earliestTime    uint32
+	dataDir          string
+	configFile       string
+	config           CeruleanConfig
+	msgBuffer        MsgBuffer
+	shardCollection  DbShardCollection
+	earliestTime     uint32
+	configLock       WithRWMutex // Protects the parts of config which can change at runtime
+	indexJobs        indexJobList
+	committerRunning int32
+	quit             chan struct{} // Closed when the instance is closed
+	committerDone    chan struct{}
+	retention        retentionState
+	tail             tailSubscribers
+	savedSearches    savedSearchList
+	deadLetters      WithMutex // Serializes writes to the dead letters file
 }
 
-func (ci CeruleanInstance) getConfigFileName() string {
+func (ci *CeruleanInstance) getConfigFileName() string {
 	return fmt.Sprintf("%s/%s", ci.dataDir, ci.configFile)
 }
 
-func (ci CeruleanInstance) getShardsDir() string {
+func (ci *CeruleanInstance) getShardsDir() string {
 	return fmt.Sprintf("%s/%s", ci.dataDir, "shards")
 }
 
+func (ci *CeruleanInstance) getJournalDir() string {
+	return fmt.Sprintf("%s/%s", ci.dataDir, "journal")
+}
+
 func NewCeruleanInstance(dataDir string) *CeruleanInstance {
 	var err error
 	instance := CeruleanInstance{
-		dataDir:    dataDir,
-		configFile: "ceruleanlog.json",
-		config:     NewCeruleanConfig(),
+		dataDir:       dataDir,
+		configFile:    "ceruleanlog.json",
+		config:        NewCeruleanConfig(),
+		quit:          make(chan struct{}),
+		committerDone: make(chan struct{}),
 	}
 	instance.msgBuffer = NewMsgBuffer(&instance)
 
@@ -62,6 +113,27 @@ func NewCeruleanInstance(dataDir string) *CeruleanInstance {
 	} else {
 		err = WriteCeruleanConfig(instance.getConfigFileName(), instance.config)
 	}
+	if err = instance.loadSavedSearches(); err != nil {
+		log.Panicln(err)
+	}
+
+	if !instance.config.JournalDisabled && instance.config.MemoryBufferTimeSeconds != 0 {
+		journal, err := NewMsgJournal(instance.getJournalDir())
+		if err != nil {
+			log.Panicln(err)
+		}
+		uncommitted, err := journal.Replay(instance.commitMessages)
+		if err != nil {
+			log.Println("Cannot replay the journal, journaling is disabled:", err)
+		} else {
+			if len(uncommitted) > 0 {
+				// They stay in the journal, and the committer retries them
+				log.Printf("Cannot commit %d journal messages, will retry", len(uncommitted))
+				instance.msgBuffer.Messages = uncommitted
+			}
+			instance.msgBuffer.journal = journal
+		}
+	}
 
 	return &instance
 }
@@ -80,15 +152,113 @@ func (ci *CeruleanInstance) getShardsInDir() (shards []spanNameID, err error) {
 	return
 }
 
+// Committer periodically commits the memory buffer to shards, until the instance is closed.
 func (ci *CeruleanInstance) Committer() {
-	ci.msgBuffer.committer()
+	atomic.StoreInt32(&ci.committerRunning, 1)
+	defer close(ci.committerDone)
+	ci.msgBuffer.committer(ci.quit)
+}
+
+// Close stops accepting new messages, commits the messages from the memory
+// buffer to shards and closes all the shards. If the context expires before
+// that's done, the remaining messages are left in the journal.
+func (ci *CeruleanInstance) Close(ctx context.Context) (err error) {
+	if !ci.msgBuffer.close() {
+		return ErrInstanceClosed
+	}
+	close(ci.quit)
+	ci.tail.close()
+	if atomic.LoadInt32(&ci.committerRunning) != 0 {
+		select {
+		case <-ci.committerDone:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		err := ci.msgBuffer.flush()
+		if cerr := ci.shardCollection.Close(); err == nil {
+			err = cerr
+		}
+		done <- err
+	}()
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err == nil {
+		log.Println("Closed CeruleanLog instance", ci.dataDir)
+	}
+	return
 }
 
 func (ci *CeruleanInstance) AddMessage(msg BasicGelfMessage) (err error) {
 	return ci.msgBuffer.addMessage(msg)
 }
 
-func (ci *CeruleanInstance) Query(timeFrom, timeTo, limit uint32, query string) (result DbShardQueryResult, err error) {
-	result, err = ci.shardCollection.Query(timeFrom, timeTo, limit, query)
-	return
+// AddMessages adds a batch of messages at once, which is cheaper than adding
+// them one by one.
+func (ci *CeruleanInstance) AddMessages(msgs []BasicGelfMessage) (err error) {
+	return ci.msgBuffer.addMessages(msgs)
+}
+
+// Query returns at most params.Limit messages between params.TimeFrom and
+// params.TimeTo, newest first, which match the query. The query is aborted
+// when ctx is done, or when it runs out of the configured time or rows to
+// scan, in which case the result is marked as partial.
+func (ci *CeruleanInstance) Query(ctx context.Context, params QueryParams) (result QueryResult, err error) {
+	timeout, maxRowsScanned := ci.queryLimits()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return ci.shardCollection.Query(ctx, params, maxRowsScanned)
+}
+
+// QueryStream prepares to iterate over the messages matching the query,
+// reading them as they're needed, e.g. for exports.
+func (ci *CeruleanInstance) QueryStream(ctx context.Context, params QueryParams) (stream *QueryStream, err error) {
+	return ci.shardCollection.QueryStream(ctx, params)
+}
+
+// Aggregate computes aggregations over the messages matching the query, optionally
+// grouped by fields and time buckets.
+func (ci *CeruleanInstance) Aggregate(ctx context.Context, params AggregateParams) (result AggregateResult, truncated bool, err error) {
+	timeout, _ := ci.queryLimits()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return ci.shardCollection.Aggregate(ctx, params)
+}
+
+// Fields returns the catalog of the fields of the messages in a time range,
+// with approximate statistics. Like queries, it's limited by the query timeout.
+func (ci *CeruleanInstance) Fields(ctx context.Context, params FieldsParams) (result FieldsResult, err error) {
+	timeout, _ := ci.queryLimits()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return ci.shardCollection.Fields(ctx, params)
+}
+
+// queryLimits returns the maximum execution time and number of rows scanned
+// per query, 0 meaning unlimited.
+func (ci *CeruleanInstance) queryLimits() (timeout time.Duration, maxRowsScanned uint64) {
+	return time.Duration(ci.config.QueryTimeoutSeconds) * time.Second, ci.config.QueryMaxRowsScanned
+}
+
+// queryWorkers returns the number of shards which are queried in parallel.
+func (ci *CeruleanInstance) queryWorkers() int {
+	if ci.config.QueryWorkers == 0 {
+		return runtime.NumCPU()
+	}
+	return int(ci.config.QueryWorkers)
 }
@@ -0,0 +1,209 @@
+package logcore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Every stored message has a global ID, made of its shard's ID and its row id
+// in the shard, which is returned as _id in query results. The context of a
+// message is the messages just before and after it, like grep -C, which can
+// be limited to those with the same values of some fields, e.g. the host.
+
+var ErrMessageNotFound = errors.New("Message not found")
+
+type MessageID struct {
+	ShardID uint32
+	RowID   int64
+}
+
+func (id MessageID) String() string {
+	return fmt.Sprintf("%d-%d", id.ShardID, id.RowID)
+}
+
+// ParseMessageID parses a message ID returned by MessageID.String.
+func ParseMessageID(s string) (id MessageID, err error) {
+	parts := strings.Split(s, "-")
+	if len(parts) != 2 {
+		return id, fmt.Errorf("Invalid message ID: %s", s)
+	}
+	shardID, err := strconv.ParseUint(parts[0], 10, 32)
+	if err != nil {
+		return id, fmt.Errorf("Invalid message ID: %s", s)
+	}
+	rowID, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || rowID <= 0 {
+		return id, fmt.Errorf("Invalid message ID: %s", s)
+	}
+	return MessageID{ShardID: uint32(shardID), RowID: rowID}, nil
+}
+
+// addMessageIDs adds the global IDs of the shard's rows to them, as _id.
+func (shard *DbShard) addMessageIDs(rows DbShardQueryResult) {
+	for _, row := range rows {
+		if id, ok := row["id"].(int64); ok {
+			row["_id"] = MessageID{ShardID: shard.id, RowID: id}.String()
+		}
+	}
+}
+
+type ContextParams struct {
+	ID     MessageID
+	Before uint32   // number of messages before the message
+	After  uint32   // number of messages after the message
+	Same   []string // fields whose values must be the same as in the message, e.g. host
+	Fields []string // fields to return besides id and timestamp, nil for all fields
+}
+
+type ContextResult struct {
+	Message map[string]interface{} `json:"message"`
+	Before  DbShardQueryResult     `json:"before"` // oldest first
+	After   DbShardQueryResult     `json:"after"`  // oldest first
+	Partial bool                   `json:"partial"`
+}
+
+// getMessage returns the message with the ID.
+func (sc *DbShardCollection) getMessage(ctx context.Context, id MessageID) (row map[string]interface{}, err error) {
+	var names []string
+	sc.WithRLock(func() {
+		names = append(names, sc.shardNames...)
+	})
+	var shard *DbShard
+	for _, name := range names {
+		_, shardID, err := sc.instance.config.ShardNameToTsID(name)
+		if err != nil || shardID != id.ShardID {
+			continue
+		}
+		if shard, err = sc.getShardByNameID(name, shardID, false); err == ErrShardNotFound {
+			return nil, ErrMessageNotFound
+		} else if err != nil {
+			return nil, err
+		}
+		break
+	}
+	if shard == nil {
+		return nil, ErrMessageNotFound
+	}
+	rows, err := shard.sqlQuery(ctx, "SELECT * FROM data WHERE id = ?", id.RowID)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, ErrMessageNotFound
+	}
+	shard.addMessageIDs(rows)
+	return rows[0], nil
+}
+
+// newestShardEnd returns the end of the newest shard's time span, in microseconds.
+func (sc *DbShardCollection) newestShardEnd() (end int64, err error) {
+	var name string
+	sc.WithRLock(func() {
+		if len(sc.shardNames) > 0 {
+			name = sc.shardNames[len(sc.shardNames)-1]
+		}
+	})
+	if name == "" {
+		return 0, fmt.Errorf("No shards")
+	}
+	_, t, err := sc.instance.config.ShardNameToTimeSpan(name)
+	if err != nil {
+		return
+	}
+	return TimeToMicro(t) - 1, nil
+}
+
+// sameValuesQuery returns the query for the messages with the same values of
+// the fields as the row, or nil if there are no fields.
+func sameValuesQuery(row map[string]interface{}, fields []string) (query *QueryNode, err error) {
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	query = &QueryNode{Type: QueryAnd}
+	for _, f := range fields {
+		var node *QueryNode
+		switch v := row[f].(type) {
+		case string:
+			if v == "" {
+				// Rows which existed before a text field was added have it set to ''
+				node = &QueryNode{Type: QueryNot, Children: []*QueryNode{{Type: QueryExists, Field: f}}}
+			} else {
+				node = &QueryNode{Type: QueryCompare, Field: f, Op: "=", Values: []QueryValue{NewQueryString(v)}}
+			}
+		case float64, int64:
+			value, err := NewQueryNumber(fmt.Sprint(v))
+			if err != nil {
+				return nil, err
+			}
+			node = &QueryNode{Type: QueryCompare, Field: f, Op: "=", Values: []QueryValue{value}}
+		case nil:
+			node = &QueryNode{Type: QueryNot, Children: []*QueryNode{{Type: QueryExists, Field: f}}}
+		default:
+			return nil, fmt.Errorf("Cannot compare field %s", f)
+		}
+		query.Children = append(query.Children, node)
+	}
+	return
+}
+
+// MessageContext returns the message with the given ID, and the messages just
+// before and after it, across shards, optionally only those which have the
+// same values of the params.Same fields.
+func (ci *CeruleanInstance) MessageContext(ctx context.Context, params ContextParams) (result ContextResult, err error) {
+	sc := &ci.shardCollection
+	row, err := sc.getMessage(ctx, params.ID)
+	if err != nil {
+		return
+	}
+	for _, f := range params.Same {
+		if f == "id" || f == "timestamp" {
+			return result, newValidationError(fmt.Errorf("Messages can't have the same %s", f))
+		}
+	}
+	query, err := sameValuesQuery(row, params.Same)
+	if err != nil {
+		return
+	}
+	result.Message = row
+	if params.Fields != nil {
+		result.Message = map[string]interface{}{"id": row["id"], "timestamp": row["timestamp"], "_id": row["_id"]}
+		for _, f := range params.Fields {
+			result.Message[f] = row[f]
+		}
+	}
+
+	// The messages are queried from the message's position, as with a cursor
+	ts := sc.newQueryCursor(row, QueryParams{}).Timestamp
+	result.Before = DbShardQueryResult{}
+	if params.Before > 0 {
+		qp := QueryParams{TimeTo: ts, Limit: params.Before, Query: query, Fields: params.Fields}
+		qp.Cursor = sc.newQueryCursor(row, qp)
+		before, err := ci.Query(ctx, qp)
+		if err != nil {
+			return result, err
+		}
+		// Newest first, reversed to the chronological order
+		for i := len(before.Rows) - 1; i >= 0; i-- {
+			result.Before = append(result.Before, before.Rows[i])
+		}
+		result.Partial = before.Partial
+	}
+	result.After = DbShardQueryResult{}
+	if params.After > 0 {
+		qp := QueryParams{TimeFrom: ts, Limit: params.After, Query: query, Ascending: true, Fields: params.Fields}
+		qp.Cursor = sc.newQueryCursor(row, qp)
+		if qp.TimeTo, err = sc.newestShardEnd(); err != nil {
+			return
+		}
+		after, err := ci.Query(ctx, qp)
+		if err != nil {
+			return result, err
+		}
+		result.After = after.Rows
+		result.Partial = result.Partial || after.Partial
+	}
+	return
+}
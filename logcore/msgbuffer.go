@@ -10,12 +10,16 @@ import (
 // - There's a "current buffer"
 // - Incoming messages either go into the current buffer, or directly into shards if so configured
 // - There's a goroutine which periodically creates a new current buffer, and commits the data from the old one to the shards
+// - Messages in the current buffer are also written to the journal, which is rotated with each new buffer.
+//   Old journal segments are removed when their messages are committed.
 
 type MsgBuffer struct {
 	WithMutex
 	Messages     []BasicGelfMessage
 	LastSwapTime time.Time
 	instance     *CeruleanInstance
+	journal      *MsgJournal // nil if not journaling
+	closed       bool
 }
 
 func NewMsgBuffer(i *CeruleanInstance) (mb MsgBuffer) {
@@ -26,51 +30,143 @@ func NewMsgBuffer(i *CeruleanInstance) (mb MsgBuffer) {
 }
 
 func (b *MsgBuffer) addMessage(msg BasicGelfMessage) (err error) {
+	return b.addMessages([]BasicGelfMessage{msg})
+}
+
+func (b *MsgBuffer) addMessages(msgs []BasicGelfMessage) (err error) {
 	//log.Println("CeruleanLog recording message:", jsonifyWhatever(msg))
+	now := getNowUTCMicro()
+	for i := range msgs {
+		if msgs[i].Timestamp == 0 {
+			msgs[i].Timestamp = now
+		}
+	}
+	var journalSeq uint64
 	b.WithLock(func() {
-		b.Messages = append(b.Messages, msg)
+		if b.closed {
+			err = ErrInstanceClosed
+			return
+		}
+		if b.journal != nil {
+			// Written under the buffer lock so the journal segment always matches the buffer
+			journalSeq, err = b.journal.Write(msgs)
+			if err != nil {
+				err = fmt.Errorf("Cannot write messages to journal: %w", err)
+				return
+			}
+		}
+		b.Messages = append(b.Messages, msgs...)
 		if b.instance.config.MemoryBufferTimeSeconds == 0 {
 			oldMessages := b.Messages
 			err = b.commitMessagesToShards(&oldMessages)
 			if err == nil {
 				b.Messages = []BasicGelfMessage{}
 			} else {
+				// Only the messages which weren't committed are left
+				b.Messages = oldMessages
 				log.Println("Error committing message(s) to database shards. Will retry because memory_buffer_time_seconds==0:", err)
 			}
 		}
 	})
+	if err == nil && journalSeq != 0 {
+		// Waiting for fsync outside the buffer lock allows concurrent writers to share it
+		err = b.journal.WaitSync(journalSeq)
+		if err != nil {
+			err = fmt.Errorf("Cannot sync journal: %w", err)
+		}
+	}
+	if err == nil {
+		b.instance.tail.publish(msgs)
+	}
 	return
 }
 
-func (b *MsgBuffer) committer() {
+func (b *MsgBuffer) committer(quit chan struct{}) {
 	log.Println(fmt.Sprintf("Starting CeruleanLog committer for %s, flush time %ds.", b.instance.dataDir, b.instance.config.MemoryBufferTimeSeconds))
 	for {
+		select {
+		case <-quit:
+			log.Println("Exiting CeruleanLog committer for", b.instance.dataDir)
+			return
+		case <-time.After(1 * time.Second):
+		}
 		if time.Since(b.LastSwapTime) >= time.Duration(b.instance.config.MemoryBufferTimeSeconds)*time.Second && len(b.Messages) != 0 {
 			var oldMessages []BasicGelfMessage
+			var journalSegment uint64
+			var err error
 			b.WithLock(func() {
+				if b.journal != nil {
+					journalSegment, err = b.journal.Rotate()
+					if err != nil {
+						log.Println("Cannot rotate journal:", err)
+						return
+					}
+				}
 				oldMessages = b.Messages
 				b.Messages = []BasicGelfMessage{}
 				b.LastSwapTime = time.Now()
 			})
-			err := b.commitMessagesToShards(&oldMessages)
 			if err != nil {
-				log.Printf("Cannot commit messages to database shards! %d messages lost! %v", len(oldMessages), err)
+				continue
+			}
+			err = b.commitMessagesToShards(&oldMessages)
+			if err != nil {
+				if b.journal != nil {
+					// The messages are still in the journal, so keep them in memory and retry later
+					log.Printf("Cannot commit messages to database shards! Will retry %d messages. %v", len(oldMessages), err)
+					b.WithLock(func() {
+						b.Messages = append(oldMessages, b.Messages...)
+					})
+				} else {
+					log.Printf("Cannot commit messages to database shards! %d messages lost! %v", len(oldMessages), err)
+				}
 			} else {
 				log.Printf("CeruleanLog committed %d messages to database shards.", len(oldMessages))
+				if b.journal != nil {
+					if err = b.journal.Remove(journalSegment); err != nil {
+						log.Println("Cannot remove committed journal segments:", err)
+					}
+				}
 			}
 		}
-		time.Sleep(1 * time.Second)
 	}
-	log.Println("Exiting CeruleanLog committer for", b.instance.dataDir)
 }
 
-func (b *MsgBuffer) commitMessagesToShards(messages *[]BasicGelfMessage) (err error) {
-	now := uint32(getNowUTC())
-	for i := range *messages {
-		if (*messages)[i].Timestamp == 0 {
-			(*messages)[i].Timestamp = now
+// close stops accepting new messages. It returns false if the buffer was already closed.
+func (b *MsgBuffer) close() (ok bool) {
+	b.WithLock(func() {
+		ok = !b.closed
+		b.closed = true
+	})
+	return
+}
+
+// flush commits all the remaining messages to shards and closes the journal.
+// Must be called after close, when the committer is stopped.
+func (b *MsgBuffer) flush() (err error) {
+	var messages []BasicGelfMessage
+	b.WithLock(func() {
+		messages = b.Messages
+		b.Messages = []BasicGelfMessage{}
+	})
+	if len(messages) > 0 {
+		err = b.commitMessagesToShards(&messages)
+		if err != nil {
+			log.Printf("Cannot commit %d messages to database shards on close: %v", len(messages), err)
+		} else {
+			log.Printf("CeruleanLog committed %d messages to database shards on close.", len(messages))
+		}
+	}
+	if b.journal != nil {
+		// If the commit failed, the messages stay in the journal and are replayed on the next start
+		if jerr := b.journal.Close(err == nil); err == nil {
+			err = jerr
 		}
 	}
-	err = b.instance.shardCollection.CommitMessagesToShards(messages)
+	return
+}
+
+func (b *MsgBuffer) commitMessagesToShards(messages *[]BasicGelfMessage) (err error) {
+	err = b.instance.commitMessages(messages)
 	return
 }
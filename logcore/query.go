@@ -0,0 +1,350 @@
+package logcore
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Queries are parsed into a tree of QueryNodes, which is validated against
+// the fields known in the shards, and compiled into SQL with bound arguments
+// separately for each shard. Fields which don't exist in a shard are treated
+// as NULL there.
+
+type QueryNodeType int
+
+const (
+	QueryAnd      QueryNodeType = iota // All of Children
+	QueryOr                            // Any of Children
+	QueryNot                           // Not Children[0]
+	QueryCompare                       // Field Op Values[0]
+	QueryIn                            // Field is one of Values
+	QueryLike                          // Field LIKE Values[0], with % and _ wildcards
+	QueryBetween                       // Values[0] <= Field <= Values[1]
+	QueryExists                        // Field is not NULL (or empty)
+	QueryMatch                         // Full-text query Values[0] matches Field, or any full-text field if Field is ""
+	QueryRegexp                        // Field matches the regular expression Values[0]
+	QueryContains                      // Field contains Values[0], ignoring case
+)
+
+// QueryValue is a literal from a query. Numbers keep their original text,
+// so they can be compared to TEXT fields as strings.
+type QueryValue struct {
+	Str      string
+	Num      float64
+	IsNumber bool
+}
+
+type QueryNode struct {
+	Type     QueryNodeType
+	Children []*QueryNode
+	Field    string
+	Func     *QueryFunc   // If set, the node applies to the function of Field
+	Op       string       // For QueryCompare: =, !=, <, <=, >, >=
+	Values   []QueryValue // For QueryMatch, the FTS5 query and a fallback LIKE pattern
+}
+
+// QueryFunc is a function of a field's value, see sql_functions.go. Its
+// results are text, except when compared with numbers, when results which
+// aren't numbers are NULL.
+type QueryFunc struct {
+	Name string
+	Args []QueryValue // After the field
+}
+
+// Maximum nesting depth of parsed queries
+const maxQueryDepth = 100
+
+// Supported query syntaxes
+const (
+	QuerySyntaxFilter = "filter" // SQL-like, see query_filter.go
+	QuerySyntaxLucene = "lucene" // Graylog-like, see query_lucene.go
+)
+
+// ParseQuery parses a query in the given syntax, which defaults to the
+// filter syntax if empty.
+func ParseQuery(syntax, q string) (node *QueryNode, err error) {
+	switch syntax {
+	case "", QuerySyntaxFilter:
+		return ParseFilterQuery(q)
+	case QuerySyntaxLucene:
+		return ParseLuceneQuery(q)
+	}
+	return nil, fmt.Errorf("Unknown query syntax: %s", syntax)
+}
+
+func NewQueryString(s string) QueryValue {
+	return QueryValue{Str: s}
+}
+
+func NewQueryNumber(s string) (v QueryValue, err error) {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return v, fmt.Errorf("Invalid number: %s", s)
+	}
+	return QueryValue{Str: s, Num: f, IsNumber: true}, nil
+}
+
+// Fields returns the list of distinct fields referenced by the query.
+func (n *QueryNode) Fields() (fields []string) {
+	if n == nil {
+		return
+	}
+	if n.Field != "" {
+		fields = append(fields, n.Field)
+	}
+	for _, c := range n.Children {
+		for _, f := range c.Fields() {
+			if !InStringArray(f, fields) {
+				fields = append(fields, f)
+			}
+		}
+	}
+	return
+}
+
+// Validate checks that all the fields used in the query exist in knownFields.
+func (n *QueryNode) Validate(knownFields map[string]string) error {
+	for _, f := range n.Fields() {
+		if _, found := knownFields[f]; !found {
+			return fmt.Errorf("Unknown field: %s", f)
+		}
+	}
+	return nil
+}
+
+// String returns a readable representation of the query, in the filter syntax.
+func (n *QueryNode) String() string {
+	if n == nil {
+		return ""
+	}
+	switch n.Type {
+	case QueryAnd, QueryOr:
+		op := " AND "
+		if n.Type == QueryOr {
+			op = " OR "
+		}
+		parts := make([]string, len(n.Children))
+		for i, c := range n.Children {
+			parts[i] = c.String()
+		}
+		return "(" + strings.Join(parts, op) + ")"
+	case QueryNot:
+		return "NOT " + n.Children[0].String()
+	case QueryCompare:
+		return fmt.Sprintf("%s %s %s", n.operandString(), n.Op, n.Values[0].String())
+	case QueryIn:
+		parts := make([]string, len(n.Values))
+		for i, v := range n.Values {
+			parts[i] = v.String()
+		}
+		return fmt.Sprintf("%s IN (%s)", n.operandString(), strings.Join(parts, ", "))
+	case QueryLike:
+		return fmt.Sprintf("%s LIKE %s", n.operandString(), n.Values[0].String())
+	case QueryBetween:
+		return fmt.Sprintf("%s BETWEEN %s AND %s", n.operandString(), n.Values[0].String(), n.Values[1].String())
+	case QueryExists:
+		return "EXISTS " + n.operandString()
+	case QueryRegexp:
+		return fmt.Sprintf("%s REGEXP %s", n.operandString(), n.Values[0].String())
+	case QueryContains:
+		return fmt.Sprintf("%s ICONTAINS %s", n.operandString(), n.Values[0].String())
+	case QueryMatch:
+		if n.Field == "" {
+			return "MATCH " + n.Values[0].String()
+		}
+		return fmt.Sprintf("%s MATCH %s", n.Field, n.Values[0].String())
+	}
+	return "?"
+}
+
+func (n *QueryNode) operandString() string {
+	if n.Func == nil {
+		return n.Field
+	}
+	parts := []string{n.Field}
+	for _, v := range n.Func.Args {
+		parts = append(parts, v.String())
+	}
+	return fmt.Sprintf("%s(%s)", n.Func.Name, strings.Join(parts, ", "))
+}
+
+// comparesNumbers checks if the node compares its field, or function, with
+// numbers only.
+func (n *QueryNode) comparesNumbers() bool {
+	switch n.Type {
+	case QueryCompare, QueryIn, QueryBetween:
+	default:
+		return false
+	}
+	for _, v := range n.Values {
+		if !v.IsNumber {
+			return false
+		}
+	}
+	return len(n.Values) > 0
+}
+
+func (v QueryValue) String() string {
+	if v.IsNumber {
+		return v.Str
+	}
+	return strconv.Quote(v.Str)
+}
+
+// sqlArg converts the value to an SQL argument appropriate for comparing
+// with a field of the given type.
+func (v QueryValue) sqlArg(field, fieldType string) interface{} {
+	switch fieldType {
+	case "TEXT":
+		return v.Str
+	case "INTEGER", "NUMERIC":
+		f := v.Num
+		if !v.IsNumber {
+			var err error
+			if f, err = strconv.ParseFloat(v.Str, 64); err != nil {
+				return v.Str
+			}
+		}
+		if field == "timestamp" {
+			// Timestamps are given in seconds, and stored in microseconds
+			return int64(math.Round(f * 1000000))
+		}
+		if fieldType == "INTEGER" && f == math.Trunc(f) {
+			return int64(f)
+		}
+		return f
+	}
+	return v.Str
+}
+
+// ToSQL compiles the query into an SQL expression for a shard with the given
+// fields and their types, and full-text indexed fields.
+func (n *QueryNode) ToSQL(fieldTypes map[string]string, fullTextFields []string) (sql string, args []interface{}, err error) {
+	if n == nil {
+		return "1", nil, nil
+	}
+	var b strings.Builder
+	err = n.toSQL(&b, &args, fieldTypes, fullTextFields)
+	return b.String(), args, err
+}
+
+func (n *QueryNode) toSQL(b *strings.Builder, args *[]interface{}, fieldTypes map[string]string, fullTextFields []string) (err error) {
+	column := "NULL"
+	field := n.Field
+	fieldType, found := fieldTypes[n.Field]
+	if found {
+		column = quoteSQLIdentifier(n.Field)
+	}
+	var funcArgs []interface{}
+	if n.Func != nil {
+		if column, funcArgs, err = n.Func.toSQL(column); err != nil {
+			return
+		}
+		field, fieldType = "", "TEXT"
+		if n.comparesNumbers() {
+			column = fmt.Sprintf("CAST(to_number(%s) AS REAL)", column)
+			fieldType = "NUMERIC"
+		}
+	}
+	// col returns the column, or function, and adds its arguments
+	col := func() string {
+		*args = append(*args, funcArgs...)
+		return column
+	}
+	switch n.Type {
+	case QueryAnd, QueryOr:
+		op := " AND "
+		if n.Type == QueryOr {
+			op = " OR "
+		}
+		b.WriteString("(")
+		for i, c := range n.Children {
+			if i > 0 {
+				b.WriteString(op)
+			}
+			if err = c.toSQL(b, args, fieldTypes, fullTextFields); err != nil {
+				return
+			}
+		}
+		b.WriteString(")")
+	case QueryNot:
+		b.WriteString("(NOT ")
+		if err = n.Children[0].toSQL(b, args, fieldTypes, fullTextFields); err != nil {
+			return
+		}
+		b.WriteString(")")
+	case QueryCompare:
+		switch n.Op {
+		case "=", "!=", "<", "<=", ">", ">=":
+		default:
+			return fmt.Errorf("Invalid comparison operator: %s", n.Op)
+		}
+		fmt.Fprintf(b, "%s %s ?", col(), n.Op)
+		*args = append(*args, n.Values[0].sqlArg(field, fieldType))
+	case QueryIn:
+		b.WriteString(col() + " IN (")
+		for i, v := range n.Values {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			b.WriteString("?")
+			*args = append(*args, v.sqlArg(field, fieldType))
+		}
+		b.WriteString(")")
+	case QueryLike:
+		fmt.Fprintf(b, "%s LIKE ? ESCAPE '\\'", col())
+		*args = append(*args, n.Values[0].Str)
+	case QueryBetween:
+		fmt.Fprintf(b, "%s BETWEEN ? AND ?", col())
+		*args = append(*args, n.Values[0].sqlArg(field, fieldType), n.Values[1].sqlArg(field, fieldType))
+	case QueryExists:
+		if fieldType == "TEXT" && n.Func == nil {
+			// Rows which existed before a field was added have it set to ''
+			fmt.Fprintf(b, "(%s IS NOT NULL AND %s != '')", column, column)
+		} else {
+			// Functions return NULL instead of ''
+			fmt.Fprintf(b, "%s IS NOT NULL", col())
+		}
+	case QueryRegexp, QueryContains:
+		// The functions can't return NULL, which they should for NULL values
+		fmt.Fprintf(b, "CASE WHEN %s IS NULL THEN NULL ELSE ", col())
+		if n.Type == QueryRegexp {
+			b.WriteString("regexp(?, ")
+			*args = append(*args, n.Values[0].Str)
+			b.WriteString(col() + ")")
+		} else {
+			fmt.Fprintf(b, "icontains(%s, ?)", col())
+			*args = append(*args, n.Values[0].Str)
+		}
+		b.WriteString(" END")
+	case QueryMatch:
+		if len(fullTextFields) > 0 && (n.Field == "" || InStringArray(n.Field, fullTextFields)) {
+			fmt.Fprintf(b, "id IN (SELECT rowid FROM %s WHERE %s MATCH ?)", fullTextTable, fullTextTable)
+			*args = append(*args, n.fullTextExpr())
+			break
+		}
+		// No full-text index, fall back to a (slow) substring search
+		fields := []string{n.Field}
+		if n.Field == "" {
+			fields = fullTextBuiltinFields
+		}
+		b.WriteString("(")
+		for i, f := range fields {
+			if i > 0 {
+				b.WriteString(" OR ")
+			}
+			column := "NULL"
+			if _, found := fieldTypes[f]; found {
+				column = quoteSQLIdentifier(f)
+			}
+			fmt.Fprintf(b, "%s LIKE ? ESCAPE '\\'", column)
+			*args = append(*args, n.Values[1].Str)
+		}
+		b.WriteString(")")
+	default:
+		return fmt.Errorf("Invalid query node type: %d", n.Type)
+	}
+	return
+}
@@ -0,0 +1,90 @@
+package logcore
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+)
+
+// QueryCursor is the position of the last message of a page of query
+// results, from which the next page continues. Messages are ordered by
+// timestamp, the sort field (if any) and id, and since each timestamp belongs
+// to exactly one shard, the sort field and id are only compared within the
+// cursor's shard.
+type QueryCursor struct {
+	Shard          string      `json:"s"`
+	Timestamp      int64       `json:"t"` // microseconds
+	ID             int64       `json:"i"`
+	Ascending      bool        `json:"a,omitempty"`
+	SortField      string      `json:"f,omitempty"`
+	SortDescending bool        `json:"d,omitempty"`
+	SortValue      interface{} `json:"v,omitempty"` // nil if the message doesn't have the sort field
+}
+
+// Encode returns the cursor as an opaque URL-safe string.
+func (c QueryCursor) Encode() string {
+	return base64.RawURLEncoding.EncodeToString(jsonifyWhateverToBytes(c))
+}
+
+// DecodeQueryCursor decodes a cursor returned by Encode.
+func DecodeQueryCursor(s string) (c *QueryCursor, err error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid cursor")
+	}
+	c = &QueryCursor{}
+	if err = json.Unmarshal(data, c); err != nil || c.Shard == "" {
+		return nil, fmt.Errorf("Invalid cursor")
+	}
+	return
+}
+
+// newQueryCursor returns the cursor pointing at the row, which is a query
+// result row, including the query's sort field.
+func (sc *DbShardCollection) newQueryCursor(row map[string]interface{}, params QueryParams) *QueryCursor {
+	ts, _ := row["timestamp"].(float64)
+	id, _ := row["id"].(int64)
+	c := &QueryCursor{Timestamp: int64(math.Round(ts * 1000000)), ID: id, Ascending: params.Ascending}
+	c.Shard, _ = sc.instance.config.GetShardNameID(uint32(c.Timestamp / 1000000))
+	if params.SortField != "" {
+		c.SortField = params.SortField
+		c.SortDescending = params.SortDescending
+		c.SortValue = row[params.SortField]
+	}
+	return c
+}
+
+// sqlCondition returns the condition for the messages after the cursor in the
+// shard. sortColumn is the sort field's column, or "" if the shard doesn't
+// have it.
+func (c *QueryCursor) sqlCondition(shardName, sortColumn string) (cond string, args []interface{}) {
+	op := "<"
+	if c.Ascending {
+		op = ">"
+	}
+	if shardName != c.Shard {
+		return fmt.Sprintf("timestamp %s ?", op), []interface{}{c.Timestamp}
+	}
+	if sortColumn == "" {
+		return fmt.Sprintf("(timestamp %s ? OR (timestamp = ? AND id %s ?))", op, op), []interface{}{c.Timestamp, c.Timestamp, c.ID}
+	}
+	sortCond, sortArgs := c.sortCondition(sortColumn, op)
+	return fmt.Sprintf("(timestamp %s ? OR (timestamp = ? AND %s))", op, sortCond), append([]interface{}{c.Timestamp, c.Timestamp}, sortArgs...)
+}
+
+// sortCondition returns the condition for the messages after the cursor
+// among those with the cursor's timestamp, which are ordered by the sort
+// column and then by id. NULLs are before all other values in SQLite's
+// ascending order.
+func (c *QueryCursor) sortCondition(column, op string) (cond string, args []interface{}) {
+	switch {
+	case c.SortValue == nil && !c.SortDescending:
+		return fmt.Sprintf("(%s IS NOT NULL OR id %s ?)", column, op), []interface{}{c.ID}
+	case c.SortValue == nil:
+		return fmt.Sprintf("(%s IS NULL AND id %s ?)", column, op), []interface{}{c.ID}
+	case !c.SortDescending:
+		return fmt.Sprintf("(%s > ? OR (%s = ? AND id %s ?))", column, column, op), []interface{}{c.SortValue, c.SortValue, c.ID}
+	}
+	return fmt.Sprintf("(%s < ? OR (%s = ? AND id %s ?) OR %s IS NULL)", column, column, op, column), []interface{}{c.SortValue, c.SortValue, c.ID}
+}
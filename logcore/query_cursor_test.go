@@ -0,0 +1,167 @@
+package logcore
+
+import (
+	"encoding/base64"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestQueryCursorEncoding(t *testing.T) {
+	tests := []struct {
+		name   string
+		cursor QueryCursor
+	}{
+		{name: "descending", cursor: QueryCursor{Shard: "2020-W38", Timestamp: 1600000000123456, ID: 42}},
+		{name: "ascending", cursor: QueryCursor{Shard: "2020-W38", Timestamp: 1600000000123456, ID: 42, Ascending: true}},
+		{name: "sort by text", cursor: QueryCursor{Shard: "2020-W38", Timestamp: 1, ID: 1, SortField: "host", SortValue: "web/1+2=3"}},
+		{name: "sort by number", cursor: QueryCursor{Shard: "2020-W38", Timestamp: 1, ID: 1, SortField: "level", SortDescending: true, SortValue: 3.5}},
+		{name: "sort field missing", cursor: QueryCursor{Shard: "2020-W38", Timestamp: 1, ID: 1, SortField: "level"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := tt.cursor.Encode()
+			if strings.ContainsAny(s, "+/=") {
+				t.Errorf("cursor %q isn't URL-safe", s)
+			}
+			c, err := DecodeQueryCursor(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(*c, tt.cursor) {
+				t.Errorf("expected %+v, got %+v", tt.cursor, *c)
+			}
+		})
+	}
+}
+
+func TestDecodeInvalidQueryCursor(t *testing.T) {
+	encode := func(s string) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(s))
+	}
+	for _, s := range []string{
+		"",
+		"not a cursor",
+		base64.URLEncoding.EncodeToString([]byte(`{"s":"2020-W38","t":1,"i":1}`)), // padded
+		base64.StdEncoding.EncodeToString([]byte(`{"s":"2020-W38?","t":1,"i":1}`)),
+		encode(`{"s":"2020-W38","t":1,"i":1`),
+		encode(`{"s":"2020-W38","t":"1","i":1}`),
+		encode(`{"t":1,"i":1}`),
+		encode(`{}`),
+		encode(`null`),
+		encode(`[1]`),
+	} {
+		if c, err := DecodeQueryCursor(s); err == nil {
+			t.Errorf("%q: expected an error, got %+v", s, c)
+		}
+	}
+}
+
+func TestNewQueryCursor(t *testing.T) {
+	sc := &DbShardCollection{instance: &CeruleanInstance{config: NewCeruleanConfig()}}
+	row := map[string]interface{}{"id": int64(42), "timestamp": 1600000000.123457, "host": "web1"}
+	tests := []struct {
+		name     string
+		params   QueryParams
+		expected QueryCursor
+	}{
+		{
+			name:     "descending",
+			expected: QueryCursor{Shard: "2020-W37", Timestamp: 1600000000123457, ID: 42},
+		},
+		{
+			name:     "ascending with a sort field",
+			params:   QueryParams{Ascending: true, SortField: "host", SortDescending: true},
+			expected: QueryCursor{Shard: "2020-W37", Timestamp: 1600000000123457, ID: 42, Ascending: true, SortField: "host", SortDescending: true, SortValue: "web1"},
+		},
+		{
+			name:     "missing sort field",
+			params:   QueryParams{SortField: "level"},
+			expected: QueryCursor{Shard: "2020-W37", Timestamp: 1600000000123457, ID: 42, SortField: "level"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := sc.newQueryCursor(row, tt.params)
+			if !reflect.DeepEqual(*c, tt.expected) {
+				t.Errorf("expected %+v, got %+v", tt.expected, *c)
+			}
+		})
+	}
+}
+
+func TestQueryCursorSQLCondition(t *testing.T) {
+	tests := []struct {
+		name       string
+		cursor     QueryCursor
+		shard      string
+		sortColumn string
+		cond       string
+		args       []interface{}
+	}{
+		{
+			name:   "other shard",
+			cursor: QueryCursor{Shard: "2020-W38", Timestamp: 10, ID: 5},
+			shard:  "2020-W37",
+			cond:   "timestamp < ?",
+			args:   []interface{}{int64(10)},
+		},
+		{
+			name:   "other shard ascending",
+			cursor: QueryCursor{Shard: "2020-W38", Timestamp: 10, ID: 5, Ascending: true},
+			shard:  "2020-W39",
+			cond:   "timestamp > ?",
+			args:   []interface{}{int64(10)},
+		},
+		{
+			name:   "cursor's shard",
+			cursor: QueryCursor{Shard: "2020-W38", Timestamp: 10, ID: 5},
+			shard:  "2020-W38",
+			cond:   "(timestamp < ? OR (timestamp = ? AND id < ?))",
+			args:   []interface{}{int64(10), int64(10), int64(5)},
+		},
+		{
+			name:       "sort field ascending",
+			cursor:     QueryCursor{Shard: "2020-W38", Timestamp: 10, ID: 5, SortField: "host", SortValue: "web1"},
+			shard:      "2020-W38",
+			sortColumn: "host",
+			cond:       "(timestamp < ? OR (timestamp = ? AND (host > ? OR (host = ? AND id < ?))))",
+			args:       []interface{}{int64(10), int64(10), "web1", "web1", int64(5)},
+		},
+		{
+			name:       "sort field descending",
+			cursor:     QueryCursor{Shard: "2020-W38", Timestamp: 10, ID: 5, Ascending: true, SortField: "host", SortDescending: true, SortValue: "web1"},
+			shard:      "2020-W38",
+			sortColumn: "host",
+			cond:       "(timestamp > ? OR (timestamp = ? AND (host < ? OR (host = ? AND id > ?) OR host IS NULL)))",
+			args:       []interface{}{int64(10), int64(10), "web1", "web1", int64(5)},
+		},
+		{
+			name:       "missing sort field ascending",
+			cursor:     QueryCursor{Shard: "2020-W38", Timestamp: 10, ID: 5, SortField: "host"},
+			shard:      "2020-W38",
+			sortColumn: "host",
+			cond:       "(timestamp < ? OR (timestamp = ? AND (host IS NOT NULL OR id < ?)))",
+			args:       []interface{}{int64(10), int64(10), int64(5)},
+		},
+		{
+			name:       "missing sort field descending",
+			cursor:     QueryCursor{Shard: "2020-W38", Timestamp: 10, ID: 5, SortField: "host", SortDescending: true},
+			shard:      "2020-W38",
+			sortColumn: "host",
+			cond:       "(timestamp < ? OR (timestamp = ? AND (host IS NULL AND id < ?)))",
+			args:       []interface{}{int64(10), int64(10), int64(5)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cond, args := tt.cursor.sqlCondition(tt.shard, tt.sortColumn)
+			if cond != tt.cond {
+				t.Errorf("expected %s, got %s", tt.cond, cond)
+			}
+			if !reflect.DeepEqual(args, tt.args) {
+				t.Errorf("expected arguments %v, got %v", tt.args, args)
+			}
+		})
+	}
+}
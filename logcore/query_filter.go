@@ -0,0 +1,434 @@
+package logcore
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// The filter language looks like an SQL WHERE clause, restricted to
+// comparisons of fields with literal values:
+//
+//   host = "web1" AND (level <= 3 OR NOT EXISTS user_id)
+//   facility IN ('kern', 'auth') AND short_message LIKE '%timeout%'
+//   duration BETWEEN 0.5 AND 10 AND user_id IS NOT NULL
+//   MATCH 'connection refus*' AND NOT short_message MATCH '"disk full"'
+//   short_message REGEXP 'req-[0-9a-f]{8}' AND host ICONTAINS 'web'
+//   regexp_extract(short_message, 'took ([0-9]+)ms') > 100
+//   json_field(full_message, 'user.id') IN ('42', '43')
+//
+// Keywords are case-insensitive, strings are single- or double-quoted with
+// backslash escapes, and a leading underscore in field names (as in GELF
+// additional fields) is optional. The timestamp field is compared in seconds.
+// MATCH takes an SQLite FTS5 full-text query, see fulltext.go. REGEXP takes a
+// Go (RE2) regular expression, which matches anywhere in the value unless
+// anchored with ^ or $. As backslashes escape characters in strings, those in
+// regular expressions must be doubled, e.g. '\\d+'. The functions, see
+// sql_functions.go, can be used in place of fields, except with MATCH.
+
+type filterTokenType int
+
+const (
+	tokEOF filterTokenType = iota
+	tokIdent
+	tokString
+	tokNumber
+	tokOp
+	tokLParen
+	tokRParen
+	tokComma
+)
+
+type filterToken struct {
+	typ filterTokenType
+	str string
+	pos int
+}
+
+func (t filterToken) String() string {
+	if t.typ == tokEOF {
+		return "end of query"
+	}
+	return fmt.Sprintf("'%s' at position %d", t.str, t.pos+1)
+}
+
+// isKeyword checks if the token is the given (upper case) keyword.
+func (t filterToken) isKeyword(kw string) bool {
+	return t.typ == tokIdent && strings.ToUpper(t.str) == kw
+}
+
+func isFilterIdentChar(c rune) bool {
+	return c == '_' || c == '-' || c == '.' || unicode.IsLetter(c) || unicode.IsDigit(c)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func tokenizeFilterQuery(q string) (tokens []filterToken, err error) {
+	i := 0
+	for i < len(q) {
+		c := q[i]
+		start := i
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			i++
+			continue
+		case c == '(':
+			tokens = append(tokens, filterToken{tokLParen, "(", start})
+			i++
+		case c == ')':
+			tokens = append(tokens, filterToken{tokRParen, ")", start})
+			i++
+		case c == ',':
+			tokens = append(tokens, filterToken{tokComma, ",", start})
+			i++
+		case c == '=' || c == '!' || c == '<' || c == '>':
+			i++
+			if i < len(q) && (q[i] == '=' || (c == '<' && q[i] == '>')) {
+				i++
+			}
+			op := q[start:i]
+			switch op {
+			case "==":
+				op = "="
+			case "<>":
+				op = "!="
+			case "!":
+				return nil, fmt.Errorf("Unexpected '!' at position %d", start+1)
+			}
+			tokens = append(tokens, filterToken{tokOp, op, start})
+		case c == '\'' || c == '"':
+			var s strings.Builder
+			i++
+			closed := false
+			for i < len(q) {
+				if q[i] == '\\' && i+1 < len(q) {
+					s.WriteByte(q[i+1])
+					i += 2
+					continue
+				}
+				if q[i] == c {
+					if i+1 < len(q) && q[i+1] == c {
+						// SQL-style doubled quote
+						s.WriteByte(c)
+						i += 2
+						continue
+					}
+					closed = true
+					i++
+					break
+				}
+				s.WriteByte(q[i])
+				i++
+			}
+			if !closed {
+				return nil, fmt.Errorf("Unterminated string starting at position %d", start+1)
+			}
+			tokens = append(tokens, filterToken{tokString, s.String(), start})
+		case isDigit(c) || ((c == '-' || c == '+' || c == '.') && i+1 < len(q) && (isDigit(q[i+1]) || q[i+1] == '.')):
+			i++
+			for i < len(q) && (isDigit(q[i]) || q[i] == '.' || q[i] == 'e' || q[i] == 'E' ||
+				((q[i] == '-' || q[i] == '+') && (q[i-1] == 'e' || q[i-1] == 'E'))) {
+				i++
+			}
+			tokens = append(tokens, filterToken{tokNumber, q[start:i], start})
+		default:
+			r := []rune(q[i:])
+			n := 0
+			for n < len(r) && isFilterIdentChar(r[n]) {
+				n++
+			}
+			if n == 0 {
+				return nil, fmt.Errorf("Unexpected character '%c' at position %d", r[0], start+1)
+			}
+			i += len(string(r[:n]))
+			tokens = append(tokens, filterToken{tokIdent, q[start:i], start})
+		}
+	}
+	tokens = append(tokens, filterToken{tokEOF, "", len(q)})
+	return
+}
+
+type filterParser struct {
+	tokens []filterToken
+	pos    int
+	depth  int
+}
+
+// ParseFilterQuery parses a query in the filter language. An empty query
+// returns a nil node, which matches everything.
+func ParseFilterQuery(q string) (node *QueryNode, err error) {
+	if strings.TrimSpace(q) == "" {
+		return nil, nil
+	}
+	tokens, err := tokenizeFilterQuery(q)
+	if err != nil {
+		return
+	}
+	p := filterParser{tokens: tokens}
+	node, err = p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.typ != tokEOF {
+		return nil, fmt.Errorf("Unexpected %s", t)
+	}
+	return
+}
+
+func (p *filterParser) peek() filterToken {
+	return p.tokens[p.pos]
+}
+
+func (p *filterParser) next() filterToken {
+	t := p.tokens[p.pos]
+	if t.typ != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *filterParser) enter() error {
+	p.depth++
+	if p.depth > maxQueryDepth {
+		return fmt.Errorf("Query nested too deeply")
+	}
+	return nil
+}
+
+func (p *filterParser) parseOr() (node *QueryNode, err error) {
+	node, err = p.parseAnd()
+	if err != nil {
+		return
+	}
+	for p.peek().isKeyword("OR") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		node = joinQueryNodes(QueryOr, node, right)
+	}
+	return
+}
+
+func (p *filterParser) parseAnd() (node *QueryNode, err error) {
+	node, err = p.parseUnary()
+	if err != nil {
+		return
+	}
+	for p.peek().isKeyword("AND") {
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		node = joinQueryNodes(QueryAnd, node, right)
+	}
+	return
+}
+
+// joinQueryNodes combines two nodes with AND or OR, flattening nested
+// nodes of the same type.
+func joinQueryNodes(typ QueryNodeType, left, right *QueryNode) *QueryNode {
+	if left.Type == typ {
+		left.Children = append(left.Children, right)
+		return left
+	}
+	return &QueryNode{Type: typ, Children: []*QueryNode{left, right}}
+}
+
+func (p *filterParser) parseUnary() (node *QueryNode, err error) {
+	if err = p.enter(); err != nil {
+		return
+	}
+	defer func() { p.depth-- }()
+
+	t := p.peek()
+	switch {
+	case t.isKeyword("NOT"):
+		p.next()
+		child, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &QueryNode{Type: QueryNot, Children: []*QueryNode{child}}, nil
+	case t.typ == tokLParen:
+		p.next()
+		node, err = p.parseOr()
+		if err != nil {
+			return
+		}
+		if t := p.next(); t.typ != tokRParen {
+			return nil, fmt.Errorf("Expecting ')', got %s", t)
+		}
+		return
+	case t.isKeyword("MATCH") && p.tokens[p.pos+1].typ == tokString:
+		p.next()
+		return NewQueryMatch("", p.next().str), nil
+	case t.isKeyword("EXISTS"):
+		p.next()
+		field, f, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		return &QueryNode{Type: QueryExists, Field: field, Func: f}, nil
+	}
+	return p.parsePredicate()
+}
+
+func (p *filterParser) parseField() (field string, err error) {
+	t := p.next()
+	if t.typ != tokIdent {
+		return "", fmt.Errorf("Expecting field name, got %s", t)
+	}
+	field = strings.TrimPrefix(t.str, "_")
+	if !reIdentifier.MatchString(field) {
+		return "", fmt.Errorf("Invalid field name %s", t)
+	}
+	return
+}
+
+// parseOperand parses a field, or a function of a field.
+func (p *filterParser) parseOperand() (field string, f *QueryFunc, err error) {
+	if p.peek().typ != tokIdent || p.tokens[p.pos+1].typ != tokLParen {
+		field, err = p.parseField()
+		return
+	}
+	name := p.next()
+	p.next()
+	if field, err = p.parseField(); err != nil {
+		return
+	}
+	var args []QueryValue
+	for {
+		t := p.next()
+		if t.typ == tokRParen {
+			break
+		}
+		if t.typ != tokComma {
+			return "", nil, fmt.Errorf("Expecting ',' or ')', got %s", t)
+		}
+		v, err := p.parseValue()
+		if err != nil {
+			return "", nil, err
+		}
+		args = append(args, v)
+	}
+	f, err = NewQueryFunc(name.str, args)
+	return
+}
+
+func (p *filterParser) parseValue() (v QueryValue, err error) {
+	t := p.next()
+	switch t.typ {
+	case tokString:
+		return NewQueryString(t.str), nil
+	case tokNumber:
+		return NewQueryNumber(t.str)
+	}
+	return v, fmt.Errorf("Expecting a string or a number, got %s", t)
+}
+
+func (p *filterParser) parsePredicate() (node *QueryNode, err error) {
+	field, f, err := p.parseOperand()
+	if err != nil {
+		return
+	}
+	negate := false
+	t := p.next()
+	if t.isKeyword("NOT") {
+		negate = true
+		t = p.next()
+		if !t.isKeyword("IN") && !t.isKeyword("LIKE") && !t.isKeyword("BETWEEN") && !t.isKeyword("MATCH") &&
+			!t.isKeyword("REGEXP") && !t.isKeyword("ICONTAINS") {
+			return nil, fmt.Errorf("Expecting IN, LIKE, BETWEEN, MATCH, REGEXP or ICONTAINS after NOT, got %s", t)
+		}
+	}
+	switch {
+	case t.typ == tokOp:
+		v, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		node = &QueryNode{Type: QueryCompare, Field: field, Op: t.str, Values: []QueryValue{v}}
+	case t.isKeyword("IN"):
+		if t := p.next(); t.typ != tokLParen {
+			return nil, fmt.Errorf("Expecting '(' after IN, got %s", t)
+		}
+		node = &QueryNode{Type: QueryIn, Field: field}
+		for {
+			v, err := p.parseValue()
+			if err != nil {
+				return nil, err
+			}
+			node.Values = append(node.Values, v)
+			t := p.next()
+			if t.typ == tokRParen {
+				break
+			}
+			if t.typ != tokComma {
+				return nil, fmt.Errorf("Expecting ',' or ')', got %s", t)
+			}
+		}
+	case t.isKeyword("LIKE"):
+		v, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		node = &QueryNode{Type: QueryLike, Field: field, Values: []QueryValue{v}}
+	case t.isKeyword("REGEXP"), t.isKeyword("ICONTAINS"):
+		v, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		node = &QueryNode{Type: QueryContains, Field: field, Values: []QueryValue{v}}
+		if t.isKeyword("REGEXP") {
+			node.Type = QueryRegexp
+			if _, err := compileQueryRegexp(v.Str); err != nil {
+				return nil, err
+			}
+		}
+	case t.isKeyword("MATCH"):
+		if f != nil {
+			return nil, fmt.Errorf("MATCH can't be used with %s()", f.Name)
+		}
+		t = p.next()
+		if t.typ != tokString {
+			return nil, fmt.Errorf("Expecting a full-text query string after MATCH, got %s", t)
+		}
+		node = NewQueryMatch(field, t.str)
+	case t.isKeyword("BETWEEN"):
+		v1, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		if t := p.next(); !t.isKeyword("AND") {
+			return nil, fmt.Errorf("Expecting AND in BETWEEN, got %s", t)
+		}
+		v2, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		node = &QueryNode{Type: QueryBetween, Field: field, Values: []QueryValue{v1, v2}}
+	case t.isKeyword("IS"):
+		node = &QueryNode{Type: QueryExists, Field: field}
+		t = p.next()
+		if t.isKeyword("NOT") {
+			t = p.next()
+		} else {
+			negate = true
+		}
+		if !t.isKeyword("NULL") {
+			return nil, fmt.Errorf("Expecting NULL after IS, got %s", t)
+		}
+	default:
+		return nil, fmt.Errorf("Expecting an operator after %s, got %s", field, t)
+	}
+	node.Func = f
+	if negate {
+		node = &QueryNode{Type: QueryNot, Children: []*QueryNode{node}}
+	}
+	return
+}
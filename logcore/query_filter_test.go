@@ -0,0 +1,71 @@
+package logcore
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseFilterQuery(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected string // the parsed query's String(), or the start of the error
+		err      bool
+	}{
+		{query: "", expected: ""},
+		{query: "  \t", expected: ""},
+		{query: `host = "web1" AND (level <= 3 OR NOT EXISTS user_id)`, expected: `(host = "web1" AND (level <= 3 OR NOT EXISTS user_id))`},
+		{query: `facility IN ('kern', 'auth') AND short_message LIKE '%timeout%'`, expected: `(facility IN ("kern", "auth") AND short_message LIKE "%timeout%")`},
+		{query: `duration BETWEEN 0.5 AND 10 AND user_id IS NOT NULL`, expected: `(duration BETWEEN 0.5 AND 10 AND EXISTS user_id)`},
+		{query: `user_id is null`, expected: `NOT EXISTS user_id`},
+		{query: `MATCH 'connection refus*' AND NOT short_message MATCH '"disk full"'`, expected: `(MATCH "connection refus*" AND NOT short_message MATCH "\"disk full\"")`},
+		{query: `short_message REGEXP 'req-[0-9a-f]{8}' AND host ICONTAINS 'web'`, expected: `(short_message REGEXP "req-[0-9a-f]{8}" AND host ICONTAINS "web")`},
+		{query: `regexp_extract(short_message, 'took ([0-9]+)ms') > 100`, expected: `regexp_extract(short_message, "took ([0-9]+)ms", 1) > 100`},
+		{query: `json_field(full_message, 'user.id') IN ('42', '43')`, expected: `json_field(full_message, "user.id") IN ("42", "43")`},
+		{query: `_user_id == 5 or a <> -1.5e3 or b != 'it''s' or c = "a\"b"`, expected: `(user_id = 5 OR a != -1.5e3 OR b != "it's" OR c = "a\"b")`},
+		{query: `a NOT IN (1) and b not like 'x' and c not between 1 and 2`, expected: `(NOT a IN (1) AND NOT b LIKE "x" AND NOT c BETWEEN 1 AND 2)`},
+		{query: `a = 1 AND b = 2 AND c = 3 OR d = 4 OR e = 5`, expected: `((a = 1 AND b = 2 AND c = 3) OR d = 4 OR e = 5)`},
+		{query: strings.Repeat("(", maxQueryDepth-1) + "a = 1" + strings.Repeat(")", maxQueryDepth-1), expected: `a = 1`},
+
+		{query: `a = `, expected: "Expecting a string or a number, got end of query", err: true},
+		{query: `a = b`, expected: "Expecting a string or a number, got 'b' at position 5", err: true},
+		{query: `a ! 1`, expected: "Unexpected '!' at position 3", err: true},
+		{query: `a = 'x`, expected: "Unterminated string starting at position 5", err: true},
+		{query: `(a = 1`, expected: "Expecting ')', got end of query", err: true},
+		{query: `a = 1)`, expected: "Unexpected ')' at position 6", err: true},
+		{query: `a = 1 b = 2`, expected: "Unexpected 'b' at position 7", err: true},
+		{query: `a`, expected: "Expecting an operator after a", err: true},
+		{query: `a # 1`, expected: "Unexpected character '#' at position 3", err: true},
+		{query: `1a = 1`, expected: "Expecting field name", err: true},
+		{query: `a IS 1`, expected: "Expecting NULL after IS", err: true},
+		{query: `a NOT = 1`, expected: "Expecting IN, LIKE, BETWEEN, MATCH, REGEXP or ICONTAINS after NOT", err: true},
+		{query: `a BETWEEN 1 2`, expected: "Expecting AND in BETWEEN", err: true},
+		{query: `a IN 1`, expected: "Expecting '(' after IN", err: true},
+		{query: `a IN (1 2)`, expected: "Expecting ',' or ')'", err: true},
+		{query: `a REGEXP '('`, expected: "Invalid regular expression", err: true},
+		{query: `nosuchfunc(a) = 1`, expected: "Unknown function: nosuchfunc", err: true},
+		{query: `json_field(a, 'x') MATCH 'x'`, expected: "MATCH can't be used with json_field()", err: true},
+		{query: strings.Repeat("(", maxQueryDepth+1) + "a = 1" + strings.Repeat(")", maxQueryDepth+1), expected: "Query nested too deeply", err: true},
+		{query: strings.Repeat("NOT ", maxQueryDepth+1) + "a = 1", expected: "Query nested too deeply", err: true},
+	}
+	for _, tt := range tests {
+		node, err := ParseFilterQuery(tt.query)
+		if tt.err {
+			if err == nil || !strings.HasPrefix(err.Error(), tt.expected) {
+				t.Errorf("%q: expected error %q, got %v", tt.query, tt.expected, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", tt.query, err)
+			continue
+		}
+		if node.String() != tt.expected {
+			t.Errorf("%q: expected %s, got %s", tt.query, tt.expected, node.String())
+			continue
+		}
+		// The readable representation is in the filter syntax
+		if reparsed, err := ParseFilterQuery(node.String()); err != nil || reparsed.String() != tt.expected {
+			t.Errorf("%q: reparsing %s returned %s, %v", tt.query, tt.expected, reparsed.String(), err)
+		}
+	}
+}
@@ -0,0 +1,482 @@
+package logcore
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// The Lucene syntax is the search syntax used by Graylog, e.g.
+//
+//   host:web-1 AND NOT short_message:"timeout"
+//   host:(web1 OR web2) AND _exists_:full_message
+//   connection refus*
+//   host:/web-[0-9]+/
+//
+// Terms without a field are full-text searches over short_message, full_message
+// and the configured full-text fields, as are terms on the first two fields.
+// Other fields must match exactly unless the term contains the * or ?
+// wildcards. Regular expressions between slashes must match the whole value,
+// and use the Go (RE2) syntax. Numeric fields can also be compared, as in
+// level:<=3, or searched with ranges, as in duration:[0.5 TO *]. Clauses
+// without an operator between them are joined with AND.
+
+// Fields searched by terms without a field name
+var luceneDefaultFields = []string{"short_message", "full_message"}
+
+type luceneTokenType int
+
+const (
+	lucEOF luceneTokenType = iota
+	lucTerm
+	lucPhrase
+	lucColon
+	lucLParen
+	lucRParen
+	lucRangeStart // [ or {
+	lucRangeEnd   // ] or }
+	lucAnd
+	lucOr
+	lucNot // NOT, ! or -
+	lucMust
+	lucRegexp // /regexp/, after a colon
+)
+
+type luceneToken struct {
+	typ     luceneTokenType
+	str     string // unescaped text
+	pattern string // for terms, a LIKE pattern with wildcards translated
+	wild    bool   // term contains unescaped wildcards
+	pos     int
+}
+
+func (t luceneToken) String() string {
+	if t.typ == lucEOF {
+		return "end of query"
+	}
+	return fmt.Sprintf("'%s' at position %d", t.str, t.pos+1)
+}
+
+func isLuceneSpecial(c rune) bool {
+	return unicode.IsSpace(c) || strings.ContainsRune(`():[]{}"`, c)
+}
+
+// escapeLike escapes the LIKE wildcards in s, for use with ESCAPE '\'.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// luceneRegexpEnd returns the position after the regular expression starting
+// with the slash at r[i], or -1 if there isn't one.
+func luceneRegexpEnd(r []rune, i int) int {
+	for j := i + 1; j < len(r); j++ {
+		if r[j] == '\\' {
+			j++
+		} else if r[j] == '/' {
+			if j+1 < len(r) && !isLuceneSpecial(r[j+1]) {
+				// Like a path: /var/log
+				return -1
+			}
+			return j + 1
+		}
+	}
+	return -1
+}
+
+func tokenizeLuceneQuery(q string) (tokens []luceneToken, err error) {
+	r := []rune(q)
+	i := 0
+	for i < len(r) {
+		c := r[i]
+		start := i
+		prevColon := len(tokens) > 0 && tokens[len(tokens)-1].typ == lucColon
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '(':
+			tokens = append(tokens, luceneToken{typ: lucLParen, str: "(", pos: start})
+			i++
+		case c == ')':
+			tokens = append(tokens, luceneToken{typ: lucRParen, str: ")", pos: start})
+			i++
+		case c == ':':
+			tokens = append(tokens, luceneToken{typ: lucColon, str: ":", pos: start})
+			i++
+		case c == '[' || c == '{':
+			tokens = append(tokens, luceneToken{typ: lucRangeStart, str: string(c), pos: start})
+			i++
+		case c == ']' || c == '}':
+			tokens = append(tokens, luceneToken{typ: lucRangeEnd, str: string(c), pos: start})
+			i++
+		case c == '&' && i+1 < len(r) && r[i+1] == '&':
+			tokens = append(tokens, luceneToken{typ: lucAnd, str: "&&", pos: start})
+			i += 2
+		case c == '|' && i+1 < len(r) && r[i+1] == '|':
+			tokens = append(tokens, luceneToken{typ: lucOr, str: "||", pos: start})
+			i += 2
+		case (c == '-' || c == '+' || c == '!') && !prevColon && i+1 < len(r) && !unicode.IsSpace(r[i+1]) && !unicode.IsDigit(r[i+1]):
+			if c == '+' {
+				tokens = append(tokens, luceneToken{typ: lucMust, str: "+", pos: start})
+			} else {
+				tokens = append(tokens, luceneToken{typ: lucNot, str: string(c), pos: start})
+			}
+			i++
+		case c == '/' && prevColon && luceneRegexpEnd(r, i) > 0:
+			end := luceneRegexpEnd(r, i)
+			// Only \/ is unescaped, other escapes are the regexp's
+			pattern := strings.ReplaceAll(string(r[i+1:end-1]), `\/`, "/")
+			tokens = append(tokens, luceneToken{typ: lucRegexp, str: pattern, pos: start})
+			i = end
+		case c == '"':
+			var s strings.Builder
+			i++
+			closed := false
+			for i < len(r) {
+				if r[i] == '\\' && i+1 < len(r) {
+					s.WriteRune(r[i+1])
+					i += 2
+					continue
+				}
+				if r[i] == '"' {
+					closed = true
+					i++
+					break
+				}
+				s.WriteRune(r[i])
+				i++
+			}
+			if !closed {
+				return nil, fmt.Errorf("Unterminated phrase starting at position %d", start+1)
+			}
+			tokens = append(tokens, luceneToken{typ: lucPhrase, str: s.String(), pattern: escapeLike(s.String()), pos: start})
+		default:
+			var s, pattern strings.Builder
+			wild := false
+			for i < len(r) && !isLuceneSpecial(r[i]) {
+				switch {
+				case r[i] == '\\' && i+1 < len(r):
+					s.WriteRune(r[i+1])
+					pattern.WriteString(escapeLike(string(r[i+1])))
+					i++
+				case r[i] == '*':
+					s.WriteRune('*')
+					pattern.WriteRune('%')
+					wild = true
+				case r[i] == '?':
+					s.WriteRune('?')
+					pattern.WriteRune('_')
+					wild = true
+				default:
+					s.WriteRune(r[i])
+					pattern.WriteString(escapeLike(string(r[i])))
+				}
+				i++
+			}
+			t := luceneToken{typ: lucTerm, str: s.String(), pattern: pattern.String(), wild: wild, pos: start}
+			switch t.str {
+			case "AND":
+				t.typ = lucAnd
+			case "OR":
+				t.typ = lucOr
+			case "NOT":
+				t.typ = lucNot
+			}
+			tokens = append(tokens, t)
+		}
+	}
+	tokens = append(tokens, luceneToken{typ: lucEOF, pos: len(r)})
+	return
+}
+
+type luceneParser struct {
+	tokens []luceneToken
+	pos    int
+	depth  int
+	field  string // field for bare terms inside field:( ... ) groups
+}
+
+// ParseLuceneQuery parses a query in the Lucene (Graylog) search syntax.
+// An empty query, or "*", returns a nil node, which matches everything.
+func ParseLuceneQuery(q string) (node *QueryNode, err error) {
+	q = strings.TrimSpace(q)
+	if q == "" || q == "*" {
+		return nil, nil
+	}
+	tokens, err := tokenizeLuceneQuery(q)
+	if err != nil {
+		return
+	}
+	p := luceneParser{tokens: tokens}
+	node, err = p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.typ != lucEOF {
+		return nil, fmt.Errorf("Unexpected %s", t)
+	}
+	return
+}
+
+func (p *luceneParser) peek() luceneToken {
+	return p.tokens[p.pos]
+}
+
+func (p *luceneParser) next() luceneToken {
+	t := p.tokens[p.pos]
+	if t.typ != lucEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *luceneParser) enter() error {
+	p.depth++
+	if p.depth > maxQueryDepth {
+		return fmt.Errorf("Query nested too deeply")
+	}
+	return nil
+}
+
+func (p *luceneParser) parseOr() (node *QueryNode, err error) {
+	node, err = p.parseAnd()
+	if err != nil {
+		return
+	}
+	for p.peek().typ == lucOr {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		node = joinQueryNodes(QueryOr, node, right)
+	}
+	return
+}
+
+func (p *luceneParser) parseAnd() (node *QueryNode, err error) {
+	node, err = p.parseClause()
+	if err != nil {
+		return
+	}
+	for {
+		t := p.peek()
+		if t.typ == lucAnd {
+			p.next()
+		} else if t.typ == lucEOF || t.typ == lucOr || t.typ == lucRParen {
+			return
+		}
+		right, err := p.parseClause()
+		if err != nil {
+			return nil, err
+		}
+		node = joinQueryNodes(QueryAnd, node, right)
+	}
+}
+
+func (p *luceneParser) parseClause() (node *QueryNode, err error) {
+	if err = p.enter(); err != nil {
+		return
+	}
+	defer func() { p.depth-- }()
+
+	t := p.next()
+	switch t.typ {
+	case lucNot:
+		child, err := p.parseClause()
+		if err != nil {
+			return nil, err
+		}
+		return &QueryNode{Type: QueryNot, Children: []*QueryNode{child}}, nil
+	case lucMust:
+		return p.parseClause()
+	case lucLParen:
+		node, err = p.parseOr()
+		if err != nil {
+			return
+		}
+		if t := p.next(); t.typ != lucRParen {
+			return nil, fmt.Errorf("Expecting ')', got %s", t)
+		}
+		return
+	case lucTerm:
+		if p.peek().typ == lucColon {
+			p.next()
+			return p.parseFieldValue(t.str)
+		}
+		return p.termNode(p.field, t)
+	case lucPhrase:
+		return p.termNode(p.field, t)
+	case lucRangeStart:
+		if p.field == "" {
+			return nil, fmt.Errorf("Range without a field name at position %d", t.pos+1)
+		}
+		p.pos--
+		return p.parseFieldValue(p.field)
+	}
+	return nil, fmt.Errorf("Unexpected %s", t)
+}
+
+func luceneFieldName(name string) (field string, err error) {
+	field = strings.TrimPrefix(name, "_")
+	if !reIdentifier.MatchString(field) {
+		return "", fmt.Errorf("Invalid field name '%s'", name)
+	}
+	return
+}
+
+func (p *luceneParser) parseFieldValue(name string) (node *QueryNode, err error) {
+	if name == "_exists_" {
+		t := p.next()
+		if t.typ != lucTerm {
+			return nil, fmt.Errorf("Expecting field name after _exists_, got %s", t)
+		}
+		field, err := luceneFieldName(t.str)
+		if err != nil {
+			return nil, err
+		}
+		return &QueryNode{Type: QueryExists, Field: field}, nil
+	}
+	field, err := luceneFieldName(name)
+	if err != nil {
+		return
+	}
+	t := p.next()
+	switch t.typ {
+	case lucLParen:
+		// field:(a OR b) applies the field to all the terms in the group
+		if err = p.enter(); err != nil {
+			return
+		}
+		oldField := p.field
+		p.field = field
+		node, err = p.parseOr()
+		p.field = oldField
+		p.depth--
+		if err != nil {
+			return
+		}
+		if t := p.next(); t.typ != lucRParen {
+			return nil, fmt.Errorf("Expecting ')', got %s", t)
+		}
+		return
+	case lucRangeStart:
+		return p.parseRange(field, t)
+	case lucTerm, lucPhrase:
+		return p.termNode(field, t)
+	case lucRegexp:
+		pattern := "^(?:" + t.str + ")$"
+		if _, err = compileQueryRegexp(pattern); err != nil {
+			return
+		}
+		return &QueryNode{Type: QueryRegexp, Field: field, Values: []QueryValue{NewQueryString(pattern)}}, nil
+	}
+	return nil, fmt.Errorf("Expecting a value for %s, got %s", field, t)
+}
+
+// parseRange parses [from TO to], where [] are inclusive and {} exclusive
+// bounds, and * is an open bound.
+func (p *luceneParser) parseRange(field string, open luceneToken) (node *QueryNode, err error) {
+	from := p.next()
+	if from.typ != lucTerm && from.typ != lucPhrase {
+		return nil, fmt.Errorf("Expecting a range start, got %s", from)
+	}
+	if t := p.next(); t.typ != lucTerm || t.str != "TO" {
+		return nil, fmt.Errorf("Expecting TO in range, got %s", t)
+	}
+	to := p.next()
+	if to.typ != lucTerm && to.typ != lucPhrase {
+		return nil, fmt.Errorf("Expecting a range end, got %s", to)
+	}
+	end := p.next()
+	if end.typ != lucRangeEnd {
+		return nil, fmt.Errorf("Expecting ']' or '}', got %s", end)
+	}
+	fromOpen := from.typ == lucTerm && from.str == "*"
+	toOpen := to.typ == lucTerm && to.str == "*"
+	if open.str == "[" && end.str == "]" && !fromOpen && !toOpen {
+		return &QueryNode{Type: QueryBetween, Field: field, Values: []QueryValue{luceneValue(from), luceneValue(to)}}, nil
+	}
+	bounds := []*QueryNode{}
+	if !fromOpen {
+		op := ">="
+		if open.str == "{" {
+			op = ">"
+		}
+		bounds = append(bounds, &QueryNode{Type: QueryCompare, Field: field, Op: op, Values: []QueryValue{luceneValue(from)}})
+	}
+	if !toOpen {
+		op := "<="
+		if end.str == "}" {
+			op = "<"
+		}
+		bounds = append(bounds, &QueryNode{Type: QueryCompare, Field: field, Op: op, Values: []QueryValue{luceneValue(to)}})
+	}
+	switch len(bounds) {
+	case 0:
+		return &QueryNode{Type: QueryExists, Field: field}, nil
+	case 1:
+		return bounds[0], nil
+	}
+	return &QueryNode{Type: QueryAnd, Children: bounds}, nil
+}
+
+// fullTextExpr converts a term or phrase into an FTS5 query. Terms with
+// wildcards other than a trailing * can't be searched with FTS5.
+func (t luceneToken) fullTextExpr() (expr string, ok bool) {
+	if t.typ == lucPhrase || !t.wild {
+		return fullTextQuote(t.str), true
+	}
+	if strings.Count(t.str, "*") == 1 && strings.HasSuffix(t.str, "*") && !strings.Contains(t.str, "?") && len(t.str) > 1 {
+		return fullTextQuote(strings.TrimSuffix(t.str, "*")) + " *", true
+	}
+	return "", false
+}
+
+// luceneValue converts a term into a query value, which is a number if it looks like one.
+func luceneValue(t luceneToken) QueryValue {
+	if t.typ == lucTerm {
+		if v, err := NewQueryNumber(t.str); err == nil {
+			return v
+		}
+	}
+	return NewQueryString(t.str)
+}
+
+// termNode returns the node matching a single term or phrase on the field,
+// or on the default fields if field is empty.
+func (p *luceneParser) termNode(field string, t luceneToken) (node *QueryNode, err error) {
+	if field == "" || InStringArray(field, luceneDefaultFields) {
+		if expr, ok := t.fullTextExpr(); ok {
+			node = NewQueryMatch(field, expr)
+			// Keep the substring semantics when falling back to LIKE
+			node.Values[1] = NewQueryString("%" + t.pattern + "%")
+			return
+		}
+	}
+	if field == "" {
+		node = &QueryNode{Type: QueryOr}
+		for _, f := range luceneDefaultFields {
+			n, _ := p.termNode(f, t)
+			node.Children = append(node.Children, n)
+		}
+		return
+	}
+	if t.typ == lucTerm {
+		if t.str == "*" {
+			return &QueryNode{Type: QueryExists, Field: field}, nil
+		}
+		for _, op := range []string{"<=", ">=", "<", ">"} {
+			if strings.HasPrefix(t.str, op) && len(t.str) > len(op) {
+				v := luceneValue(luceneToken{typ: lucTerm, str: t.str[len(op):]})
+				return &QueryNode{Type: QueryCompare, Field: field, Op: op, Values: []QueryValue{v}}, nil
+			}
+		}
+	}
+	if InStringArray(field, luceneDefaultFields) {
+		return &QueryNode{Type: QueryLike, Field: field, Values: []QueryValue{NewQueryString("%" + t.pattern + "%")}}, nil
+	}
+	if t.wild {
+		return &QueryNode{Type: QueryLike, Field: field, Values: []QueryValue{NewQueryString(t.pattern)}}, nil
+	}
+	return &QueryNode{Type: QueryCompare, Field: field, Op: "=", Values: []QueryValue{luceneValue(t)}}, nil
+}
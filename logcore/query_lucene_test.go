@@ -0,0 +1,104 @@
+package logcore
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseLuceneQuery(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected string // the parsed query's String(), or the start of the error
+		err      bool
+	}{
+		{query: "", expected: ""},
+		{query: " * ", expected: ""},
+		{query: `host:web-1 AND NOT short_message:"timeout"`, expected: `(host = "web-1" AND NOT short_message MATCH "\"timeout\"")`},
+		{query: `host:(web1 OR web2) AND _exists_:full_message`, expected: `((host = "web1" OR host = "web2") AND EXISTS full_message)`},
+		{query: `connection refus*`, expected: `(MATCH "\"connection\"" AND MATCH "\"refus\" *")`},
+		{query: `"disk full"`, expected: `MATCH "\"disk full\""`},
+		{query: `err?r`, expected: `(short_message LIKE "%err_r%" OR full_message LIKE "%err_r%")`},
+		{query: `host:/web-[0-9]+/`, expected: `host REGEXP "^(?:web-[0-9]+)$"`},
+		{query: `a:/x\/y/`, expected: `a REGEXP "^(?:x/y)$"`},
+		{query: `path:/var/log`, expected: `path = "/var/log"`},
+		{query: `level:<=3 duration:[0.5 TO *]`, expected: `(level <= 3 AND duration >= 0.5)`},
+		{query: `a:*`, expected: `EXISTS a`},
+		{query: `a:[1 TO 5]`, expected: `a BETWEEN 1 AND 5`},
+		{query: `a:{1 TO 5]`, expected: `(a > 1 AND a <= 5)`},
+		{query: `a:{a TO z}`, expected: `(a > "a" AND a < "z")`},
+		{query: `a:[* TO *]`, expected: `EXISTS a`},
+		{query: `a:(x [1 TO 2])`, expected: `(a = "x" AND a BETWEEN 1 AND 2)`},
+		{query: `a:x* || b:y? && !c:z`, expected: `(a LIKE "x%" OR (b LIKE "y_" AND NOT c = "z"))`},
+		{query: `+a:1 -b:2`, expected: `(a = 1 AND NOT b = 2)`},
+		{query: `a:-5`, expected: `a = -5`},
+		{query: `_a:1`, expected: `a = 1`},
+		{query: `a:\*x`, expected: `a = "*x"`},
+		{query: `a:"x y"`, expected: `a = "x y"`},
+		{query: strings.Repeat("(", maxQueryDepth-1) + "a:1" + strings.Repeat(")", maxQueryDepth-1), expected: `a = 1`},
+
+		{query: `a:`, expected: "Expecting a value for a, got end of query", err: true},
+		{query: `a:(x`, expected: "Expecting ')', got end of query", err: true},
+		{query: `x)`, expected: "Unexpected ')' at position 2", err: true},
+		{query: `"x`, expected: "Unterminated phrase starting at position 1", err: true},
+		{query: `a:[1 TO]`, expected: "Expecting a range end", err: true},
+		{query: `a:[1 5]`, expected: "Expecting TO in range", err: true},
+		{query: `a:[1 TO 2`, expected: "Expecting ']' or '}', got end of query", err: true},
+		{query: `[1 TO 2]`, expected: "Range without a field name at position 1", err: true},
+		{query: `1a:1`, expected: "Invalid field name '1a'", err: true},
+		{query: `_exists_:`, expected: "Expecting field name after _exists_", err: true},
+		{query: `a:/(/`, expected: "Invalid regular expression", err: true},
+		{query: `AND`, expected: "Unexpected 'AND' at position 1", err: true},
+		{query: `a OR`, expected: "Unexpected end of query", err: true},
+		{query: strings.Repeat("(", maxQueryDepth+1) + "a" + strings.Repeat(")", maxQueryDepth+1), expected: "Query nested too deeply", err: true},
+		{query: strings.Repeat("a:(", maxQueryDepth+1) + "a" + strings.Repeat(")", maxQueryDepth+1), expected: "Query nested too deeply", err: true},
+		{query: strings.Repeat("NOT ", maxQueryDepth+1) + "a", expected: "Query nested too deeply", err: true},
+	}
+	for _, tt := range tests {
+		node, err := ParseLuceneQuery(tt.query)
+		if tt.err {
+			if err == nil || !strings.HasPrefix(err.Error(), tt.expected) {
+				t.Errorf("%q: expected error %q, got %v", tt.query, tt.expected, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", tt.query, err)
+			continue
+		}
+		if node.String() != tt.expected {
+			t.Errorf("%q: expected %s, got %s", tt.query, tt.expected, node.String())
+		}
+	}
+}
+
+// The examples in the documentation must work on a shard with only the
+// builtin fields.
+func TestLuceneDocExamples(t *testing.T) {
+	builtinFields := map[string]string{
+		"id":            "INTEGER",
+		"timestamp":     "INTEGER",
+		"facility":      "TEXT",
+		"host":          "TEXT",
+		"full_message":  "TEXT",
+		"short_message": "TEXT",
+	}
+	examples := []string{
+		`host:web-1 AND NOT short_message:"timeout"`,
+		`host:(web1 OR web2) AND _exists_:full_message`,
+		`connection refus*`,
+		`host:/web-[0-9]+/`,
+		`host:(web1 OR web2) AND NOT timeout`,
+	}
+	for _, q := range examples {
+		node, err := ParseLuceneQuery(q)
+		if err == nil {
+			err = node.Validate(builtinFields)
+		}
+		if err == nil {
+			_, _, err = node.ToSQL(builtinFields, []string{"short_message", "full_message"})
+		}
+		if err != nil {
+			t.Errorf("%q: %v", q, err)
+		}
+	}
+}
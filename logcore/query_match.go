@@ -0,0 +1,231 @@
+package logcore
+
+import (
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Evaluation of queries on messages which aren't (yet) in the database, e.g.
+// for live tailing. It follows the SQL semantics of ToSQL: conditions on
+// missing fields are unknown (NULL), so they don't match even when negated,
+// and full-text conditions are substring searches, as when FTS5 isn't
+// available.
+
+type sqlBool int8
+
+const (
+	sqlFalse sqlBool = iota
+	sqlTrue
+	sqlNull
+)
+
+func toSQLBool(b bool) sqlBool {
+	if b {
+		return sqlTrue
+	}
+	return sqlFalse
+}
+
+// Matches checks if the message matches the query. A nil query matches all messages.
+func (n *QueryNode) Matches(msg *BasicGelfMessage) bool {
+	if n == nil {
+		return true
+	}
+	return n.eval(msg) == sqlTrue
+}
+
+func (n *QueryNode) eval(msg *BasicGelfMessage) sqlBool {
+	switch n.Type {
+	case QueryAnd:
+		result := sqlTrue
+		for _, c := range n.Children {
+			switch c.eval(msg) {
+			case sqlFalse:
+				return sqlFalse
+			case sqlNull:
+				result = sqlNull
+			}
+		}
+		return result
+	case QueryOr:
+		result := sqlFalse
+		for _, c := range n.Children {
+			switch c.eval(msg) {
+			case sqlTrue:
+				return sqlTrue
+			case sqlNull:
+				result = sqlNull
+			}
+		}
+		return result
+	case QueryNot:
+		switch n.Children[0].eval(msg) {
+		case sqlTrue:
+			return sqlFalse
+		case sqlFalse:
+			return sqlTrue
+		}
+		return sqlNull
+	case QueryMatch:
+		fields := []string{n.Field}
+		if n.Field == "" {
+			fields = fullTextBuiltinFields
+		}
+		result := sqlFalse
+		for _, f := range fields {
+			switch likeValue(messageFieldValue(msg, f), n.Values[1].Str) {
+			case sqlTrue:
+				return sqlTrue
+			case sqlNull:
+				result = sqlNull
+			}
+		}
+		return result
+	}
+
+	v := messageFieldValue(msg, n.Field)
+	field := n.Field
+	if n.Func != nil {
+		v, field = n.Func.eval(v), ""
+		if n.comparesNumbers() && v != nil {
+			if f, err := strconv.ParseFloat(string(toNumber(v)), 64); err == nil {
+				v = f
+			} else {
+				v = nil
+			}
+		}
+	}
+	switch n.Type {
+	case QueryExists:
+		s, isString := v.(string)
+		return toSQLBool(v != nil && !(isString && s == ""))
+	case QueryLike:
+		return likeValue(v, n.Values[0].Str)
+	}
+	if v == nil {
+		return sqlNull
+	}
+	switch n.Type {
+	case QueryRegexp:
+		match, err := sqlRegexp(n.Values[0].Str, v)
+		return toSQLBool(match && err == nil)
+	case QueryContains:
+		return toSQLBool(icontains(v, n.Values[0].Str))
+	case QueryCompare:
+		c := compareQueryValue(v, n.Values[0], field)
+		switch n.Op {
+		case "=":
+			return toSQLBool(c == 0)
+		case "!=":
+			return toSQLBool(c != 0)
+		case "<":
+			return toSQLBool(c < 0)
+		case "<=":
+			return toSQLBool(c <= 0)
+		case ">":
+			return toSQLBool(c > 0)
+		case ">=":
+			return toSQLBool(c >= 0)
+		}
+	case QueryIn:
+		for _, qv := range n.Values {
+			if compareQueryValue(v, qv, field) == 0 {
+				return sqlTrue
+			}
+		}
+		return sqlFalse
+	case QueryBetween:
+		return toSQLBool(compareQueryValue(v, n.Values[0], field) >= 0 && compareQueryValue(v, n.Values[1], field) <= 0)
+	}
+	return sqlFalse
+}
+
+// compareQueryValue compares a message's field value with a query value,
+// converted as in sqlArg. As in SQLite, numbers are less than strings.
+func compareQueryValue(v interface{}, qv QueryValue, field string) int {
+	switch v := v.(type) {
+	case string:
+		return strings.Compare(v, qv.Str)
+	case int64, float64:
+		arg := qv.sqlArg(field, "NUMERIC")
+		if _, isString := arg.(string); isString {
+			return -1
+		}
+		a, b := toFloat64(v), toFloat64(arg)
+		switch {
+		case a < b:
+			return -1
+		case a > b:
+			return 1
+		}
+		return 0
+	}
+	return -1
+}
+
+// likeValue evaluates the SQL LIKE operator (case-insensitive for ASCII
+// letters, with \ as the escape character) on a message's field value.
+func likeValue(v interface{}, pattern string) sqlBool {
+	s, ok := sqlValueText(v)
+	if !ok {
+		return sqlNull
+	}
+	return toSQLBool(matchLike(s, pattern))
+}
+
+// matchLike matches the string with a LIKE pattern. It only backtracks to
+// the last %, so it takes at most O(len(s) * len(pattern)) time.
+func matchLike(s, pattern string) bool {
+	const (
+		likeAnyOne  = -1
+		likeAnyMany = -2
+	)
+	pat := []rune{}
+	for i := 0; i < len(pattern); {
+		p, size := utf8.DecodeRuneInString(pattern[i:])
+		i += size
+		switch {
+		case p == '%':
+			p = likeAnyMany
+		case p == '_':
+			p = likeAnyOne
+		case p == '\\' && i < len(pattern):
+			p, size = utf8.DecodeRuneInString(pattern[i:])
+			i += size
+		}
+		pat = append(pat, p)
+	}
+	str := []rune(s)
+	si, pi := 0, 0
+	starPi, starSi := -1, 0
+	for si < len(str) {
+		switch {
+		case pi < len(pat) && pat[pi] == likeAnyMany:
+			starPi, starSi = pi, si
+			pi++
+		case pi < len(pat) && (pat[pi] == likeAnyOne || likeRuneEqual(str[si], pat[pi])):
+			si++
+			pi++
+		case starPi >= 0:
+			starSi++
+			si, pi = starSi, starPi+1
+		default:
+			return false
+		}
+	}
+	for pi < len(pat) && pat[pi] == likeAnyMany {
+		pi++
+	}
+	return pi == len(pat)
+}
+
+func likeRuneEqual(a, b rune) bool {
+	if a == b {
+		return true
+	}
+	if a < utf8.RuneSelf && b < utf8.RuneSelf {
+		return strings.EqualFold(string(a), string(b))
+	}
+	return false
+}
@@ -0,0 +1,123 @@
+package logcore
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Builtin fields, in the order in which they're listed in QueryStream.Columns
+var streamBuiltinColumns = []string{"id", "timestamp", "host", "facility", "short_message", "full_message"}
+
+// QueryStream iterates over the messages matching a query, shard by shard,
+// reading them from the database as they're needed, so that it can be used
+// for large exports. It isn't subject to the query timeout and the limit on
+// the rows scanned.
+type QueryStream struct {
+	Columns []string // union of the shards' fields, the builtin ones first, or id, timestamp and the requested fields
+
+	ctx    context.Context
+	params QueryParams
+	shards []*DbShard
+}
+
+// QueryStream prepares to iterate over the messages matching the query, in the
+// query order, with the fields in params.Fields if it's not nil. If
+// params.Limit is 0, all messages are returned.
+func (sc *DbShardCollection) QueryStream(ctx context.Context, params QueryParams) (stream *QueryStream, err error) {
+	params, shards, err := sc.prepareQuery(params)
+	if err != nil {
+		return
+	}
+	stream = &QueryStream{ctx: ctx, params: params, shards: shards}
+	if params.Fields != nil {
+		stream.Columns = []string{"id", "timestamp"}
+		for _, f := range params.Fields {
+			if !InStringArray(f, stream.Columns) {
+				stream.Columns = append(stream.Columns, f)
+			}
+		}
+		return
+	}
+	others := []string{}
+	for fn := range knownFieldTypes(shards) {
+		if !InStringArray(fn, streamBuiltinColumns) {
+			others = append(others, fn)
+		}
+	}
+	sort.Strings(others)
+	stream.Columns = append(append([]string{}, streamBuiltinColumns...), others...)
+	return
+}
+
+// Each calls fn for each message, stopping at the first error returned by fn.
+func (s *QueryStream) Each(fn func(row map[string]interface{}) error) (err error) {
+	var count uint32
+	for _, shard := range s.shards {
+		if s.params.Limit > 0 && count >= s.params.Limit {
+			break
+		}
+		where, args, err := s.params.Query.ToSQL(shard.getFieldTypes(), shard.getFullTextFields())
+		if err != nil {
+			return err
+		}
+		cond, rangeArgs := shard.rangeCondition(s.params)
+		limit := int64(-1)
+		if s.params.Limit > 0 {
+			limit = int64(s.params.Limit - count)
+		}
+		args = append(append(rangeArgs, args...), limit)
+		sqlString := fmt.Sprintf("SELECT %s FROM data WHERE %s AND %s ORDER BY %s LIMIT ?", shard.selectColumns(s.params), cond, where, shard.orderSQL(s.params))
+		err = shard.sqlQueryEach(s.ctx, sqlString, func(row map[string]interface{}) error {
+			count++
+			projectRows(DbShardQueryResult{row}, s.params)
+			return fn(row)
+		}, args...)
+		if err != nil {
+			return err
+		}
+	}
+	return
+}
+
+// RowToGelfMessage converts a query result row back to a GELF message. Empty
+// strings in fields which aren't builtin are taken as missing values.
+func RowToGelfMessage(row map[string]interface{}) (msg BasicGelfMessage) {
+	msg.Version = "1.1"
+	msg.AdditionalStrings = map[string]string{}
+	msg.AdditionalNumbers = map[string]float64{}
+	for k, v := range row {
+		switch k {
+		case "id":
+			continue
+		case "timestamp":
+			ts, _ := v.(float64)
+			msg.Timestamp = int64(math.Round(ts * 1000000))
+			continue
+		case "host":
+			msg.Host, _ = v.(string)
+			continue
+		case "facility":
+			msg.Facility, _ = v.(string)
+			continue
+		case "short_message":
+			msg.ShortMessage, _ = v.(string)
+			continue
+		case "full_message":
+			msg.FullMessage, _ = v.(string)
+			continue
+		}
+		switch v := v.(type) {
+		case string:
+			if v != "" {
+				msg.AdditionalStrings[k] = v
+			}
+		case float64:
+			msg.AdditionalNumbers[k] = v
+		case int64:
+			msg.AdditionalNumbers[k] = float64(v)
+		}
+	}
+	return
+}
@@ -0,0 +1,161 @@
+package logcore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+)
+
+// The janitor periodically deletes the oldest shards, according to the
+// retention_* settings in the config. The shard containing the current time,
+// and the newest shard, are never deleted.
+
+const retentionCheckInterval = 10 * time.Minute
+
+type RemovedShard struct {
+	Name   string `json:"name"`
+	Reason string `json:"reason"` // "max_age", "max_shards" or "max_size"
+	Bytes  int64  `json:"bytes"`
+}
+
+type RetentionReport struct {
+	Time       time.Time      `json:"time"`
+	Removed    []RemovedShard `json:"removed"`
+	Errors     []string       `json:"errors"`
+	ShardCount int            `json:"shard_count"` // remaining after the cleanup
+	TotalBytes int64          `json:"total_bytes"` // remaining after the cleanup
+}
+
+type retentionState struct {
+	WithMutex
+	lastReport *RetentionReport
+}
+
+type shardRetentionInfo struct {
+	name  string
+	end   time.Time
+	bytes int64
+}
+
+// Janitor periodically applies the retention policy, until the instance is closed.
+func (ci *CeruleanInstance) Janitor() {
+	maxAgeDays, maxSizeMB, maxShards := ci.retentionConfig()
+	if maxAgeDays == 0 && maxSizeMB == 0 && maxShards == 0 {
+		log.Println("No retention policy configured, not starting the janitor")
+		return
+	}
+	log.Printf("Starting CeruleanLog janitor for %s, max age %d days, max size %d MB, max shards %d.",
+		ci.dataDir, maxAgeDays, maxSizeMB, maxShards)
+	for {
+		if _, err := ci.ApplyRetention(); err != nil {
+			log.Println("Error applying retention policy:", err)
+		}
+		select {
+		case <-ci.quit:
+			log.Println("Exiting CeruleanLog janitor for", ci.dataDir)
+			return
+		case <-time.After(retentionCheckInterval):
+		}
+	}
+}
+
+// retentionConfig returns the retention limits from the config.
+func (ci *CeruleanInstance) retentionConfig() (maxAgeDays uint32, maxSizeMB uint64, maxShards uint32) {
+	ci.configLock.WithRLock(func() {
+		maxAgeDays = ci.config.RetentionMaxAgeDays
+		maxSizeMB = ci.config.RetentionMaxSizeMB
+		maxShards = ci.config.RetentionMaxShards
+	})
+	return
+}
+
+// LastRetentionReport returns the result of the last retention run, if any.
+func (ci *CeruleanInstance) LastRetentionReport() (report *RetentionReport) {
+	ci.retention.WithLock(func() {
+		report = ci.retention.lastReport
+	})
+	return
+}
+
+// ApplyRetention deletes the oldest shards which are over the configured
+// retention limits, and returns a report on what was done.
+func (ci *CeruleanInstance) ApplyRetention() (report RetentionReport, err error) {
+	report = RetentionReport{
+		Time:    time.Now().UTC(),
+		Removed: []RemovedShard{},
+		Errors:  []string{},
+	}
+
+	var shardNames []string
+	ci.shardCollection.WithRLock(func() {
+		shardNames = append(shardNames, ci.shardCollection.shardNames...)
+	})
+	shards := []shardRetentionInfo{}
+	for _, name := range shardNames {
+		_, end, err := ci.config.ShardNameToTimeSpan(name)
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("Cannot parse shard name %s: %v", name, err))
+			continue
+		}
+		bytes, err := dirSize(fmt.Sprintf("%s/%s", ci.getShardsDir(), name))
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("Cannot get size of shard %s: %v", name, err))
+			continue
+		}
+		shards = append(shards, shardRetentionInfo{name: name, end: end, bytes: bytes})
+		report.TotalBytes += bytes
+	}
+	report.ShardCount = len(shards)
+
+	maxAgeDays, maxSizeMB, maxShards := ci.retentionConfig()
+	currentShard, _ := ci.config.GetShardNameID(uint32(getNowUTC()))
+	maxAgeCutoff := time.Now().UTC().AddDate(0, 0, -int(maxAgeDays))
+	// shardNames are sorted, so the oldest shards come first
+	for i, s := range shards {
+		if i == len(shards)-1 || s.name == currentShard {
+			break
+		}
+		reason := ""
+		if maxAgeDays != 0 && s.end.Before(maxAgeCutoff) {
+			reason = "max_age"
+		} else if maxShards != 0 && report.ShardCount > int(maxShards) {
+			reason = "max_shards"
+		} else if maxSizeMB != 0 && report.TotalBytes > int64(maxSizeMB)*1024*1024 {
+			reason = "max_size"
+		} else {
+			break
+		}
+		err = ci.shardCollection.removeShard(s.name)
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("Cannot remove shard %s: %v", s.name, err))
+			break
+		}
+		log.Printf("Retention: removed shard %s (%s, %d bytes)", s.name, reason, s.bytes)
+		report.Removed = append(report.Removed, RemovedShard{Name: s.name, Reason: reason, Bytes: s.bytes})
+		report.ShardCount--
+		report.TotalBytes -= s.bytes
+	}
+	ci.retention.WithLock(func() {
+		ci.retention.lastReport = &report
+	})
+	return
+}
+
+// dirSize returns the total size of the files in a directory (not recursive).
+func dirSize(dir string) (size int64, err error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	for _, f := range files {
+		if !f.IsDir() {
+			size += f.Size()
+		}
+	}
+	return
+}
@@ -0,0 +1,342 @@
+package logcore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Saved searches are named queries, with the fields to return and a default
+// time range, stored in saved_searches.json in the data directory. Their
+// queries can have $name or ${name} parameters, which are replaced by values
+// given when they're run, or by default values, as literals: quoted strings,
+// or numbers, or inside quoted strings, escaped text. $$ is a literal $.
+
+const savedSearchesFile = "saved_searches.json"
+
+var (
+	ErrSavedSearchNotFound = errors.New("Saved search not found")
+	ErrSavedSearchExists   = errors.New("Saved search already exists")
+)
+
+var (
+	reSavedSearchName = regexp.MustCompile("^[a-zA-Z0-9][a-zA-Z0-9_.-]{0,99}$")
+	reSearchParamName = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
+	reSearchNumber    = regexp.MustCompile(`^[-+]?([0-9]+\.?[0-9]*|\.[0-9]+)([eE][-+]?[0-9]+)?$`)
+)
+
+type SavedSearch struct {
+	Name     string            `json:"name"`
+	Query    string            `json:"query"`
+	Syntax   string            `json:"syntax,omitempty"`    // filter (the default) or lucene
+	Fields   []string          `json:"fields,omitempty"`    // fields to return besides id and timestamp, all if empty
+	TimeFrom string            `json:"time_from,omitempty"` // default time range, in the formats accepted by the API, e.g. now-1h
+	TimeTo   string            `json:"time_to,omitempty"`
+	Params   map[string]string `json:"params,omitempty"` // default values of parameters
+	Owner    string            `json:"owner,omitempty"`
+	Created  time.Time         `json:"created"`
+	Updated  time.Time         `json:"updated"`
+}
+
+type savedSearchList struct {
+	WithRWMutex
+	searches map[string]SavedSearch
+}
+
+func (ci *CeruleanInstance) getSavedSearchesFileName() string {
+	return fmt.Sprintf("%s/%s", ci.dataDir, savedSearchesFile)
+}
+
+// loadSavedSearches reads the saved searches file, if it exists.
+func (ci *CeruleanInstance) loadSavedSearches() (err error) {
+	ss := &ci.savedSearches
+	ss.searches = map[string]SavedSearch{}
+	data, err := ioutil.ReadFile(ci.getSavedSearchesFileName())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return
+	}
+	var list []SavedSearch
+	if err = json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("Cannot parse %s: %w", savedSearchesFile, err)
+	}
+	for _, s := range list {
+		ss.searches[s.Name] = s
+	}
+	return
+}
+
+// writeSavedSearches writes the saved searches file, which must be done with
+// the list locked. The file is replaced atomically.
+func (ci *CeruleanInstance) writeSavedSearches() (err error) {
+	data, err := json.MarshalIndent(ci.savedSearches.sorted(), "", "  ")
+	if err != nil {
+		return
+	}
+	fileName := ci.getSavedSearchesFileName()
+	if err = ioutil.WriteFile(fileName+".tmp", data, 0644); err != nil {
+		return
+	}
+	return os.Rename(fileName+".tmp", fileName)
+}
+
+func (ss *savedSearchList) sorted() (list []SavedSearch) {
+	list = make([]SavedSearch, 0, len(ss.searches))
+	for _, s := range ss.searches {
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return
+}
+
+// SavedSearches returns the saved searches, sorted by name, only those of
+// the owner if it's not empty.
+func (ci *CeruleanInstance) SavedSearches(owner string) (list []SavedSearch) {
+	ci.savedSearches.WithRLock(func() {
+		list = ci.savedSearches.sorted()
+	})
+	if owner == "" {
+		return
+	}
+	filtered := []SavedSearch{}
+	for _, s := range list {
+		if s.Owner == owner {
+			filtered = append(filtered, s)
+		}
+	}
+	return filtered
+}
+
+// SavedSearch returns the saved search with the name.
+func (ci *CeruleanInstance) SavedSearch(name string) (s SavedSearch, err error) {
+	found := false
+	ci.savedSearches.WithRLock(func() {
+		s, found = ci.savedSearches.searches[name]
+	})
+	if !found {
+		return s, ErrSavedSearchNotFound
+	}
+	return
+}
+
+// CreateSavedSearch validates and saves a new search.
+func (ci *CeruleanInstance) CreateSavedSearch(s SavedSearch) (saved SavedSearch, err error) {
+	if err = s.Validate(); err != nil {
+		return
+	}
+	s.Created = time.Now().UTC()
+	s.Updated = s.Created
+	ci.savedSearches.WithWLock(func() {
+		if _, found := ci.savedSearches.searches[s.Name]; found {
+			err = ErrSavedSearchExists
+			return
+		}
+		ci.savedSearches.searches[s.Name] = s
+		if err = ci.writeSavedSearches(); err != nil {
+			delete(ci.savedSearches.searches, s.Name)
+		}
+	})
+	return s, err
+}
+
+// UpdateSavedSearch validates and replaces an existing saved search.
+func (ci *CeruleanInstance) UpdateSavedSearch(s SavedSearch) (saved SavedSearch, err error) {
+	if err = s.Validate(); err != nil {
+		return
+	}
+	s.Updated = time.Now().UTC()
+	ci.savedSearches.WithWLock(func() {
+		old, found := ci.savedSearches.searches[s.Name]
+		if !found {
+			err = ErrSavedSearchNotFound
+			return
+		}
+		s.Created = old.Created
+		ci.savedSearches.searches[s.Name] = s
+		if err = ci.writeSavedSearches(); err != nil {
+			ci.savedSearches.searches[s.Name] = old
+		}
+	})
+	return s, err
+}
+
+// DeleteSavedSearch deletes the saved search with the name.
+func (ci *CeruleanInstance) DeleteSavedSearch(name string) (err error) {
+	ci.savedSearches.WithWLock(func() {
+		old, found := ci.savedSearches.searches[name]
+		if !found {
+			err = ErrSavedSearchNotFound
+			return
+		}
+		delete(ci.savedSearches.searches, name)
+		if err = ci.writeSavedSearches(); err != nil {
+			ci.savedSearches.searches[name] = old
+		}
+	})
+	return
+}
+
+// Validate checks the saved search's name, fields and parameters, and that
+// its query can be parsed.
+func (s *SavedSearch) Validate() (err error) {
+	if !reSavedSearchName.MatchString(s.Name) {
+		return fmt.Errorf("Invalid saved search name '%s'", s.Name)
+	}
+	for i, f := range s.Fields {
+		s.Fields[i] = strings.TrimPrefix(strings.TrimSpace(f), "_")
+		if !reIdentifier.MatchString(s.Fields[i]) {
+			return fmt.Errorf("Invalid field name '%s'", f)
+		}
+	}
+	for name := range s.Params {
+		if !reSearchParamName.MatchString(name) {
+			return fmt.Errorf("Invalid parameter name '%s'", name)
+		}
+	}
+	// Parse the query with placeholder values for all the parameters
+	params, err := s.Parameters()
+	if err != nil {
+		return
+	}
+	values := map[string]string{}
+	for _, p := range params {
+		values[p] = "x"
+	}
+	for name := range s.Params {
+		if !InStringArray(name, params) {
+			return fmt.Errorf("Parameter %s isn't used in the query", name)
+		}
+	}
+	q, err := s.substituteParams(values)
+	if err != nil {
+		return
+	}
+	_, err = ParseQuery(s.Syntax, q)
+	return
+}
+
+// Parameters returns the names of the parameters used in the query.
+func (s *SavedSearch) Parameters() (params []string, err error) {
+	err = s.scanParams(func(name string, quote rune) (string, error) {
+		if !InStringArray(name, params) {
+			params = append(params, name)
+		}
+		return "", nil
+	}, &strings.Builder{})
+	return
+}
+
+// QueryWithParams returns the query with the parameters replaced by the
+// values, or the default values of those which aren't given.
+func (s *SavedSearch) QueryWithParams(values map[string]string) (q string, err error) {
+	params, err := s.Parameters()
+	if err != nil {
+		return
+	}
+	for name := range values {
+		if !InStringArray(name, params) {
+			return "", fmt.Errorf("Unknown parameter: %s", name)
+		}
+	}
+	return s.substituteParams(values)
+}
+
+// substituteParams returns the query with the parameters replaced by the
+// values, or the default values, quoted as literals.
+func (s *SavedSearch) substituteParams(values map[string]string) (q string, err error) {
+	var b strings.Builder
+	err = s.scanParams(func(name string, quote rune) (string, error) {
+		v, found := values[name]
+		if !found {
+			if v, found = s.Params[name]; !found {
+				return "", fmt.Errorf("Missing value for parameter %s", name)
+			}
+		}
+		if quote == 0 {
+			if reSearchNumber.MatchString(v) {
+				return v, nil
+			}
+			return `"` + escapeSearchParam(v, '"') + `"`, nil
+		}
+		return escapeSearchParam(v, quote), nil
+	}, &b)
+	return b.String(), err
+}
+
+// escapeSearchParam escapes the value for a string quoted with the quote
+// character, in both query syntaxes.
+func escapeSearchParam(v string, quote rune) string {
+	return strings.NewReplacer(`\`, `\\`, string(quote), `\`+string(quote)).Replace(v)
+}
+
+// scanParams copies the query to b, replacing the parameters with the result
+// of replace, which is given the quote character if the parameter is in a
+// quoted string (or 0).
+func (s *SavedSearch) scanParams(replace func(name string, quote rune) (string, error), b *strings.Builder) (err error) {
+	quotes := `'"`
+	if s.Syntax == QuerySyntaxLucene {
+		quotes = `"`
+	}
+	r := []rune(s.Query)
+	var quote rune
+	for i := 0; i < len(r); i++ {
+		c := r[i]
+		switch {
+		case quote != 0 && c == '\\' && i+1 < len(r):
+			b.WriteRune(c)
+			b.WriteRune(r[i+1])
+			i++
+			continue
+		case c == quote:
+			quote = 0
+		case quote == 0 && strings.ContainsRune(quotes, c):
+			quote = c
+		case c == '$' && i+1 < len(r) && r[i+1] == '$':
+			b.WriteRune('$')
+			i++
+			continue
+		case c == '$' && i+1 < len(r) && (r[i+1] == '{' || r[i+1] == '_' || isASCIILetter(r[i+1])):
+			var name string
+			if r[i+1] == '{' {
+				end := i + 2
+				for end < len(r) && r[end] != '}' {
+					end++
+				}
+				if end == len(r) {
+					return fmt.Errorf("Unterminated parameter at position %d", i+1)
+				}
+				name = string(r[i+2 : end])
+				i = end
+			} else {
+				end := i + 1
+				for end < len(r) && (r[end] == '_' || isASCIILetter(r[end]) || r[end] >= '0' && r[end] <= '9') {
+					end++
+				}
+				name = string(r[i+1 : end])
+				i = end - 1
+			}
+			if !reSearchParamName.MatchString(name) {
+				return fmt.Errorf("Invalid parameter name '%s'", name)
+			}
+			v, err := replace(name, quote)
+			if err != nil {
+				return err
+			}
+			b.WriteString(v)
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return
+}
+
+func isASCIILetter(c rune) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
@@ -0,0 +1,233 @@
+package logcore
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSavedSearchQueryWithParams(t *testing.T) {
+	tests := []struct {
+		name     string
+		syntax   string
+		query    string
+		defaults map[string]string
+		values   map[string]string
+		expected string // the query with the parameters replaced, or the start of the error
+		parsed   string // the parsed query's String(), if not ""
+		err      bool
+	}{
+		{
+			name:     "string",
+			query:    "host = $host",
+			values:   map[string]string{"host": "web1"},
+			expected: `host = "web1"`,
+		},
+		{
+			name:     "number",
+			query:    "level <= $level AND duration > ${min}",
+			values:   map[string]string{"level": "3", "min": "-.5e1"},
+			expected: `level <= 3 AND duration > -.5e1`,
+		},
+		{
+			name:     "not quite a number",
+			query:    "version = $v",
+			values:   map[string]string{"v": "1.2.3"},
+			expected: `version = "1.2.3"`,
+		},
+		{
+			name:     "default value",
+			query:    "host = $host AND level <= $level",
+			defaults: map[string]string{"host": "web1", "level": "3"},
+			values:   map[string]string{"level": "5"},
+			expected: `host = "web1" AND level <= 5`,
+		},
+		{
+			name:     "in a single-quoted string",
+			query:    "short_message LIKE '%$text%'",
+			values:   map[string]string{"text": `it's 100% \o/`},
+			expected: `short_message LIKE '%it\'s 100% \\o/%'`,
+			parsed:   `short_message LIKE "%it's 100% \\o/%"`,
+		},
+		{
+			name:     "in a double-quoted string",
+			query:    `short_message = "user ${user}: ok"`,
+			values:   map[string]string{"user": `"x"`},
+			expected: `short_message = "user \"x\": ok"`,
+			parsed:   `short_message = "user \"x\": ok"`,
+		},
+		{
+			name:     "injection",
+			query:    "host = $host AND level < 3",
+			values:   map[string]string{"host": `x" OR host != "y`},
+			expected: `host = "x\" OR host != \"y" AND level < 3`,
+			parsed:   `(host = "x\" OR host != \"y" AND level < 3)`,
+		},
+		{
+			name:     "injection with a backslash",
+			query:    "host = '$host'",
+			values:   map[string]string{"host": `x\' OR host != '`},
+			expected: `host = 'x\\\' OR host != \''`,
+			parsed:   `host = "x\\' OR host != '"`,
+		},
+		{
+			name:     "escaped quotes and dollars",
+			query:    `a = 'don\'t $$x $x' AND b = "$$" AND c = $$x`,
+			values:   map[string]string{"x": "1"},
+			expected: `a = 'don\'t $x 1' AND b = "$" AND c = $x`,
+		},
+		{
+			name:     "SQL-style doubled quote",
+			query:    "a = 'it''s $x'",
+			values:   map[string]string{"x": "'"},
+			expected: `a = 'it''s \''`,
+			parsed:   `a = "it's '"`,
+		},
+		{
+			name:     "dollar which isn't a parameter",
+			query:    "a = '$1' AND b = '$'",
+			expected: "a = '$1' AND b = '$'",
+		},
+		{
+			name:     "repeated parameter",
+			query:    "a = $x OR b = $x",
+			values:   map[string]string{"x": "y"},
+			expected: `a = "y" OR b = "y"`,
+		},
+		{
+			name:     "Lucene",
+			syntax:   QuerySyntaxLucene,
+			query:    `host:$host AND short_message:"$text" AND level:<=$level`,
+			values:   map[string]string{"host": "web 1 OR x:y", "text": `say "hi"`, "level": "3"},
+			expected: `host:"web 1 OR x:y" AND short_message:"say \"hi\"" AND level:<=3`,
+			parsed:   `(host = "web 1 OR x:y" AND short_message MATCH "\"say \"\"hi\"\"\"" AND level <= 3)`,
+		},
+		{
+			name:     "single quotes in Lucene",
+			syntax:   QuerySyntaxLucene,
+			query:    `host:'$host'`,
+			values:   map[string]string{"host": "web1"},
+			expected: `host:'"web1"'`,
+		},
+		{
+			name:     "missing value",
+			query:    "host = $host",
+			expected: "Missing value for parameter host",
+			err:      true,
+		},
+		{
+			name:     "unknown parameter",
+			query:    "host = $host",
+			values:   map[string]string{"host": "web1", "level": "3"},
+			expected: "Unknown parameter: level",
+			err:      true,
+		},
+		{
+			name:     "unterminated parameter",
+			query:    "host = ${host",
+			values:   map[string]string{"host": "web1"},
+			expected: "Unterminated parameter at position 8",
+			err:      true,
+		},
+		{
+			name:     "invalid parameter name",
+			query:    "host = ${1host}",
+			expected: "Invalid parameter name '1host'",
+			err:      true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := SavedSearch{Name: "test", Query: tt.query, Syntax: tt.syntax, Params: tt.defaults}
+			q, err := s.QueryWithParams(tt.values)
+			if tt.err {
+				if err == nil || !strings.HasPrefix(err.Error(), tt.expected) {
+					t.Errorf("expected error %q, got %v", tt.expected, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if q != tt.expected {
+				t.Errorf("expected %s, got %s", tt.expected, q)
+			}
+			if tt.parsed != "" {
+				node, err := ParseQuery(tt.syntax, q)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if node.String() != tt.parsed {
+					t.Errorf("expected %s parsed as %s, got %s", q, tt.parsed, node.String())
+				}
+			}
+		})
+	}
+}
+
+func TestSavedSearchValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		search SavedSearch
+		params []string
+		err    string // start of the error, "" if it's valid
+	}{
+		{
+			name:   "valid",
+			search: SavedSearch{Name: "errors-1.web", Query: "host = $host AND level <= ${level}", Fields: []string{" _host", "level"}, Params: map[string]string{"level": "3"}},
+			params: []string{"host", "level"},
+		},
+		{
+			name:   "Lucene",
+			search: SavedSearch{Name: "lucene", Query: "host:$host", Syntax: QuerySyntaxLucene},
+			params: []string{"host"},
+		},
+		{
+			name:   "invalid name",
+			search: SavedSearch{Name: "-errors", Query: "level <= 3"},
+			err:    "Invalid saved search name",
+		},
+		{
+			name:   "invalid field",
+			search: SavedSearch{Name: "errors", Query: "level <= 3", Fields: []string{"a b"}},
+			err:    "Invalid field name 'a b'",
+		},
+		{
+			name:   "invalid parameter name",
+			search: SavedSearch{Name: "errors", Query: "level <= 3", Params: map[string]string{"a-b": "1"}},
+			err:    "Invalid parameter name 'a-b'",
+		},
+		{
+			name:   "unused parameter",
+			search: SavedSearch{Name: "errors", Query: "level <= 3", Params: map[string]string{"host": "web1"}},
+			err:    "Parameter host isn't used in the query",
+		},
+		{
+			name:   "invalid query",
+			search: SavedSearch{Name: "errors", Query: "level <= $level AND"},
+			err:    "Expecting field name",
+		},
+		{
+			name:   "parameter in place of a field",
+			search: SavedSearch{Name: "errors", Query: "$field = 1"},
+			err:    "Expecting field name",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.search.Validate()
+			if tt.err == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			} else if tt.err != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+					t.Fatalf("expected error %q, got %v", tt.err, err)
+				}
+				return
+			}
+			params, err := tt.search.Parameters()
+			if err != nil || !reflect.DeepEqual(params, tt.params) {
+				t.Errorf("expected parameters %v, got %v, %v", tt.params, params, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,228 @@
+package logcore
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"sort"
+)
+
+// Mergeable sketches for approximate aggregations: DDSketch for quantiles,
+// and HyperLogLog for distinct counts. Sketches are computed per shard, and
+// merged in the collection.
+
+const (
+	DefaultQuantileAccuracy  = 0.01 // relative error of quantiles
+	DefaultDistinctPrecision = 14   // 2^14 registers, about 0.8% standard error
+	MinDistinctPrecision     = 4
+	MaxDistinctPrecision     = 16
+
+	// Values smaller than this (in absolute value) are counted as zero
+	ddSketchMinValue = 1e-9
+)
+
+// DDSketch estimates quantiles with a relative accuracy guarantee: for a
+// quantile whose exact value is v, the estimate is within v*accuracy of it.
+// See "DDSketch: A Fast and Fully-Mergeable Quantile Sketch with Relative-Error
+// Guarantees", Masson et al., 2019.
+type DDSketch struct {
+	accuracy float64
+	logGamma float64
+	positive map[int]uint64 // bucket index -> count
+	negative map[int]uint64 // bucket index of the absolute value -> count
+	zero     uint64
+	count    uint64
+	min      float64
+	max      float64
+}
+
+func NewDDSketch(accuracy float64) (s *DDSketch, err error) {
+	if !(accuracy > 0 && accuracy < 1) {
+		return nil, fmt.Errorf("Invalid quantile accuracy: %v", accuracy)
+	}
+	return &DDSketch{
+		accuracy: accuracy,
+		logGamma: math.Log((1 + accuracy) / (1 - accuracy)),
+		positive: map[int]uint64{},
+		negative: map[int]uint64{},
+		min:      math.Inf(1),
+		max:      math.Inf(-1),
+	}, nil
+}
+
+func (s *DDSketch) index(v float64) int {
+	return int(math.Ceil(math.Log(v) / s.logGamma))
+}
+
+// value returns the representative value of the bucket with the given index.
+func (s *DDSketch) value(index int) float64 {
+	gamma := math.Exp(s.logGamma)
+	return 2 * math.Pow(gamma, float64(index)) / (gamma + 1)
+}
+
+func (s *DDSketch) Add(v float64) {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return
+	}
+	switch {
+	case v > ddSketchMinValue:
+		s.positive[s.index(v)]++
+	case v < -ddSketchMinValue:
+		s.negative[s.index(-v)]++
+	default:
+		s.zero++
+	}
+	s.count++
+	s.min = math.Min(s.min, v)
+	s.max = math.Max(s.max, v)
+}
+
+// Merge adds the values from another sketch, which must have the same accuracy.
+func (s *DDSketch) Merge(o *DDSketch) error {
+	if s.accuracy != o.accuracy {
+		return fmt.Errorf("Cannot merge sketches with different accuracy")
+	}
+	for i, c := range o.positive {
+		s.positive[i] += c
+	}
+	for i, c := range o.negative {
+		s.negative[i] += c
+	}
+	s.zero += o.zero
+	s.count += o.count
+	s.min = math.Min(s.min, o.min)
+	s.max = math.Max(s.max, o.max)
+	return nil
+}
+
+func (s *DDSketch) Count() uint64 {
+	return s.count
+}
+
+// Quantile returns the estimated q-quantile (0 <= q <= 1), or false if the sketch is empty.
+func (s *DDSketch) Quantile(q float64) (v float64, ok bool) {
+	if s.count == 0 || q < 0 || q > 1 {
+		return 0, false
+	}
+	rank := uint64(q * float64(s.count-1))
+	var seen uint64
+
+	// Negative values, from the largest absolute value
+	negIndexes := make([]int, 0, len(s.negative))
+	for i := range s.negative {
+		negIndexes = append(negIndexes, i)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(negIndexes)))
+	for _, i := range negIndexes {
+		seen += s.negative[i]
+		if seen > rank {
+			return s.clamp(-s.value(i)), true
+		}
+	}
+	seen += s.zero
+	if seen > rank {
+		return s.clamp(0), true
+	}
+	posIndexes := make([]int, 0, len(s.positive))
+	for i := range s.positive {
+		posIndexes = append(posIndexes, i)
+	}
+	sort.Ints(posIndexes)
+	for _, i := range posIndexes {
+		seen += s.positive[i]
+		if seen > rank {
+			return s.clamp(s.value(i)), true
+		}
+	}
+	return s.max, true
+}
+
+func (s *DDSketch) clamp(v float64) float64 {
+	return math.Max(s.min, math.Min(s.max, v))
+}
+
+// HyperLogLog estimates the number of distinct values, with a standard
+// error of about 1.04/sqrt(2^precision).
+type HyperLogLog struct {
+	precision uint8
+	registers []uint8
+}
+
+func NewHyperLogLog(precision uint8) (h *HyperLogLog, err error) {
+	if precision < MinDistinctPrecision || precision > MaxDistinctPrecision {
+		return nil, fmt.Errorf("Invalid distinct count precision: %d (must be %d-%d)", precision, MinDistinctPrecision, MaxDistinctPrecision)
+	}
+	return &HyperLogLog{precision: precision, registers: make([]uint8, 1<<precision)}, nil
+}
+
+// hllHash hashes the value with FNV-1a, followed by the SplitMix64 finalizer
+// to spread the bits more evenly.
+func hllHash(b []byte) uint64 {
+	f := fnv.New64a()
+	f.Write(b)
+	x := f.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+func (h *HyperLogLog) Add(b []byte) {
+	x := hllHash(b)
+	i := x >> (64 - h.precision)
+	w := x<<h.precision | 1<<(h.precision-1)
+	rho := uint8(bits.LeadingZeros64(w)) + 1
+	if rho > h.registers[i] {
+		h.registers[i] = rho
+	}
+}
+
+func (h *HyperLogLog) AddString(s string) {
+	h.Add([]byte(s))
+}
+
+// Merge adds the values from another HyperLogLog, which must have the same precision.
+func (h *HyperLogLog) Merge(o *HyperLogLog) error {
+	if h.precision != o.precision {
+		return fmt.Errorf("Cannot merge HyperLogLogs with different precision")
+	}
+	for i, r := range o.registers {
+		if r > h.registers[i] {
+			h.registers[i] = r
+		}
+	}
+	return nil
+}
+
+// Count returns the estimated number of distinct values.
+func (h *HyperLogLog) Count() uint64 {
+	m := float64(len(h.registers))
+	var alpha float64
+	switch len(h.registers) {
+	case 16:
+		alpha = 0.673
+	case 32:
+		alpha = 0.697
+	case 64:
+		alpha = 0.709
+	default:
+		alpha = 0.7213 / (1 + 1.079/m)
+	}
+	sum := 0.0
+	zeros := 0
+	for _, r := range h.registers {
+		sum += math.Pow(2, -float64(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	estimate := alpha * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		// Linear counting is more accurate for small cardinalities
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return uint64(math.Round(estimate))
+}
@@ -0,0 +1,344 @@
+package logcore
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"regexp/syntax"
+	"strconv"
+	"strings"
+
+	sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+// SQLite has no regular expressions or JSON functions (unless built with
+// sqlite_json), so they're implemented in Go and registered on each shard
+// connection, through a driver with a connect hook. The same functions are
+// used when evaluating queries on messages which aren't in the database.
+//
+// The go-sqlite3 driver can't return a NULL or a dynamically typed value
+// from a function, except as an empty BLOB, so the functions returning
+// values return BLOBs (NULL for empty values), which the queries CAST to
+// TEXT or REAL.
+
+const shardSQLDriver = "sqlite3_ceruleanlog"
+
+const (
+	// MaxRegexpLength is the maximum length of regular expressions in queries, in bytes
+	MaxRegexpLength = 1000
+	// Maximum size of a parsed regular expression, with repetitions expanded.
+	// Go regular expressions run in linear time, but the time and memory
+	// used are proportional to this.
+	maxRegexpSize = 10000
+	// Maximum number of compiled regular expressions kept in regexpCache
+	regexpCacheSize = 1000
+)
+
+func init() {
+	sql.Register(shardSQLDriver, &sqlite3.SQLiteDriver{
+		ConnectHook: registerSQLFunctions,
+	})
+}
+
+func registerSQLFunctions(conn *sqlite3.SQLiteConn) (err error) {
+	funcs := []struct {
+		name string
+		impl interface{}
+	}{
+		// regexp(pattern, value) is also called by SQLite for: value REGEXP pattern
+		{"regexp", sqlRegexp},
+		{"regexp_extract", regexpExtract},
+		{"json_field", jsonField},
+		{"icontains", icontains},
+		{"to_number", toNumber},
+	}
+	for _, f := range funcs {
+		if err = conn.RegisterFunc(f.name, f.impl, true); err != nil {
+			return fmt.Errorf("Cannot register SQL function %s: %w", f.name, err)
+		}
+	}
+	return
+}
+
+type cachedRegexp struct {
+	re  *regexp.Regexp
+	err error
+}
+
+// Compiled regular expressions (and errors), by pattern
+var regexpCache = struct {
+	WithRWMutex
+	patterns map[string]cachedRegexp
+}{patterns: map[string]cachedRegexp{}}
+
+// compileQueryRegexp compiles a regular expression from a query, rejecting
+// patterns which are too long or too large once repetitions are expanded,
+// like (a{1000}){1000}. The results are cached, as the SQL functions get the
+// pattern for each row.
+func compileQueryRegexp(pattern string) (re *regexp.Regexp, err error) {
+	var c cachedRegexp
+	found := false
+	regexpCache.WithRLock(func() {
+		c, found = regexpCache.patterns[pattern]
+	})
+	if found {
+		return c.re, c.err
+	}
+
+	c.re, c.err = checkAndCompileRegexp(pattern)
+	regexpCache.WithWLock(func() {
+		if len(regexpCache.patterns) >= regexpCacheSize {
+			// Evict an arbitrary pattern
+			for p := range regexpCache.patterns {
+				delete(regexpCache.patterns, p)
+				break
+			}
+		}
+		regexpCache.patterns[pattern] = c
+	})
+	return c.re, c.err
+}
+
+func checkAndCompileRegexp(pattern string) (re *regexp.Regexp, err error) {
+	if len(pattern) > MaxRegexpLength {
+		return nil, fmt.Errorf("Regular expression is longer than %d bytes", MaxRegexpLength)
+	}
+	parsed, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid regular expression: %w", err)
+	}
+	if regexpSize(parsed) > maxRegexpSize {
+		return nil, fmt.Errorf("Regular expression is too complex: %s", pattern)
+	}
+	return regexp.Compile(pattern)
+}
+
+// regexpSize returns the number of nodes (and characters of literals) in the
+// parsed regular expression, with the repetitions expanded as when it's
+// compiled, or a number larger than maxRegexpSize.
+func regexpSize(re *syntax.Regexp) (size int) {
+	size = 1
+	if re.Op == syntax.OpLiteral && len(re.Rune) > 1 {
+		size = len(re.Rune)
+	}
+	for _, sub := range re.Sub {
+		size += regexpSize(sub)
+	}
+	if re.Op == syntax.OpRepeat {
+		n := re.Max
+		if n < re.Min {
+			// x{n,} is expanded to n copies of x and x*
+			n = re.Min + 1
+		}
+		if n > 1 {
+			size *= n
+		}
+	}
+	if size > maxRegexpSize {
+		return maxRegexpSize + 1
+	}
+	return
+}
+
+// sqlValueText converts an SQL value to text as SQLite does, and returns
+// false for NULL.
+func sqlValueText(v interface{}) (s string, ok bool) {
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case []byte:
+		// go-sqlite3 passes NULL as a nil []byte
+		return string(v), v != nil
+	case int64:
+		return strconv.FormatInt(v, 10), true
+	case float64:
+		if math.Abs(v) < 1e15 && v == math.Trunc(v) {
+			// Stored as an integer in a NUMERIC column
+			return strconv.FormatInt(int64(v), 10), true
+		}
+		return strconv.FormatFloat(v, 'g', 15, 64), true
+	}
+	return "", false
+}
+
+// sqlRegexp checks if the value matches the regular expression anywhere.
+func sqlRegexp(pattern string, v interface{}) (match bool, err error) {
+	s, ok := sqlValueText(v)
+	if !ok {
+		return false, nil
+	}
+	re, err := compileQueryRegexp(pattern)
+	if err != nil {
+		return
+	}
+	return re.MatchString(s), nil
+}
+
+// regexpExtract returns the group (0 for the whole match) of the first match
+// of the regular expression in the value, or NULL if it doesn't match.
+func regexpExtract(v interface{}, pattern string, group int64) (result []byte, err error) {
+	s, ok := sqlValueText(v)
+	if !ok {
+		return nil, nil
+	}
+	re, err := compileQueryRegexp(pattern)
+	if err != nil {
+		return
+	}
+	if group < 0 || group > int64(re.NumSubexp()) {
+		return nil, fmt.Errorf("Regular expression %s has no group %d", pattern, group)
+	}
+	m := re.FindStringSubmatchIndex(s)
+	if m == nil || m[2*group] < 0 {
+		return nil, nil
+	}
+	return []byte(s[m[2*group]:m[2*group+1]]), nil
+}
+
+// jsonField returns the value at the path in a JSON object or array in the
+// value, or NULL if the value isn't JSON or doesn't have the path. The path
+// is a list of object keys and array indexes separated by dots, e.g.
+// "user.roles.0". Objects and arrays are returned as JSON.
+func jsonField(v interface{}, path string) (result []byte, err error) {
+	s, ok := sqlValueText(v)
+	if !ok {
+		return nil, nil
+	}
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, "{") && !strings.HasPrefix(s, "[") {
+		// Not JSON, skip the parsing
+		return nil, nil
+	}
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.UseNumber()
+	var value interface{}
+	if dec.Decode(&value) != nil {
+		return nil, nil
+	}
+	if path != "" {
+		for _, key := range strings.Split(path, ".") {
+			switch container := value.(type) {
+			case map[string]interface{}:
+				value, ok = container[key]
+			case []interface{}:
+				i, convErr := strconv.Atoi(key)
+				ok = convErr == nil && i >= 0 && i < len(container)
+				if ok {
+					value = container[i]
+				}
+			default:
+				ok = false
+			}
+			if !ok {
+				return nil, nil
+			}
+		}
+	}
+	switch value := value.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []byte(value), nil
+	case json.Number:
+		return []byte(value), nil
+	case bool:
+		return []byte(strconv.FormatBool(value)), nil
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err = enc.Encode(value); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// icontains checks if the value contains the string, ignoring case.
+func icontains(v interface{}, substr string) bool {
+	s, ok := sqlValueText(v)
+	return ok && strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
+
+// toNumber returns the value if it's a number, or NULL otherwise, so that
+// CAST(to_number(v) AS REAL) doesn't convert text to 0.
+func toNumber(v interface{}) []byte {
+	s, ok := sqlValueText(v)
+	if !ok {
+		return nil
+	}
+	s = strings.TrimSpace(s)
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) || strings.ContainsAny(s, "xX_") {
+		// SQLite doesn't parse NaN, Inf, hexadecimal floats or underscores
+		return nil
+	}
+	return []byte(s)
+}
+
+// NewQueryFunc returns a function of a field for queries, checking its
+// arguments:
+//
+//	regexp_extract(field, pattern[, group]) - the group (by default 1 if the
+//	    pattern has groups, otherwise 0 for the whole match) of the first match
+//	json_field(field, path) - the value at the path in JSON in the field
+func NewQueryFunc(name string, args []QueryValue) (f *QueryFunc, err error) {
+	name = strings.ToLower(name)
+	f = &QueryFunc{Name: name, Args: args}
+	switch name {
+	case "regexp_extract":
+		if len(args) < 1 || len(args) > 2 || args[0].IsNumber {
+			return nil, fmt.Errorf("Expecting a pattern string and an optional group number for %s", name)
+		}
+		re, err := compileQueryRegexp(args[0].Str)
+		if err != nil {
+			return nil, err
+		}
+		group := 0
+		if re.NumSubexp() > 0 {
+			group = 1
+		}
+		if len(args) == 2 {
+			group = int(args[1].Num)
+			if !args[1].IsNumber || float64(group) != args[1].Num || group < 0 || group > re.NumSubexp() {
+				return nil, fmt.Errorf("Regular expression %s has no group %s", args[0].String(), args[1].String())
+			}
+		}
+		f.Args = []QueryValue{args[0], {Str: strconv.Itoa(group), Num: float64(group), IsNumber: true}}
+	case "json_field":
+		if len(args) != 1 || args[0].IsNumber {
+			return nil, fmt.Errorf("Expecting a path string for %s", name)
+		}
+	default:
+		return nil, fmt.Errorf("Unknown function: %s", name)
+	}
+	return
+}
+
+// toSQL returns the SQL expression for the function of the column, and its arguments.
+func (f *QueryFunc) toSQL(column string) (expr string, args []interface{}, err error) {
+	switch f.Name {
+	case "regexp_extract":
+		return fmt.Sprintf("CAST(regexp_extract(%s, ?, ?) AS TEXT)", column), []interface{}{f.Args[0].Str, int64(f.Args[1].Num)}, nil
+	case "json_field":
+		return fmt.Sprintf("CAST(json_field(%s, ?) AS TEXT)", column), []interface{}{f.Args[0].Str}, nil
+	}
+	return "", nil, fmt.Errorf("Unknown function: %s", f.Name)
+}
+
+// eval returns the function of a field's value, as a string, or nil as in toSQL.
+func (f *QueryFunc) eval(v interface{}) interface{} {
+	var result []byte
+	switch f.Name {
+	case "regexp_extract":
+		result, _ = regexpExtract(v, f.Args[0].Str, int64(f.Args[1].Num))
+	case "json_field":
+		result, _ = jsonField(v, f.Args[0].Str)
+	}
+	if len(result) == 0 {
+		return nil
+	}
+	return string(result)
+}
@@ -0,0 +1,88 @@
+package logcore
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckAndCompileRegexp(t *testing.T) {
+	tests := []struct {
+		pattern string
+		err     string // start of the error, "" if it's valid
+	}{
+		{pattern: `req-[0-9a-f]{8}`},
+		{pattern: `took (\d+)ms$`},
+		{pattern: `a{1000}`},
+		{pattern: `(abc){1000}`},
+		{pattern: `((a{10}){10}){10}`},
+		{pattern: `[a-z]{1000}`},
+		{pattern: strings.Repeat("a", MaxRegexpLength)},
+		{pattern: strings.Repeat("a", MaxRegexpLength+1), err: "Regular expression is longer than"},
+		{pattern: `(abcdefghijk){1000}`, err: "Regular expression is too complex"},
+		{pattern: `((abcdefghijk){10}){100}`, err: "Regular expression is too complex"},
+		{pattern: `(abcdefghijklmnopqrst{2,}){500}`, err: "Regular expression is too complex"},
+		{pattern: `a{1001}`, err: "Invalid regular expression"},
+		{pattern: `(a{1000}){1000}`, err: "Invalid regular expression"},
+		{pattern: `(`, err: "Invalid regular expression"},
+		{pattern: `\p{Nope}`, err: "Invalid regular expression"},
+	}
+	for _, tt := range tests {
+		// Twice, to check the cached results
+		for i := 0; i < 2; i++ {
+			re, err := compileQueryRegexp(tt.pattern)
+			if tt.err == "" && (err != nil || re == nil) {
+				t.Errorf("%.40q: unexpected error: %v", tt.pattern, err)
+			} else if tt.err != "" && (err == nil || !strings.HasPrefix(err.Error(), tt.err)) {
+				t.Errorf("%.40q: expected error %q, got %v", tt.pattern, tt.err, err)
+			}
+		}
+	}
+}
+
+func TestNewQueryFunc(t *testing.T) {
+	num := func(s string) QueryValue {
+		v, err := NewQueryNumber(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	tests := []struct {
+		name     string
+		args     []QueryValue
+		expected string // the function's String() with field f, "" for an error
+	}{
+		{name: "regexp_extract", args: []QueryValue{NewQueryString(`took (\d+)ms`)}, expected: `regexp_extract(f, "took (\\d+)ms", 1)`},
+		{name: "REGEXP_EXTRACT", args: []QueryValue{NewQueryString(`\d+`)}, expected: `regexp_extract(f, "\\d+", 0)`},
+		{name: "regexp_extract", args: []QueryValue{NewQueryString(`(a)(b)`), num("2")}, expected: `regexp_extract(f, "(a)(b)", 2)`},
+		{name: "regexp_extract", args: []QueryValue{NewQueryString(`(a)(b)`), num("0")}, expected: `regexp_extract(f, "(a)(b)", 0)`},
+		{name: "regexp_extract", args: []QueryValue{NewQueryString(`(a)(b)`), num("3")}},
+		{name: "regexp_extract", args: []QueryValue{NewQueryString(`(a)(b)`), num("1.5")}},
+		{name: "regexp_extract", args: []QueryValue{NewQueryString(`(a)(b)`), num("-1")}},
+		{name: "regexp_extract", args: []QueryValue{NewQueryString(`(a)(b)`), NewQueryString("1")}},
+		{name: "regexp_extract", args: []QueryValue{num("1")}},
+		{name: "regexp_extract", args: []QueryValue{NewQueryString(`(abcdefghijk){1000}`)}},
+		{name: "regexp_extract"},
+		{name: "json_field", args: []QueryValue{NewQueryString("user.id")}, expected: `json_field(f, "user.id")`},
+		{name: "json_field", args: []QueryValue{num("1")}},
+		{name: "json_field", args: []QueryValue{NewQueryString("a"), NewQueryString("b")}},
+		{name: "lower", args: []QueryValue{NewQueryString("a")}},
+	}
+	for _, tt := range tests {
+		f, err := NewQueryFunc(tt.name, tt.args)
+		if tt.expected == "" {
+			if err == nil {
+				t.Errorf("%s%v: expected an error", tt.name, tt.args)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s%v: unexpected error: %v", tt.name, tt.args, err)
+			continue
+		}
+		n := QueryNode{Field: "f", Func: f}
+		if n.operandString() != tt.expected {
+			t.Errorf("%s%v: expected %s, got %s", tt.name, tt.args, tt.expected, n.operandString())
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package logcore
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+var syslogFacilityNames = []string{
+	"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news",
+	"uucp", "cron", "authpriv", "ftp", "ntp", "security", "console", "solaris-cron",
+	"local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7",
+}
+
+var reSyslogNonIdentifier = regexp.MustCompile("[^a-zA-Z0-9_]+")
+
+// ParseSyslogMessage parses a RFC 5424 or RFC 3164 syslog message into a
+// BasicGelfMessage. The syslog severity, app name, proc ID, message ID and
+// structured data elements are stored as additional fields.
+func ParseSyslogMessage(data []byte) (msg BasicGelfMessage, err error) {
+	msg.AdditionalStrings = map[string]string{}
+	msg.AdditionalNumbers = map[string]float64{}
+
+	data = bytes.TrimRight(data, "\r\n\x00")
+	if len(data) < 3 || data[0] != '<' {
+		err = fmt.Errorf("Syslog message doesn't start with PRI")
+		return
+	}
+	end := bytes.IndexByte(data, '>')
+	if end < 2 || end > 4 {
+		err = fmt.Errorf("Invalid syslog PRI")
+		return
+	}
+	priStr := string(data[1:end])
+	pri, err := strconv.Atoi(priStr)
+	if err != nil || !isAllDigits(priStr) || pri < 0 || pri > 191 {
+		err = fmt.Errorf("Invalid syslog PRI: %s", data[1:end])
+		return
+	}
+	msg.Facility = syslogFacilityNames[pri/8]
+	msg.AdditionalNumbers["severity"] = float64(pri % 8)
+	if !utf8.Valid(data) {
+		data = bytes.ToValidUTF8(data, []byte("\ufffd"))
+	}
+	rest := string(data[end+1:])
+
+	if strings.HasPrefix(rest, "1 ") {
+		err = parseSyslog5424(rest[2:], &msg)
+	} else {
+		parseSyslog3164(rest, &msg)
+	}
+	return
+}
+
+func isAllDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// nextSyslogField returns the next space-delimited field and the rest of the string
+func nextSyslogField(s string) (field, rest string) {
+	p := strings.IndexByte(s, ' ')
+	if p == -1 {
+		return s, ""
+	}
+	return s[:p], s[p+1:]
+}
+
+func parseSyslog5424(s string, msg *BasicGelfMessage) (err error) {
+	var ts, hostname, appName, procID, msgID string
+	ts, s = nextSyslogField(s)
+	hostname, s = nextSyslogField(s)
+	appName, s = nextSyslogField(s)
+	procID, s = nextSyslogField(s)
+	msgID, s = nextSyslogField(s)
+
+	if ts != "-" {
+		t, err := time.Parse(time.RFC3339Nano, ts)
+		if err != nil {
+			return fmt.Errorf("Invalid RFC 5424 timestamp: %s", ts)
+		}
+		msg.Timestamp = TimeToMicro(t)
+	}
+	if hostname != "-" {
+		msg.Host = hostname
+	}
+	if appName != "-" && appName != "" {
+		msg.AdditionalStrings["appname"] = appName
+	}
+	if procID != "-" && procID != "" {
+		msg.AdditionalStrings["procid"] = procID
+	}
+	if msgID != "-" && msgID != "" {
+		msg.AdditionalStrings["msgid"] = msgID
+	}
+
+	if strings.HasPrefix(s, "-") {
+		s = strings.TrimPrefix(s[1:], " ")
+	} else if strings.HasPrefix(s, "[") {
+		s, err = parseSyslogStructuredData(s, msg)
+		if err != nil {
+			return
+		}
+	} else if s != "" {
+		return fmt.Errorf("Invalid RFC 5424 structured data")
+	}
+	msg.ShortMessage = strings.TrimPrefix(s, "\ufeff")
+	return
+}
+
+// parseSyslogStructuredData parses SD elements like [id param="value" ...]
+// and stores them as sd_<id>_<param> additional fields.
+func parseSyslogStructuredData(s string, msg *BasicGelfMessage) (rest string, err error) {
+	for strings.HasPrefix(s, "[") {
+		s = s[1:]
+		var sdID string
+		p := strings.IndexAny(s, " ]")
+		if p == -1 {
+			return "", fmt.Errorf("Unterminated structured data element")
+		}
+		sdID, s = s[:p], s[p:]
+		for {
+			s = strings.TrimLeft(s, " ")
+			if s == "" {
+				return "", fmt.Errorf("Unterminated structured data element %s", sdID)
+			}
+			if s[0] == ']' {
+				s = s[1:]
+				break
+			}
+			eq := strings.Index(s, "=\"")
+			if eq == -1 {
+				return "", fmt.Errorf("Invalid structured data parameter in %s", sdID)
+			}
+			name := s[:eq]
+			s = s[eq+2:]
+			var value strings.Builder
+			closed := false
+			for i := 0; i < len(s); i++ {
+				if s[i] == '\\' && i+1 < len(s) && (s[i+1] == '"' || s[i+1] == '\\' || s[i+1] == ']') {
+					value.WriteByte(s[i+1])
+					i++
+				} else if s[i] == '"' {
+					s = s[i+1:]
+					closed = true
+					break
+				} else {
+					value.WriteByte(s[i])
+				}
+			}
+			if !closed {
+				return "", fmt.Errorf("Unterminated structured data value in %s", sdID)
+			}
+			field := reSyslogNonIdentifier.ReplaceAllString("sd_"+sdID+"_"+name, "_")
+			msg.AdditionalStrings[field] = value.String()
+		}
+	}
+	return strings.TrimPrefix(s, " "), nil
+}
+
+// parseSyslog3164 parses the legacy BSD syslog format, which is loosely
+// "Mmm dd hh:mm:ss HOSTNAME TAG[PID]: MSG". Anything which doesn't
+// fit is stored as the message.
+func parseSyslog3164(s string, msg *BasicGelfMessage) {
+	if len(s) >= 16 && s[15] == ' ' {
+		now := time.Now().UTC()
+		if t, err := time.ParseInLocation(time.Stamp, s[:15], time.UTC); err == nil {
+			t = t.AddDate(now.Year(), 0, 0)
+			if t.After(now.Add(24 * time.Hour)) {
+				// Messages from December received in January
+				t = t.AddDate(-1, 0, 0)
+			}
+			msg.Timestamp = TimeToMicro(t)
+			s = s[16:]
+			msg.Host, s = nextSyslogField(s)
+		}
+	}
+
+	// The tag is alphanumeric, at most 32 characters and terminated by ":" or "["
+	tagEnd := strings.IndexAny(s, ":[ ")
+	if tagEnd > 0 && tagEnd <= 32 && s[tagEnd] != ' ' {
+		msg.AdditionalStrings["appname"] = s[:tagEnd]
+		s = s[tagEnd:]
+		if s[0] == '[' {
+			if p := strings.IndexByte(s, ']'); p != -1 {
+				msg.AdditionalStrings["procid"] = s[1:p]
+				s = s[p+1:]
+			}
+		}
+		s = strings.TrimPrefix(s, ":")
+		s = strings.TrimPrefix(s, " ")
+	}
+	msg.ShortMessage = s
+}
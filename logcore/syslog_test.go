@@ -0,0 +1,158 @@
+package logcore
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseSyslogMessage(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		err      bool
+		facility string
+		severity float64
+		host     string
+		message  string
+		ts       string // RFC 3339, or MM-DD hh:mm:ss for RFC 3164, "" if not set
+		strings  map[string]string
+	}{
+		{
+			name:     "RFC 5424",
+			data:     `<165>1 2003-10-11T22:14:15.003Z mymachine.example.com evntslog - ID47 [exampleSDID@32473 iut="3" eventSource="Application"] An application event`,
+			facility: "local4",
+			severity: 5,
+			host:     "mymachine.example.com",
+			message:  "An application event",
+			ts:       "2003-10-11T22:14:15.003Z",
+			strings: map[string]string{
+				"appname":                          "evntslog",
+				"msgid":                            "ID47",
+				"sd_exampleSDID_32473_iut":         "3",
+				"sd_exampleSDID_32473_eventSource": "Application",
+			},
+		},
+		{
+			name:     "RFC 5424 without structured data",
+			data:     "<34>1 2003-10-11T22:14:15.003Z mymachine su 123 - - 'su root' failed\n",
+			facility: "auth",
+			severity: 2,
+			host:     "mymachine",
+			message:  "'su root' failed",
+			ts:       "2003-10-11T22:14:15.003Z",
+			strings:  map[string]string{"appname": "su", "procid": "123"},
+		},
+		{
+			name:     "RFC 5424 with nil values and BOM",
+			data:     "<0>1 - - - - - - \ufeffhello",
+			facility: "kern",
+			message:  "hello",
+			strings:  map[string]string{},
+		},
+		{
+			name:     "RFC 5424 with escapes in structured data",
+			data:     `<13>1 - host app - - [a b="x\"y\]z"][c d="1"]`,
+			facility: "user",
+			severity: 5,
+			host:     "host",
+			strings:  map[string]string{"appname": "app", "sd_a_b": `x"y]z`, "sd_c_d": "1"},
+		},
+		{
+			name: "RFC 5424 with an invalid timestamp",
+			data: "<13>1 yesterday host app - - - hello",
+			err:  true,
+		},
+		{
+			name: "RFC 5424 with unterminated structured data",
+			data: `<13>1 - host app - - [a b="x`,
+			err:  true,
+		},
+		{
+			name: "RFC 5424 with invalid structured data",
+			data: "<13>1 - host app - - hello",
+			err:  true,
+		},
+		{
+			name:     "RFC 3164",
+			data:     "<34>Oct 11 22:14:15 mymachine su[123]: 'su root' failed",
+			facility: "auth",
+			severity: 2,
+			host:     "mymachine",
+			message:  "'su root' failed",
+			ts:       "10-11 22:14:15",
+			strings:  map[string]string{"appname": "su", "procid": "123"},
+		},
+		{
+			name:     "RFC 3164 with a single digit day",
+			data:     "<13>Feb  5 01:02:03 host cron: job done",
+			facility: "user",
+			severity: 5,
+			host:     "host",
+			message:  "job done",
+			ts:       "02-05 01:02:03",
+			strings:  map[string]string{"appname": "cron"},
+		},
+		{
+			name:     "RFC 3164 without a header",
+			data:     "<13>just a message",
+			facility: "user",
+			severity: 5,
+			message:  "just a message",
+			strings:  map[string]string{},
+		},
+		{
+			name:     "highest PRI",
+			data:     "<191>hello",
+			facility: "local7",
+			severity: 7,
+			message:  "hello",
+			strings:  map[string]string{},
+		},
+		{name: "PRI out of range", data: "<192>hello", err: true},
+		{name: "PRI with a plus sign", data: "<+13>hello", err: true},
+		{name: "PRI with a minus sign", data: "<-1>hello", err: true},
+		{name: "PRI too long", data: "<0013>hello", err: true},
+		{name: "empty PRI", data: "<>hello", err: true},
+		{name: "unterminated PRI", data: "<13 hello", err: true},
+		{name: "no PRI", data: "hello", err: true},
+		{name: "empty", data: "", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := ParseSyslogMessage([]byte(tt.data))
+			if tt.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", msg)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg.Facility != tt.facility || msg.AdditionalNumbers["severity"] != tt.severity {
+				t.Errorf("expected facility %s and severity %v, got %s and %v", tt.facility, tt.severity, msg.Facility, msg.AdditionalNumbers["severity"])
+			}
+			if msg.Host != tt.host {
+				t.Errorf("expected host %q, got %q", tt.host, msg.Host)
+			}
+			if msg.ShortMessage != tt.message {
+				t.Errorf("expected message %q, got %q", tt.message, msg.ShortMessage)
+			}
+			if !reflect.DeepEqual(msg.AdditionalStrings, tt.strings) {
+				t.Errorf("expected fields %v, got %v", tt.strings, msg.AdditionalStrings)
+			}
+			var ts string
+			if msg.Timestamp != 0 {
+				ts = time.Unix(0, msg.Timestamp*1000).UTC().Format(time.RFC3339Nano)
+				if len(tt.ts) == len("01-02 15:04:05") {
+					// RFC 3164 timestamps don't have a year
+					ts = time.Unix(0, msg.Timestamp*1000).UTC().Format("01-02 15:04:05")
+				}
+			}
+			if ts != tt.ts {
+				t.Errorf("expected timestamp %q, got %q", tt.ts, ts)
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package logcore
+
+import (
+	"sync/atomic"
+)
+
+// Live tailing: subscribers get the messages matching their queries as
+// they're added to the instance. Ingestion never waits for subscribers: if a
+// subscriber's buffer is full, messages are dropped and counted instead.
+
+const TailBufferSize = 1000
+
+// TailSubscriber receives the messages matching a query on Messages, which is
+// closed when the subscriber is unsubscribed or the instance is closed.
+type TailSubscriber struct {
+	Messages <-chan BasicGelfMessage
+
+	messages chan BasicGelfMessage
+	query    *QueryNode
+	dropped  uint64 // accessed atomically
+}
+
+// TakeDropped returns the number of messages dropped since the previous call,
+// because the subscriber's buffer was full.
+func (s *TailSubscriber) TakeDropped() uint64 {
+	return atomic.SwapUint64(&s.dropped, 0)
+}
+
+type tailSubscribers struct {
+	WithRWMutex
+	subs   map[*TailSubscriber]struct{}
+	count  int32 // accessed atomically, to skip locking when there are no subscribers
+	closed bool
+}
+
+// Subscribe returns a subscriber to the new messages matching the query. A
+// nil query matches all messages.
+func (ci *CeruleanInstance) Subscribe(query *QueryNode) (s *TailSubscriber) {
+	t := &ci.tail
+	ch := make(chan BasicGelfMessage, TailBufferSize)
+	s = &TailSubscriber{Messages: ch, messages: ch, query: query}
+	t.WithWLock(func() {
+		if t.closed {
+			close(ch)
+			return
+		}
+		if t.subs == nil {
+			t.subs = map[*TailSubscriber]struct{}{}
+		}
+		t.subs[s] = struct{}{}
+		atomic.AddInt32(&t.count, 1)
+	})
+	return
+}
+
+// Unsubscribe stops sending messages to the subscriber, and closes its channel.
+func (ci *CeruleanInstance) Unsubscribe(s *TailSubscriber) {
+	t := &ci.tail
+	t.WithWLock(func() {
+		if _, found := t.subs[s]; found {
+			delete(t.subs, s)
+			atomic.AddInt32(&t.count, -1)
+			close(s.messages)
+		}
+	})
+}
+
+// publish sends the messages to the subscribers whose queries they match,
+// without blocking.
+func (t *tailSubscribers) publish(msgs []BasicGelfMessage) {
+	if atomic.LoadInt32(&t.count) == 0 {
+		return
+	}
+	t.WithRLock(func() {
+		for s := range t.subs {
+			for i := range msgs {
+				if !s.query.Matches(&msgs[i]) {
+					continue
+				}
+				select {
+				case s.messages <- msgs[i]:
+				default:
+					atomic.AddUint64(&s.dropped, 1)
+				}
+			}
+		}
+	})
+}
+
+// close unsubscribes all subscribers.
+func (t *tailSubscribers) close() {
+	t.WithWLock(func() {
+		for s := range t.subs {
+			close(s.messages)
+		}
+		t.subs = nil
+		t.closed = true
+		atomic.StoreInt32(&t.count, 0)
+	})
+}
+
+// MessageToRow converts a message to the same form as query result rows, with
+// only the fields which the message has.
+func MessageToRow(msg *BasicGelfMessage) (row map[string]interface{}) {
+	row = map[string]interface{}{
+		"timestamp":     float64(msg.Timestamp) / 1000000,
+		"host":          msg.Host,
+		"facility":      msg.Facility,
+		"short_message": msg.ShortMessage,
+		"full_message":  msg.FullMessage,
+	}
+	for k, v := range msg.AdditionalStrings {
+		row[k] = v
+	}
+	for k, v := range msg.AdditionalNumbers {
+		row[k] = v
+	}
+	return
+}
@@ -70,11 +70,21 @@ func unixTimeStampToUTCTime(ts uint32) time.Time {
 	return time.Unix(int64(ts), 0)
 }
 
+// TimeToMicro converts the given time to a Unix timestamp in microseconds
+func TimeToMicro(t time.Time) int64 {
+	return t.UnixNano() / 1000
+}
+
 // Gets the current Unix timestamp in UTC
 func getNowUTC() int64 {
 	return time.Now().UTC().Unix()
 }
 
+// Gets the current Unix timestamp in UTC, in microseconds
+func getNowUTCMicro() int64 {
+	return TimeToMicro(time.Now())
+}
+
 func jsonifyWhatever(i interface{}) string {
 	jsonb, err := json.Marshal(i)
 	if err != nil {
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"io"
 	"log"
@@ -19,6 +20,8 @@ const (
 	eventQuit = iota
 )
 
+const shutdownTimeout = 30 * time.Second
+
 type sysEventMessage struct {
 	event int
 	idata int
@@ -28,6 +31,11 @@ var sysEventChannel = make(chan sysEventMessage, 5)
 
 var logFileName = flag.String("log", "/tmp/ceruleanlog.log", "Log file ('-' for only stderr)")
 var dataDir = flag.String("data", "./cerulean_data", "Data directory")
+var gelfUDPBind = flag.String("gelf-udp", ":12201", "GELF UDP listen address ('' to disable)")
+var gelfTCPBind = flag.String("gelf-tcp", ":12201", "GELF TCP listen address ('' to disable)")
+var syslogUDPBind = flag.String("syslog-udp", ":1514", "Syslog UDP listen address ('' to disable)")
+var syslogTCPBind = flag.String("syslog-tcp", ":1514", "Syslog TCP listen address ('' to disable)")
+
 var logOutput io.Writer
 var startTime time.Time
 
@@ -65,10 +73,24 @@ func main() {
 	*/
 
 	sigChannel := make(chan os.Signal, 1)
-	signal.Notify(sigChannel, syscall.SIGINT)
+	signal.Notify(sigChannel, syscall.SIGINT, syscall.SIGTERM)
 
+	wwwServer = newWebServer()
 	go webServer()
+	if *gelfUDPBind != "" {
+		go gelfUDPServer()
+	}
+	if *gelfTCPBind != "" {
+		go gelfTCPServer()
+	}
+	if *syslogUDPBind != "" {
+		go syslogUDPServer()
+	}
+	if *syslogTCPBind != "" {
+		go syslogTCPServer()
+	}
 	go instance.Committer()
+	go instance.Janitor()
 
 	var m runtime.MemStats
 	runtime.ReadMemStats(&m)
@@ -80,14 +102,21 @@ func main() {
 		case msg := <-sysEventChannel:
 			switch msg.event {
 			case eventQuit:
+				exitCode := msg.idata
+				if !shutdown() && exitCode == 0 {
+					exitCode = 1
+				}
 				log.Println("Exiting")
-				os.Exit(msg.idata)
+				os.Exit(exitCode)
 			}
 		case sig := <-sigChannel:
 			switch sig {
 			case syscall.SIGINT:
 				sysEventChannel <- sysEventMessage{event: eventQuit, idata: 0}
 				log.Println("^C detected")
+			case syscall.SIGTERM:
+				sysEventChannel <- sysEventMessage{event: eventQuit, idata: 0}
+				log.Println("SIGTERM received")
 			}
 		case <-time.After(60 * time.Second):
 
@@ -100,6 +129,26 @@ func main() {
 	}
 }
 
+// shutdown stops the inputs and the web server, and closes the instance,
+// which commits the buffered messages. Returns false if anything failed.
+func shutdown() (ok bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	ok = true
+
+	log.Println("Shutting down...")
+	closeInputs()
+	if err := wwwServer.Shutdown(ctx); err != nil {
+		log.Println("Error shutting down the web server:", err)
+		ok = false
+	}
+	if err := instance.Close(ctx); err != nil {
+		log.Println("Error closing the instance:", err)
+		ok = false
+	}
+	return
+}
+
 func printMemStats(m *runtime.MemStats) {
 	// For info on each, see: https://golang.org/pkg/runtime/#MemStats
 	log.Printf("Alloc: %v MiB\tTotalAlloc: %v MiB\tSys: %v MiB\tNumGC: %v\tUptime: %0.1fh\n",
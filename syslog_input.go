@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+
+	"github.com/ivoras/ceruleanlog/logcore"
+)
+
+const (
+	syslogMaxMessageSize = 64 * 1024
+	// Maximum number of digits of the octet count of a frame, as in "65536 "
+	syslogMaxOctetCountDigits = 5
+)
+
+// Goroutine which receives syslog messages over UDP, one message per datagram
+func syslogUDPServer() {
+	conn, err := net.ListenPacket("udp", *syslogUDPBind)
+	if err != nil {
+		log.Panic("Cannot listen on ", *syslogUDPBind, " for syslog UDP: ", err)
+	}
+	if !trackInput(conn) {
+		conn.Close()
+		return
+	}
+	log.Println("Syslog UDP server listening on", *syslogUDPBind)
+
+	buf := make([]byte, syslogMaxMessageSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if inputsClosing() {
+				return
+			}
+			log.Println("Syslog UDP read error:", err)
+			continue
+		}
+		msg, err := logcore.ParseSyslogMessage(buf[:n])
+		if err != nil {
+			log.Println("Error parsing syslog message from", addr, err)
+			continue
+		}
+		if err = instance.AddMessage(msg); err != nil {
+			log.Println("Error ingesting message:", err)
+		}
+	}
+}
+
+// Goroutine which receives syslog messages over TCP, framed either
+// with octet counting or with newlines (RFC 6587).
+func syslogTCPServer() {
+	listener, err := net.Listen("tcp", *syslogTCPBind)
+	if err != nil {
+		log.Panic("Cannot listen on ", *syslogTCPBind, " for syslog TCP: ", err)
+	}
+	if !trackInput(listener) {
+		listener.Close()
+		return
+	}
+	log.Println("Syslog TCP server listening on", *syslogTCPBind)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if inputsClosing() {
+				return
+			}
+			log.Println("Syslog TCP accept error:", err)
+			continue
+		}
+		if !trackInput(conn) {
+			conn.Close()
+			return
+		}
+		go syslogTCPHandleConnection(conn)
+	}
+}
+
+func syslogTCPHandleConnection(conn net.Conn) {
+	defer untrackInput(conn)
+	defer conn.Close()
+	addr := conn.RemoteAddr()
+	r := bufio.NewReader(conn)
+	nMessages := 0
+	nErrors := 0
+	for {
+		frame, err := readSyslogFrame(r)
+		if len(frame) > 0 {
+			msg, perr := logcore.ParseSyslogMessage(frame)
+			if perr != nil {
+				log.Println("Error parsing syslog message from", addr, perr)
+				nErrors++
+			} else if perr = instance.AddMessage(msg); perr != nil {
+				log.Println("Error ingesting message:", perr)
+				nErrors++
+			} else {
+				nMessages++
+			}
+		}
+		if err != nil {
+			if err != io.EOF && !inputsClosing() {
+				log.Println("Syslog TCP read error from", addr, err)
+			}
+			break
+		}
+	}
+	log.Printf("Syslog TCP connection from %v closed, %d messages received, %d errors", addr, nMessages, nErrors)
+}
+
+// readSyslogFrame reads a single syslog frame. If the frame starts with a digit,
+// it's octet-counted ("LEN SP MSG"), otherwise it's terminated by a newline.
+func readSyslogFrame(r *bufio.Reader) (frame []byte, err error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if first[0] >= '0' && first[0] <= '9' {
+		var lenBuf []byte
+		for len(lenBuf) <= syslogMaxOctetCountDigits {
+			var c byte
+			if c, err = r.ReadByte(); err != nil {
+				return nil, err
+			}
+			if c == ' ' {
+				break
+			}
+			lenBuf = append(lenBuf, c)
+		}
+		var n int
+		n, err = strconv.Atoi(string(lenBuf))
+		if err != nil || len(lenBuf) > syslogMaxOctetCountDigits || n <= 0 || n > syslogMaxMessageSize {
+			return nil, fmt.Errorf("Invalid syslog octet count: %q", lenBuf)
+		}
+		frame = make([]byte, n)
+		if _, err = io.ReadFull(r, frame); err != nil {
+			// Truncated by the end of the connection
+			return nil, err
+		}
+		return
+	}
+	for {
+		var chunk []byte
+		chunk, err = r.ReadSlice('\n')
+		if len(frame)+len(chunk) > syslogMaxMessageSize {
+			return nil, fmt.Errorf("Syslog message larger than %d bytes", syslogMaxMessageSize)
+		}
+		frame = append(frame, chunk...)
+		if err != bufio.ErrBufferFull {
+			break
+		}
+	}
+	return bytes.TrimRight(frame, "\r\n"), err
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadSyslogFrame(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream string
+		frames []string
+		err    bool // if the stream ends with an error other than io.EOF
+	}{
+		{
+			name:   "octet counted",
+			stream: "5 hello11 <13>1 - - -",
+			frames: []string{"hello", "<13>1 - - -"},
+		},
+		{
+			name:   "octet counted with newlines",
+			stream: "6 a\nb\nc\n2 d\n",
+			frames: []string{"a\nb\nc\n", "d\n"},
+		},
+		{
+			name:   "newline terminated",
+			stream: "<13>hello\r\n<13>world\n<13>last",
+			frames: []string{"<13>hello", "<13>world", "<13>last"},
+		},
+		{
+			name:   "mixed",
+			stream: "<13>hello\n5 world<13>again\n",
+			frames: []string{"<13>hello", "world", "<13>again"},
+		},
+		{
+			name:   "largest octet count",
+			stream: "65536 " + strings.Repeat("a", 65536),
+			frames: []string{strings.Repeat("a", 65536)},
+		},
+		{
+			name:   "octet count too large",
+			stream: "65537 " + strings.Repeat("a", 65537),
+			err:    true,
+		},
+		{
+			name:   "too many octet count digits",
+			stream: "000005 hello",
+			err:    true,
+		},
+		{
+			name:   "octet count without a space",
+			stream: strings.Repeat("9", 1000),
+			err:    true,
+		},
+		{
+			name:   "zero octet count",
+			stream: "0 ",
+			err:    true,
+		},
+		{
+			name:   "invalid octet count",
+			stream: "5x hello",
+			err:    true,
+		},
+		{
+			name:   "truncated octet counted frame",
+			stream: "5 hello10 <13>",
+			frames: []string{"hello"},
+			err:    true,
+		},
+		{
+			name:   "line too long",
+			stream: "<13>" + strings.Repeat("a", syslogMaxMessageSize) + "\n",
+			err:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(strings.NewReader(tt.stream))
+			var frames []string
+			var err error
+			for err == nil {
+				var frame []byte
+				frame, err = readSyslogFrame(r)
+				if len(frame) > 0 {
+					frames = append(frames, string(frame))
+				}
+			}
+			if (err != io.EOF) != tt.err {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(frames, tt.frames) {
+				t.Errorf("expected frames %q, got %q", tt.frames, frames)
+			}
+		})
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ivoras/ceruleanlog/logcore"
+)
+
+const (
+	wwwExportFlushRows = 1000
+	// Trailer set if the export fails after the response has started
+	wwwExportErrorTrailer = "X-Export-Error"
+)
+
+var wwwExportContentTypes = map[string]string{
+	"ndjson": "application/x-ndjson",
+	"csv":    "text/csv; charset=utf-8",
+	"gelf":   "application/x-ndjson",
+}
+
+// Handles the /export API, which streams all the messages matching the query
+// (with the same arguments as /query, but without a default limit), as they're
+// read from the shards. The format argument can be ndjson (the default), csv
+// (with a header listing the fields of all the shards), or gelf (one GELF
+// message per line). The response is gzip-compressed if the client accepts it.
+// Since errors which happen during the export can't change the HTTP status,
+// they're sent in the X-Export-Error trailer.
+func wwwExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		wwwError(w, r, "HTTP GET method expected")
+		return
+	}
+	timeFrom, timeTo, err := wwwTimeRange(r)
+	if err != nil {
+		wwwErrorWithCode(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	query, err := wwwParseQuery(r)
+	if err != nil {
+		wwwErrorWithCode(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	params := logcore.QueryParams{TimeFrom: timeFrom, TimeTo: timeTo, Query: query}
+	if strLimit := r.URL.Query().Get("limit"); strLimit != "" {
+		limit, err := strconv.ParseUint(strLimit, 10, 32)
+		if err != nil {
+			wwwErrorWithCode(w, r, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		params.Limit = uint32(limit)
+	}
+	if err = wwwQueryFields(r, &params); err != nil {
+		wwwErrorWithCode(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if params.Ascending, err = wwwQueryOrder(r, false); err != nil {
+		wwwErrorWithCode(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "ndjson"
+	}
+	contentType, ok := wwwExportContentTypes[format]
+	if !ok {
+		wwwErrorWithCode(w, r, "Invalid format, expecting ndjson, csv or gelf", http.StatusBadRequest)
+		return
+	}
+
+	stream, err := instance.QueryStream(r.Context(), params)
+	if err != nil {
+		wwwQueryError(w, r, "Query error", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Trailer", wwwExportErrorTrailer)
+	w.Header().Add("Vary", "Accept-Encoding")
+	var out io.Writer = w
+	var gz *gzip.Writer
+	if wwwAcceptsGzip(r) {
+		w.Header().Set("Content-Encoding", "gzip")
+		gz = gzip.NewWriter(w)
+		out = gz
+	}
+	bw := bufio.NewWriterSize(out, 64*1024)
+	flush := func() error {
+		if err := bw.Flush(); err != nil {
+			return err
+		}
+		if gz != nil {
+			if err := gz.Flush(); err != nil {
+				return err
+			}
+		}
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+		return nil
+	}
+
+	write, finish := wwwExportWriter(format, bw, stream.Columns)
+	rows := 0
+	err = stream.Each(func(row map[string]interface{}) error {
+		if err := write(row); err != nil {
+			return err
+		}
+		rows++
+		if rows%wwwExportFlushRows == 0 {
+			if err := finish(); err != nil {
+				return err
+			}
+			return flush()
+		}
+		return nil
+	})
+	if err == nil {
+		err = finish()
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	if gz != nil {
+		if gzErr := gz.Close(); err == nil {
+			err = gzErr
+		}
+	}
+	if err != nil {
+		log.Println("Export error after", rows, "rows:", err)
+		w.Header().Set(wwwExportErrorTrailer, err.Error())
+	}
+}
+
+// wwwAcceptsGzip checks if the client accepts gzip-compressed responses.
+func wwwAcceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		enc = strings.TrimSpace(enc)
+		if enc == "gzip" || strings.HasPrefix(enc, "gzip;") && !strings.HasSuffix(strings.ReplaceAll(enc, " ", ""), "q=0") {
+			return true
+		}
+	}
+	return false
+}
+
+// wwwExportWriter returns the function which writes a row in the given format,
+// and the function which flushes any data buffered by the format's writer.
+func wwwExportWriter(format string, w io.Writer, columns []string) (write func(row map[string]interface{}) error, finish func() error) {
+	finish = func() error { return nil }
+	switch format {
+	case "csv":
+		cw := csv.NewWriter(w)
+		header := true
+		record := make([]string, len(columns))
+		write = func(row map[string]interface{}) error {
+			if header {
+				header = false
+				if err := cw.Write(columns); err != nil {
+					return err
+				}
+			}
+			for i, c := range columns {
+				record[i] = wwwExportCSVValue(row[c])
+			}
+			return cw.Write(record)
+		}
+		finish = func() error {
+			if header {
+				// No rows, write just the header
+				header = false
+				if err := cw.Write(columns); err != nil {
+					return err
+				}
+			}
+			cw.Flush()
+			return cw.Error()
+		}
+	case "gelf":
+		write = func(row map[string]interface{}) error {
+			msg := logcore.RowToGelfMessage(row)
+			data, err := msg.MarshalGelf()
+			if err != nil {
+				return err
+			}
+			_, err = w.Write(append(data, '\n'))
+			return err
+		}
+	default:
+		enc := json.NewEncoder(w)
+		enc.SetEscapeHTML(false)
+		write = func(row map[string]interface{}) error {
+			return enc.Encode(row)
+		}
+	}
+	return
+}
+
+func wwwExportCSVValue(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case nil:
+		return ""
+	}
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ivoras/ceruleanlog/logcore"
+)
+
+const wwwMaxSavedSearchSize = 64 * 1024
+
+// Prefix of the /searches/run arguments with the values of parameters, e.g. param.host=web1
+const wwwSearchParamPrefix = "param."
+
+// Handles the /searches API. GET lists the saved searches (only the owner's
+// with owner=), or returns the one with name=. POST creates a saved search
+// from the JSON body, e.g.
+//
+//	{"name": "slow-requests", "query": "host = $host AND duration > 5",
+//	 "fields": ["duration"], "time_from": "now-1h", "params": {"host": "web1"}}
+//
+// PUT replaces the saved search with the body's name, and DELETE deletes the
+// one with name=.
+func wwwSearches(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		name := r.URL.Query().Get("name")
+		if name == "" {
+			wwwJSON(w, r, WwwRespSavedSearches{Ok: true, Result: instance.SavedSearches(r.URL.Query().Get("owner"))})
+			return
+		}
+		s, err := instance.SavedSearch(name)
+		if err != nil {
+			wwwSavedSearchError(w, r, err)
+			return
+		}
+		wwwJSON(w, r, WwwRespSavedSearch{Ok: true, Result: s})
+	case "POST", "PUT":
+		s, err := wwwReadSavedSearch(r)
+		if err != nil {
+			wwwErrorWithCode(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if r.Method == "POST" {
+			s, err = instance.CreateSavedSearch(s)
+		} else {
+			s, err = instance.UpdateSavedSearch(s)
+		}
+		if err != nil {
+			wwwSavedSearchError(w, r, err)
+			return
+		}
+		wwwJSON(w, r, WwwRespSavedSearch{Ok: true, Result: s})
+	case "DELETE":
+		name := r.URL.Query().Get("name")
+		if name == "" {
+			wwwErrorWithCode(w, r, "Missing name", http.StatusBadRequest)
+			return
+		}
+		if err := instance.DeleteSavedSearch(name); err != nil {
+			wwwSavedSearchError(w, r, err)
+			return
+		}
+		wwwJSON(w, r, WwwRespDefault{Ok: true, Message: fmt.Sprintf("Deleted saved search %s", name)})
+	default:
+		wwwError(w, r, "HTTP GET, POST, PUT or DELETE method expected")
+	}
+}
+
+// wwwReadSavedSearch reads and validates a saved search from the request body.
+func wwwReadSavedSearch(r *http.Request) (s logcore.SavedSearch, err error) {
+	defer r.Body.Close()
+	dec := json.NewDecoder(io.LimitReader(r.Body, wwwMaxSavedSearchSize))
+	dec.DisallowUnknownFields()
+	if err = dec.Decode(&s); err != nil {
+		return s, fmt.Errorf("Invalid saved search: %v", err)
+	}
+	now := time.Now().UTC()
+	if s.TimeFrom != "" {
+		if _, err = parseWwwTime(s.TimeFrom, now, false); err != nil {
+			return s, fmt.Errorf("Invalid time_from: %v", err)
+		}
+	} else if s.TimeTo != "" {
+		return s, fmt.Errorf("time_to requires time_from")
+	}
+	if s.TimeTo != "" {
+		if _, err = parseWwwTime(s.TimeTo, now, true); err != nil {
+			return s, fmt.Errorf("Invalid time_to: %v", err)
+		}
+	}
+	err = s.Validate()
+	return
+}
+
+// wwwSavedSearchError sends the error of a saved search operation, with a
+// status code depending on the error.
+func wwwSavedSearchError(w http.ResponseWriter, r *http.Request, err error) {
+	switch err {
+	case logcore.ErrSavedSearchNotFound:
+		wwwErrorWithCode(w, r, err.Error(), http.StatusNotFound)
+	case logcore.ErrSavedSearchExists:
+		wwwErrorWithCode(w, r, err.Error(), http.StatusConflict)
+	default:
+		wwwError(w, r, fmt.Sprintf("Error saving searches: %v", err))
+	}
+}
+
+// Handles the /searches/run API, which runs the saved search with name= as
+// /query, with the values of its parameters given as param.<name>=value, e.g.
+// /searches/run?name=slow-requests&param.host=web2
+// The saved search's time range and fields are used unless time_from or
+// fields are given, and the other arguments of /query can be used as well.
+func wwwRunSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		wwwError(w, r, "HTTP GET method expected")
+		return
+	}
+	args := r.URL.Query()
+	s, err := instance.SavedSearch(args.Get("name"))
+	if err != nil {
+		wwwSavedSearchError(w, r, err)
+		return
+	}
+	if args.Get("query") != "" || args.Get("syntax") != "" {
+		wwwErrorWithCode(w, r, "The query of a saved search can't be changed, only its parameters", http.StatusBadRequest)
+		return
+	}
+	values := map[string]string{}
+	for arg := range args {
+		if strings.HasPrefix(arg, wwwSearchParamPrefix) {
+			values[strings.TrimPrefix(arg, wwwSearchParamPrefix)] = args.Get(arg)
+			args.Del(arg)
+		}
+	}
+	query, err := s.QueryWithParams(values)
+	if err != nil {
+		wwwErrorWithCode(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	args.Del("name")
+	args.Set("query", query)
+	args.Set("syntax", s.Syntax)
+	if args.Get("fields") == "" && len(s.Fields) > 0 {
+		args.Set("fields", strings.Join(s.Fields, ","))
+	}
+	if args.Get("time_from") == "" && s.TimeFrom != "" {
+		// The saved time range is used as a whole
+		args.Set("time_from", s.TimeFrom)
+		if args.Get("time_to") == "" && s.TimeTo != "" {
+			args.Set("time_to", s.TimeTo)
+		}
+	}
+	runReq := r.Clone(r.Context())
+	runReq.URL.RawQuery = args.Encode()
+	wwwQuery(w, runReq)
+}
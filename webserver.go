@@ -1,12 +1,21 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"regexp"
 	"runtime/debug"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/handlers"
@@ -15,17 +24,39 @@ import (
 )
 
 const (
-	wwwBind         = ":2020"
-	jsonContentType = "application/json; charset=utf-8"
+	wwwBind            = ":2020"
+	jsonContentType    = "application/json; charset=utf-8"
+	wwwGelfMaxBodySize = 64 * 1024 * 1024
+
+	wwwDefaultQueryLimit = 1000
+
+	wwwDefaultContextMessages = 10
+	wwwMaxContextMessages     = 1000
+
+	wwwMaxFieldsTopValues  = 100
+	wwwMaxFieldsSampleRows = 1000000
 )
 
-// Goroutine which serves HTTP & WS for the main client-facing API
-func webServer() {
+var wwwServer *http.Server
+
+// Closed when the web server is shutting down, to end long-running responses
+var wwwShuttingDown = make(chan struct{})
+
+// newWebServer creates the server for the main client-facing API. It's
+// created before webServer is started, so that shutdown() can always stop it.
+func newWebServer() *http.Server {
 	http.HandleFunc("/", wwwRoot)
 	http.HandleFunc("/gelf", wwwGelf)
 	http.HandleFunc("/query", wwwQuery)
-
-	log.Println("Web server listening on", wwwBind)
+	http.HandleFunc("/export", wwwExport)
+	http.HandleFunc("/context", wwwContext)
+	http.HandleFunc("/tail", wwwTail)
+	http.HandleFunc("/aggregate", wwwAggregate)
+	http.HandleFunc("/fields", wwwFields)
+	http.HandleFunc("/searches", wwwSearches)
+	http.HandleFunc("/searches/run", wwwRunSearch)
+	http.HandleFunc("/indexes", wwwIndexes)
+	http.HandleFunc("/retention", wwwRetention)
 
 	corsHandler := cors.New(cors.Options{
 		AllowedOrigins:   []string{"*"},
@@ -33,8 +64,19 @@ func webServer() {
 		AllowCredentials: true,
 	})
 
-	err := http.ListenAndServe(wwwBind, handlers.CombinedLoggingHandler(logOutput, corsHandler.Handler(http.DefaultServeMux)))
-	if err != nil {
+	server := &http.Server{
+		Addr:    wwwBind,
+		Handler: handlers.CombinedLoggingHandler(logOutput, corsHandler.Handler(http.DefaultServeMux)),
+	}
+	server.RegisterOnShutdown(func() { close(wwwShuttingDown) })
+	return server
+}
+
+// Goroutine which serves HTTP & WS for the main client-facing API
+func webServer() {
+	log.Println("Web server listening on", wwwBind)
+	err := wwwServer.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
 		log.Panic("Cannot listen on ", wwwBind, " for the web server")
 	}
 }
@@ -64,6 +106,16 @@ func wwwErrorWithCode(w http.ResponseWriter, r *http.Request, msg string, code i
 	}
 }
 
+// wwwQueryError sends the error of a query, with the Bad Request (400) code
+// if the query or its parameters are invalid, or as wwwError otherwise.
+func wwwQueryError(w http.ResponseWriter, r *http.Request, prefix string, err error) {
+	if logcore.IsValidationError(err) {
+		wwwErrorWithCode(w, r, fmt.Sprintf("%s: %v", prefix, err), http.StatusBadRequest)
+		return
+	}
+	wwwError(w, r, fmt.Sprintf("%s: %v", prefix, err))
+}
+
 // wwwJSON JSON-ifies and sends the given msg to the HTTP client.
 func wwwJSON(w http.ResponseWriter, r *http.Request, msg interface{}) {
 	jsonb, err := json.Marshal(msg)
@@ -83,64 +135,657 @@ func wwwRoot(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("<html><body>Equinox API. Nothing here.</body></html>"))
 }
 
-// Handles the /gelf API
+// Handles the /gelf API. The body can be a single GELF message, a JSON array
+// of messages, or a sequence of messages, e.g. newline-delimited, optionally
+// compressed with gzip or deflate (as indicated by Content-Encoding).
 func wwwGelf(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		wwwError(w, r, "HTTP POST method expected")
 		return
 	}
 	defer r.Body.Close()
-	data, err := ioutil.ReadAll(r.Body)
+	body, err := wwwGelfBodyReader(r)
 	if err != nil {
-		wwwErrorWithCode(w, r, "Cannot read data", http.StatusBadRequest)
+		wwwErrorWithCode(w, r, err.Error(), http.StatusBadRequest)
 		return
 	}
-	msg, err := logcore.ParseGelfMessage(data)
+	data, err := ioutil.ReadAll(io.LimitReader(body, wwwGelfMaxBodySize+1))
 	if err != nil {
-		wwwErrorWithCode(w, r, fmt.Sprintf("Error parsing GELF message: %v", err), http.StatusBadRequest)
+		wwwErrorWithCode(w, r, "Cannot read data", http.StatusBadRequest)
+		return
+	}
+	if len(data) > wwwGelfMaxBodySize {
+		wwwErrorWithCode(w, r, fmt.Sprintf("Request body larger than %d bytes", wwwGelfMaxBodySize), http.StatusRequestEntityTooLarge)
 		return
 	}
-	err = instance.AddMessage(msg)
+	docs, err := splitGelfBatch(data)
 	if err != nil {
-		wwwError(w, r, fmt.Sprintf("Error ingesting message: %v", err))
+		wwwErrorWithCode(w, r, fmt.Sprintf("Error parsing GELF batch: %v", err), http.StatusBadRequest)
 		return
 	}
-	wwwJSON(w, r, WwwRespDefault{Ok: true, Message: "Saved."})
+
+	resp := WwwRespGelf{Rejected: []WwwGelfRejectedLine{}}
+	msgs := make([]logcore.BasicGelfMessage, 0, len(docs))
+	for _, doc := range docs {
+		var msg logcore.BasicGelfMessage
+		err := doc.err
+		if err == nil {
+			msg, err = logcore.ParseGelfMessage(doc.data)
+		}
+		if err != nil {
+			resp.Rejected = append(resp.Rejected, WwwGelfRejectedLine{Line: doc.line, Error: err.Error()})
+			continue
+		}
+		msgs = append(msgs, msg)
+	}
+	if len(msgs) > 0 {
+		err = instance.AddMessages(msgs)
+		if err != nil {
+			wwwError(w, r, fmt.Sprintf("Error ingesting messages: %v", err))
+			return
+		}
+	}
+	resp.Accepted = len(msgs)
+	resp.Ok = len(resp.Rejected) == 0
+	resp.Message = fmt.Sprintf("Saved %d message(s), rejected %d.", resp.Accepted, len(resp.Rejected))
+	if resp.Accepted == 0 && len(resp.Rejected) > 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(jsonifyWhateverToBytes(resp))
+		return
+	}
+	wwwJSON(w, r, resp)
+}
+
+// wwwGelfBodyReader wraps the request body in a decompressor according
+// to the Content-Encoding header.
+func wwwGelfBodyReader(r *http.Request) (io.Reader, error) {
+	switch strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))) {
+	case "", "identity":
+		return r.Body, nil
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid gzip body: %v", err)
+		}
+		return zr, nil
+	case "deflate":
+		// HTTP "deflate" is supposed to be zlib-wrapped, but some clients send raw deflate
+		br := bufio.NewReader(r.Body)
+		header, err := br.Peek(2)
+		if err == nil && header[0]&0x0f == 0x08 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+			zr, err := zlib.NewReader(br)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid deflate body: %v", err)
+			}
+			return zr, nil
+		}
+		return flate.NewReader(br), nil
+	default:
+		return nil, fmt.Errorf("Unsupported Content-Encoding: %s", r.Header.Get("Content-Encoding"))
+	}
 }
 
-// Handles the /query API
+// gelfDocument is a document from a GELF batch, with the line it starts on
+// (or its index + 1 in a JSON array), or the error if it isn't valid JSON.
+type gelfDocument struct {
+	line int
+	data []byte
+	err  error
+}
+
+// splitGelfBatch splits the request body into individual GELF documents.
+// A JSON array is split into its elements, anything else is decoded as a
+// sequence of JSON documents, which can be a single (e.g. pretty-printed)
+// document, concatenated documents or newline-delimited JSON. After invalid
+// JSON, decoding continues on the next line.
+func splitGelfBatch(data []byte) (docs []gelfDocument, err error) {
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		var elements []json.RawMessage
+		if err = json.Unmarshal(trimmed, &elements); err != nil {
+			return
+		}
+		for i, e := range elements {
+			docs = append(docs, gelfDocument{line: i + 1, data: []byte(e)})
+		}
+		return
+	}
+	lineAt := func(pos int) int {
+		return bytes.Count(data[:pos], []byte{'\n'}) + 1
+	}
+	offset := 0
+	for offset < len(data) {
+		dec := json.NewDecoder(bytes.NewReader(data[offset:]))
+		for {
+			prevEnd := offset + int(dec.InputOffset())
+			var doc json.RawMessage
+			derr := dec.Decode(&doc)
+			if derr == io.EOF {
+				return
+			}
+			if derr != nil {
+				start := len(data) - len(bytes.TrimLeft(data[prevEnd:], " \t\r\n"))
+				docs = append(docs, gelfDocument{line: lineAt(start), err: derr})
+				// After a syntax error, continue on the next line, otherwise
+				// (e.g. an incomplete document) the rest of the data is invalid
+				serr, ok := derr.(*json.SyntaxError)
+				if !ok {
+					return
+				}
+				errPos := offset + int(serr.Offset) - 1
+				if errPos < start {
+					errPos = start
+				}
+				nl := bytes.IndexByte(data[errPos:], '\n')
+				if nl == -1 {
+					return
+				}
+				offset = errPos + nl + 1
+				break
+			}
+			end := offset + int(dec.InputOffset())
+			docs = append(docs, gelfDocument{line: lineAt(end - len(doc)), data: []byte(doc)})
+		}
+	}
+	return
+}
+
+// Handles the /query API. Results are newest first, or oldest first with
+// order=asc. If there are more results, next_cursor is returned, which can be
+// passed as cursor= (with the other parameters unchanged) to get the next page.
+// The returned fields can be limited with fields=, and messages with the same
+// timestamp sorted by an indexed field with sort=, e.g. fields=host,level&sort=host:desc
 func wwwQuery(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "GET" {
 		wwwError(w, r, "HTTP GET method expected")
 		return
 	}
-	if len(r.URL.Query()["time_from"]) == 0 {
-		wwwErrorWithCode(w, r, "Missing time_from", http.StatusBadRequest)
+	timeFrom, timeTo, err := wwwTimeRange(r)
+	if err != nil {
+		wwwErrorWithCode(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	query, err := wwwParseQuery(r)
+	if err != nil {
+		wwwErrorWithCode(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit := uint64(wwwDefaultQueryLimit)
+	if strLimit := r.URL.Query().Get("limit"); strLimit != "" {
+		limit, err = strconv.ParseUint(strLimit, 10, 32)
+		if err != nil || limit == 0 {
+			wwwErrorWithCode(w, r, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	params := logcore.QueryParams{TimeFrom: timeFrom, TimeTo: timeTo, Limit: uint32(limit), Query: query}
+	if err = wwwQueryFields(r, &params); err != nil {
+		wwwErrorWithCode(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if strCursor := r.URL.Query().Get("cursor"); strCursor != "" {
+		params.Cursor, err = logcore.DecodeQueryCursor(strCursor)
+		if err != nil {
+			wwwErrorWithCode(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		params.Ascending = params.Cursor.Ascending
+	}
+	if params.Ascending, err = wwwQueryOrder(r, params.Ascending); err != nil {
+		wwwErrorWithCode(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result, err := instance.Query(r.Context(), params)
+	if err != nil {
+		wwwQueryError(w, r, "Query error", err)
+		return
+	}
+	resp := WwwRespQuery{
+		Ok:               true,
+		Result:           result.Rows,
+		Partial:          result.Partial,
+		PartialReason:    result.PartialReason,
+		IncompleteShards: result.IncompleteShards,
+		RowsScanned:      result.RowsScanned,
+	}
+	if result.NextCursor != nil {
+		resp.NextCursor = result.NextCursor.Encode()
+	}
+	wwwJSON(w, r, resp)
+}
+
+// Handles the /context API, which returns the message with the given id (the
+// _id of query results), and the messages before and after it, oldest first,
+// e.g. /context?id=202641-193&before=20&after=20&same=host
+// With same=, only the messages with the same values of the fields (e.g. host
+// or facility) are returned. The returned fields can be limited with fields=.
+func wwwContext(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		wwwError(w, r, "HTTP GET method expected")
+		return
+	}
+	id, err := logcore.ParseMessageID(r.URL.Query().Get("id"))
+	if err != nil {
+		wwwErrorWithCode(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	params := logcore.ContextParams{ID: id, Before: wwwDefaultContextMessages, After: wwwDefaultContextMessages}
+	for _, arg := range []struct {
+		name  string
+		count *uint32
+	}{{"before", &params.Before}, {"after", &params.After}} {
+		if str := r.URL.Query().Get(arg.name); str != "" {
+			n, err := strconv.ParseUint(str, 10, 32)
+			if err != nil || n > wwwMaxContextMessages {
+				wwwErrorWithCode(w, r, fmt.Sprintf("Invalid %s, must be 0-%d", arg.name, wwwMaxContextMessages), http.StatusBadRequest)
+				return
+			}
+			*arg.count = uint32(n)
+		}
+	}
+	params.Same = wwwFieldList(r, "same")
+	params.Fields = wwwFieldList(r, "fields")
+
+	result, err := instance.MessageContext(r.Context(), params)
+	if err == logcore.ErrMessageNotFound {
+		wwwErrorWithCode(w, r, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		wwwQueryError(w, r, "Query error", err)
+		return
+	}
+	wwwJSON(w, r, WwwRespContext{Ok: true, Result: result})
+}
+
+// Handles the /aggregate API, e.g.
+// /aggregate?time_from=...&time_to=...&query=level<=3&group_by=host&interval=5m&agg=count,avg:duration,p99:duration,distinct:user_id
+// The accuracy of percentiles (relative error, default 0.01) and distinct counts
+// (HyperLogLog precision, default 14) can be set with accuracy= and precision=.
+// At most limit= rows are returned (by default 1000). If there are more,
+// truncated is true, and the newest time buckets are returned, or without
+// interval=, the groups with the largest values of the first aggregation.
+func wwwAggregate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		wwwError(w, r, "HTTP GET method expected")
+		return
+	}
+	timeFrom, timeTo, err := wwwTimeRange(r)
+	if err != nil {
+		wwwErrorWithCode(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	query, err := wwwParseQuery(r)
+	if err != nil {
+		wwwErrorWithCode(w, r, err.Error(), http.StatusBadRequest)
 		return
 	}
-	if len(r.URL.Query()["time_to"]) == 0 {
-		wwwErrorWithCode(w, r, "Missing time_to", http.StatusBadRequest)
+	params := logcore.AggregateParams{
+		TimeFrom: timeFrom,
+		TimeTo:   timeTo,
+		Query:    query,
+		Limit:    wwwDefaultQueryLimit,
+	}
+	if strGroupBy := r.URL.Query().Get("group_by"); strGroupBy != "" {
+		for _, f := range strings.Split(strGroupBy, ",") {
+			params.GroupBy = append(params.GroupBy, strings.TrimPrefix(strings.TrimSpace(f), "_"))
+		}
+	}
+	if strInterval := r.URL.Query().Get("interval"); strInterval != "" {
+		interval, err := parseWwwDuration(strInterval)
+		if err != nil || interval <= 0 {
+			wwwErrorWithCode(w, r, "Invalid interval", http.StatusBadRequest)
+			return
+		}
+		params.Interval = int64(interval / time.Microsecond)
+	}
+	if strAgg := r.URL.Query().Get("agg"); strAgg != "" {
+		params.Aggregations, err = logcore.ParseAggregations(strAgg)
+		if err != nil {
+			wwwErrorWithCode(w, r, fmt.Sprintf("Invalid agg: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	if strAccuracy := r.URL.Query().Get("accuracy"); strAccuracy != "" {
+		params.QuantileAccuracy, err = strconv.ParseFloat(strAccuracy, 64)
+		if err != nil || !(params.QuantileAccuracy > 0 && params.QuantileAccuracy < 1) {
+			wwwErrorWithCode(w, r, "Invalid accuracy", http.StatusBadRequest)
+			return
+		}
+	}
+	if strPrecision := r.URL.Query().Get("precision"); strPrecision != "" {
+		precision, err := strconv.ParseUint(strPrecision, 10, 8)
+		if err != nil || precision < logcore.MinDistinctPrecision || precision > logcore.MaxDistinctPrecision {
+			wwwErrorWithCode(w, r, fmt.Sprintf("Invalid precision, must be %d-%d", logcore.MinDistinctPrecision, logcore.MaxDistinctPrecision), http.StatusBadRequest)
+			return
+		}
+		params.DistinctPrecision = uint8(precision)
+	}
+	if strLimit := r.URL.Query().Get("limit"); strLimit != "" {
+		params.Limit, err = strconv.Atoi(strLimit)
+		if err != nil || params.Limit <= 0 {
+			wwwErrorWithCode(w, r, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	result, truncated, err := instance.Aggregate(r.Context(), params)
+	if err != nil {
+		wwwQueryError(w, r, "Aggregation error", err)
 		return
 	}
+	wwwJSON(w, r, WwwRespAggregate{Ok: true, Result: result, Truncated: truncated})
+}
 
-	strTimeFrom := r.URL.Query()["time_from"][0]
-	timeFrom, err := time.ParseInLocation("2006-01-02T15:04", strTimeFrom, time.UTC)
+// Handles the /fields API, which lists the fields of the messages in the time
+// range, with their types, the shards which have them, whether they're
+// indexed, and the approximate number of messages with each field and its
+// most common values, computed from a sample of each shard's newest messages.
+// If it runs out of the query time, the result is marked as partial.
+func wwwFields(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		wwwError(w, r, "HTTP GET method expected")
+		return
+	}
+	timeFrom, timeTo, err := wwwTimeRange(r)
 	if err != nil {
-		wwwErrorWithCode(w, r, fmt.Sprintf("Invalid time_from: %v", err), http.StatusBadRequest)
+		wwwErrorWithCode(w, r, err.Error(), http.StatusBadRequest)
 		return
 	}
-	strTimeTo := r.URL.Query()["time_to"][0]
-	timeTo, err := time.ParseInLocation("2006-01-02T15:04", strTimeTo, time.UTC)
+	params := logcore.FieldsParams{TimeFrom: timeFrom, TimeTo: timeTo}
+	if strTop := r.URL.Query().Get("top"); strTop != "" {
+		params.TopValues, err = strconv.Atoi(strTop)
+		if err != nil || params.TopValues <= 0 || params.TopValues > wwwMaxFieldsTopValues {
+			wwwErrorWithCode(w, r, fmt.Sprintf("Invalid top, must be 1-%d", wwwMaxFieldsTopValues), http.StatusBadRequest)
+			return
+		}
+	}
+	if strSample := r.URL.Query().Get("sample"); strSample != "" {
+		params.SampleRows, err = strconv.Atoi(strSample)
+		if err != nil || params.SampleRows <= 0 || params.SampleRows > wwwMaxFieldsSampleRows {
+			wwwErrorWithCode(w, r, fmt.Sprintf("Invalid sample, must be 1-%d", wwwMaxFieldsSampleRows), http.StatusBadRequest)
+			return
+		}
+	}
+
+	result, err := instance.Fields(r.Context(), params)
 	if err != nil {
-		wwwErrorWithCode(w, r, fmt.Sprintf("Invalid time_to: %v", err), http.StatusBadRequest)
+		wwwQueryError(w, r, "Error listing fields", err)
 		return
 	}
-	query := r.URL.Query()["query"][0]
-	if query == "" {
-		wwwErrorWithCode(w, r, "Invalid query", http.StatusBadRequest)
+	wwwJSON(w, r, WwwRespFields{Ok: true, Result: result})
+}
+
+// wwwTimeRange returns the time_from and time_to arguments, in microseconds.
+// time_to defaults to now.
+func wwwTimeRange(r *http.Request) (timeFrom, timeTo int64, err error) {
+	now := time.Now().UTC()
+	if len(r.URL.Query()["time_from"]) == 0 {
+		return 0, 0, fmt.Errorf("Missing time_from")
+	}
+	from, err := parseWwwTime(r.URL.Query()["time_from"][0], now, false)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Invalid time_from: %v", err)
+	}
+	to := now
+	if len(r.URL.Query()["time_to"]) != 0 {
+		to, err = parseWwwTime(r.URL.Query()["time_to"][0], now, true)
+		if err != nil {
+			return 0, 0, fmt.Errorf("Invalid time_to: %v", err)
+		}
+	}
+	if from.After(to) {
+		return 0, 0, fmt.Errorf("time_from is after time_to")
+	}
+	return logcore.TimeToMicro(from), logcore.TimeToMicro(to), nil
+}
+
+// wwwParseQuery parses the query argument, in the syntax given by the syntax argument.
+func wwwParseQuery(r *http.Request) (query *logcore.QueryNode, err error) {
+	query, err = logcore.ParseQuery(r.URL.Query().Get("syntax"), r.URL.Query().Get("query"))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid query: %v", err)
+	}
+	return
+}
+
+// wwwQueryOrder returns true if the order argument is "asc", false if it's
+// "desc", or def if it's not given.
+func wwwQueryOrder(r *http.Request, def bool) (ascending bool, err error) {
+	switch r.URL.Query().Get("order") {
+	case "":
+		return def, nil
+	case "asc":
+		return true, nil
+	case "desc":
+		return false, nil
+	}
+	return def, fmt.Errorf("Invalid order, expecting asc or desc")
+}
+
+// wwwQueryFields sets the query's projection from the fields argument, a
+// comma-separated list of the fields to return besides id and timestamp, and
+// its secondary sort from the sort argument, an indexed field optionally
+// followed by :asc (the default) or :desc.
+func wwwQueryFields(r *http.Request, params *logcore.QueryParams) (err error) {
+	params.Fields = wwwFieldList(r, "fields")
+	if strSort := r.URL.Query().Get("sort"); strSort != "" {
+		if i := strings.LastIndex(strSort, ":"); i != -1 {
+			switch strSort[i+1:] {
+			case "asc":
+			case "desc":
+				params.SortDescending = true
+			default:
+				return fmt.Errorf("Invalid sort, expecting a field optionally followed by :asc or :desc")
+			}
+			strSort = strSort[:i]
+		}
+		params.SortField = strings.TrimPrefix(strings.TrimSpace(strSort), "_")
+	}
+	return
+}
+
+// wwwFieldList returns the comma-separated list of field names in the
+// argument, or nil if it's not given.
+func wwwFieldList(r *http.Request, arg string) (fields []string) {
+	str := r.URL.Query().Get(arg)
+	if str == "" {
+		return nil
+	}
+	for _, f := range strings.Split(str, ",") {
+		fields = append(fields, strings.TrimPrefix(strings.TrimSpace(f), "_"))
+	}
+	return
+}
+
+// parseWwwDuration parses a Go duration like "5m" or "1h30m", or a number of days like "7d".
+func parseWwwDuration(s string) (d time.Duration, err error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.ParseUint(strings.TrimSuffix(s, "d"), 10, 16)
+		if err != nil {
+			return 0, fmt.Errorf("Invalid duration: %s", s)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// parseWwwTime parses the time formats accepted by the API:
+//   - RFC 3339, e.g. 2006-01-02T15:04:05.123+02:00
+//   - the same without the offset, in UTC, with optional seconds and fractions
+//     of a second, or just the date, e.g. 2006-01-02T15:04 or 2006-01-02
+//   - Unix timestamps in seconds, with optional fractions, or milliseconds,
+//     with at least 9 digits (from 1973 on), so that e.g. 2024 or 20240101
+//     isn't taken as a time in 1970
+//   - times relative to now, like in Elasticsearch and Grafana, e.g. now-15m,
+//     or now-1d/d for yesterday, rounded (in UTC) to the start of the unit, or
+//     to its end if roundUp is true, so that time_to=now-1d/d includes all of yesterday
+func parseWwwTime(s string, now time.Time, roundUp bool) (t time.Time, err error) {
+	// An unescaped + in a URL query is decoded as a space
+	s = strings.ReplaceAll(strings.TrimSpace(s), " ", "+")
+	if strings.HasPrefix(s, "now") {
+		return parseWwwRelativeTime(s, now, roundUp)
+	}
+	if reWwwEpochTime.MatchString(s) {
+		return parseWwwEpochTime(s)
+	}
+	if t, err = time.Parse(time.RFC3339Nano, s); err == nil {
 		return
 	}
+	for _, layout := range []string{"2006-01-02T15:04", "2006-01-02T15:04:05", "2006-01-02"} {
+		t, err = time.ParseInLocation(layout, s, time.UTC)
+		if err == nil {
+			return
+		}
+	}
+	return t, fmt.Errorf("Unrecognized time: %s", s)
+}
+
+var (
+	reWwwEpochTime    = regexp.MustCompile(`^[0-9]{9,}(\.[0-9]+)?$`)
+	reWwwRelativeTime = regexp.MustCompile(`^now((?:[+-][0-9]+[smhdwMy])*)(?:/([smhdwMy]))?$`)
+	reWwwTimeOffset   = regexp.MustCompile(`([+-])([0-9]+)([smhdwMy])`)
+)
 
-	result, err := instance.Query(uint32(timeFrom.Unix()), uint32(timeTo.Unix()), query)
-	wwwJSON(w, r, WwwRespQuery{Ok: true, Result: result})
+// Larger Unix timestamps are taken to be in milliseconds. In seconds, it's in the year 5138.
+const wwwEpochMillisThreshold = 100000000000
+
+// parseWwwEpochTime parses a Unix timestamp in seconds or milliseconds.
+func parseWwwEpochTime(s string) (t time.Time, err error) {
+	intPart, fracPart := s, ""
+	if i := strings.IndexByte(s, '.'); i != -1 {
+		intPart, fracPart = s[:i], s[i+1:]
+	}
+	n, err := strconv.ParseInt(intPart, 10, 64)
+	if err != nil {
+		return t, fmt.Errorf("Invalid Unix timestamp: %s", s)
+	}
+	var frac float64
+	if fracPart != "" {
+		frac, _ = strconv.ParseFloat("0."+fracPart, 64)
+	}
+	if n >= wwwEpochMillisThreshold {
+		return time.Unix(n/1000, (n%1000)*int64(time.Millisecond)+int64(frac*float64(time.Millisecond))).UTC(), nil
+	}
+	return time.Unix(n, int64(frac*float64(time.Second))).UTC(), nil
+}
+
+// parseWwwRelativeTime parses a time relative to now: "now", followed by any
+// number of offsets like -15m or +1h, and optionally by rounding like /d. The
+// units are s, m, h, d, w (weeks), M (months) and y (years).
+func parseWwwRelativeTime(s string, now time.Time, roundUp bool) (t time.Time, err error) {
+	match := reWwwRelativeTime.FindStringSubmatch(s)
+	if match == nil {
+		return t, fmt.Errorf("Invalid relative time: %s, expecting e.g. now-15m or now-1d/d", s)
+	}
+	t = now.UTC()
+	for _, offset := range reWwwTimeOffset.FindAllStringSubmatch(match[1], -1) {
+		n, err := strconv.Atoi(offset[2])
+		if err != nil {
+			return t, fmt.Errorf("Invalid relative time: %s", s)
+		}
+		if offset[1] == "-" {
+			n = -n
+		}
+		t = addWwwTimeUnits(t, n, offset[3])
+	}
+	if unit := match[2]; unit != "" {
+		t = truncateWwwTime(t, unit)
+		if roundUp {
+			t = addWwwTimeUnits(t, 1, unit).Add(-time.Microsecond)
+		}
+	}
+	return
+}
+
+func addWwwTimeUnits(t time.Time, n int, unit string) time.Time {
+	switch unit {
+	case "s":
+		return t.Add(time.Duration(n) * time.Second)
+	case "m":
+		return t.Add(time.Duration(n) * time.Minute)
+	case "h":
+		return t.Add(time.Duration(n) * time.Hour)
+	case "d":
+		return t.AddDate(0, 0, n)
+	case "w":
+		return t.AddDate(0, 0, 7*n)
+	case "M":
+		return t.AddDate(0, n, 0)
+	case "y":
+		return t.AddDate(n, 0, 0)
+	}
+	return t
+}
+
+// truncateWwwTime rounds the time down to the start of the unit. Weeks start on Monday.
+func truncateWwwTime(t time.Time, unit string) time.Time {
+	switch unit {
+	case "s":
+		return t.Truncate(time.Second)
+	case "m":
+		return t.Truncate(time.Minute)
+	case "h":
+		return t.Truncate(time.Hour)
+	case "d":
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	case "w":
+		return time.Date(t.Year(), t.Month(), t.Day()-(int(t.Weekday())+6)%7, 0, 0, 0, 0, time.UTC)
+	case "M":
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	case "y":
+		return time.Date(t.Year(), 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	return t
+}
+
+// Handles the /indexes API. GET lists the configured indexes and index jobs,
+// POST starts creating an index on the given fields, DELETE starts dropping it.
+func wwwIndexes(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		wwwJSON(w, r, WwwRespIndexes{Ok: true, Indexes: instance.IndexFieldList(), Jobs: instance.IndexJobs()})
+		return
+	}
+	if r.Method != "POST" && r.Method != "DELETE" {
+		wwwError(w, r, "HTTP GET, POST or DELETE method expected")
+		return
+	}
+	strFields := r.URL.Query().Get("fields")
+	if strFields == "" {
+		wwwErrorWithCode(w, r, "Missing fields", http.StatusBadRequest)
+		return
+	}
+	fields := strings.Split(strFields, ",")
+	var job logcore.IndexJob
+	var err error
+	if r.Method == "POST" {
+		job, err = instance.AddIndex(fields)
+	} else {
+		job, err = instance.DropIndex(fields)
+	}
+	if err != nil {
+		wwwErrorWithCode(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	wwwJSON(w, r, WwwRespIndexJob{Ok: true, Job: job})
+}
+
+// Handles the /retention API. GET returns the result of the last retention run,
+// POST applies the retention policy immediately.
+func wwwRetention(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		wwwJSON(w, r, WwwRespRetention{Ok: true, Report: instance.LastRetentionReport()})
+	case "POST":
+		report, err := instance.ApplyRetention()
+		if err != nil {
+			wwwError(w, r, fmt.Sprintf("Error applying retention policy: %v", err))
+			return
+		}
+		wwwJSON(w, r, WwwRespRetention{Ok: true, Report: &report})
+	default:
+		wwwError(w, r, "HTTP GET or POST method expected")
+	}
 }
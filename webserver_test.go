@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseWwwTime(t *testing.T) {
+	now := time.Date(2024, 3, 14, 15, 9, 26, 535897000, time.UTC) // Thursday
+	tests := []struct {
+		s        string
+		roundUp  bool
+		expected string // RFC 3339, "" for an error
+	}{
+		{s: "2006-01-02T15:04:05.123+02:00", expected: "2006-01-02T13:04:05.123Z"},
+		{s: "2006-01-02T15:04:05Z", expected: "2006-01-02T15:04:05Z"},
+		{s: "2006-01-02T15:04:05", expected: "2006-01-02T15:04:05Z"},
+		{s: "2006-01-02T15:04:05.5", expected: "2006-01-02T15:04:05.5Z"},
+		{s: "2006-01-02T15:04", expected: "2006-01-02T15:04:00Z"},
+		{s: "2006-01-02", expected: "2006-01-02T00:00:00Z"},
+		{s: " 2006-01-02T15:04:05 01:00", expected: "2006-01-02T14:04:05Z"}, // unescaped + decoded as a space
+
+		{s: "100000000", expected: "1973-03-03T09:46:40Z"},
+		{s: "1600000000", expected: "2020-09-13T12:26:40Z"},
+		{s: "1600000000.25", expected: "2020-09-13T12:26:40.25Z"},
+		{s: "99999999999", expected: "5138-11-16T09:46:39Z"},
+		{s: "1600000000123", expected: "2020-09-13T12:26:40.123Z"},
+		{s: "1600000000123.5", expected: "2020-09-13T12:26:40.1235Z"},
+		{s: "2024", expected: ""},
+		{s: "20240101", expected: ""},
+		{s: "99999999", expected: ""},
+		{s: "0", expected: ""},
+		{s: "-1600000000", expected: ""},
+		{s: "1600000000.", expected: ""},
+		{s: "99999999999999999999", expected: ""},
+
+		{s: "now", expected: "2024-03-14T15:09:26.535897Z"},
+		{s: "now-15m", expected: "2024-03-14T14:54:26.535897Z"},
+		{s: "now+1h-30s", expected: "2024-03-14T16:08:56.535897Z"},
+		{s: "now 1d", expected: "2024-03-15T15:09:26.535897Z"},
+		{s: "now-1d/d", expected: "2024-03-13T00:00:00Z"},
+		{s: "now-1d/d", roundUp: true, expected: "2024-03-13T23:59:59.999999Z"},
+		{s: "now/w", expected: "2024-03-11T00:00:00Z"},
+		{s: "now-1M/M", expected: "2024-02-01T00:00:00Z"},
+		{s: "now/y", roundUp: true, expected: "2024-12-31T23:59:59.999999Z"},
+		{s: "now-15", expected: ""},
+		{s: "now-15x", expected: ""},
+		{s: "now/", expected: ""},
+		{s: "nowish", expected: ""},
+
+		{s: "", expected: ""},
+		{s: "yesterday", expected: ""},
+		{s: "2006-13-02", expected: ""},
+	}
+	for _, tt := range tests {
+		parsed, err := parseWwwTime(tt.s, now, tt.roundUp)
+		if tt.expected == "" {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %v", tt.s, parsed)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", tt.s, err)
+			continue
+		}
+		if got := parsed.UTC().Format(time.RFC3339Nano); got != tt.expected {
+			t.Errorf("%q: expected %s, got %s", tt.s, tt.expected, got)
+		}
+	}
+}
+
+func TestSplitGelfBatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		expected []string // line:compacted document, or line:error for invalid documents
+		err      bool
+	}{
+		{
+			name:     "single document",
+			data:     `{"short_message":"a"}`,
+			expected: []string{`1:{"short_message":"a"}`},
+		},
+		{
+			name:     "pretty-printed document",
+			data:     "{\n  \"host\": \"web1\",\n  \"short_message\": \"a\"\n}\n",
+			expected: []string{`1:{"host":"web1","short_message":"a"}`},
+		},
+		{
+			name:     "pretty-printed documents",
+			data:     "{\n  \"short_message\": \"a\"\n}\n{\n  \"short_message\": \"b\"\n}",
+			expected: []string{`1:{"short_message":"a"}`, `4:{"short_message":"b"}`},
+		},
+		{
+			name:     "newline-delimited",
+			data:     "{\"short_message\":\"a\"}\r\n\n{\"short_message\":\"b\"}\n",
+			expected: []string{`1:{"short_message":"a"}`, `3:{"short_message":"b"}`},
+		},
+		{
+			name:     "concatenated",
+			data:     `{"short_message":"a"}{"short_message":"b"} {"short_message":"c"}`,
+			expected: []string{`1:{"short_message":"a"}`, `1:{"short_message":"b"}`, `1:{"short_message":"c"}`},
+		},
+		{
+			name:     "array",
+			data:     " [{\"short_message\":\"a\"},\n{\"short_message\":\"b\"}]\n",
+			expected: []string{`1:{"short_message":"a"}`, `2:{"short_message":"b"}`},
+		},
+		{
+			name: "invalid array",
+			data: `[{"short_message":"a"},`,
+			err:  true,
+		},
+		{
+			name:     "invalid line",
+			data:     "{\"short_message\":\"a\"}\nnot json\n{\"short_message\":\"b\"}\n",
+			expected: []string{`1:{"short_message":"a"}`, "2:error", `3:{"short_message":"b"}`},
+		},
+		{
+			name:     "invalid document in the middle of a line",
+			data:     "{\"short_message\":\"a\"} {\"short_message\" 1}\n{\"short_message\":\"b\"}",
+			expected: []string{`1:{"short_message":"a"}`, "1:error", `2:{"short_message":"b"}`},
+		},
+		{
+			name:     "invalid pretty-printed document",
+			data:     "{\n  \"short_message\": a\n}\n{\"short_message\":\"b\"}\n",
+			expected: []string{"1:error", "3:error", `4:{"short_message":"b"}`},
+		},
+		{
+			name:     "invalid last line",
+			data:     "{\"short_message\":\"a\"}\n}",
+			expected: []string{`1:{"short_message":"a"}`, "2:error"},
+		},
+		{
+			name:     "incomplete document",
+			data:     "{\"short_message\":\"a\"}\n{\"short_message\":\n",
+			expected: []string{`1:{"short_message":"a"}`, "2:error"},
+		},
+		{
+			name: "empty",
+			data: " \n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			docs, err := splitGelfBatch([]byte(tt.data))
+			if (err != nil) != tt.err {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var got []string
+			for _, doc := range docs {
+				if doc.err != nil {
+					got = append(got, fmt.Sprintf("%d:error", doc.line))
+					continue
+				}
+				var buf bytes.Buffer
+				if err := json.Compact(&buf, doc.data); err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, fmt.Sprintf("%d:%s", doc.line, buf.String()))
+			}
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
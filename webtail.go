@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/ivoras/ceruleanlog/logcore"
+)
+
+const (
+	wwwTailDroppedInterval   = 1 * time.Second
+	wwwTailKeepaliveInterval = 15 * time.Second
+	wwwTailWriteTimeout      = 10 * time.Second
+)
+
+var wwwTailUpgrader = websocket.Upgrader{
+	// Same as the CORS policy of the rest of the API
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// Handles the /tail API, which sends the new messages matching the query (in
+// the same syntax as /query) as they arrive. With a WebSocket upgrade request,
+// each message is sent as a WwwTailEvent JSON text message, otherwise as
+// Server-Sent Events: "message" events with query result rows as data, and
+// "dropped" events with the number of messages which were dropped because the
+// client was too slow.
+func wwwTail(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		wwwError(w, r, "HTTP GET method expected")
+		return
+	}
+	query, err := wwwParseQuery(r)
+	if err != nil {
+		wwwErrorWithCode(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if websocket.IsWebSocketUpgrade(r) {
+		wwwTailWebSocket(w, r, query)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		wwwError(w, r, "Streaming is not supported")
+		return
+	}
+
+	sub := instance.Subscribe(query)
+	defer instance.Unsubscribe(sub)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	err = wwwTailLoop(r.Context().Done(), sub, func(ev WwwTailEvent) error {
+		var err error
+		switch ev.Type {
+		case "message":
+			_, err = fmt.Fprintf(w, "data: %s\n\n", jsonifyWhateverToBytes(ev.Message))
+		case "dropped":
+			_, err = fmt.Fprintf(w, "event: dropped\ndata: %s\n\n", jsonifyWhateverToBytes(map[string]uint64{"dropped": ev.Dropped}))
+		default:
+			_, err = fmt.Fprint(w, ": keepalive\n\n")
+		}
+		flusher.Flush()
+		return err
+	})
+	if err != nil {
+		log.Println("Tail ended:", err)
+	}
+}
+
+func wwwTailWebSocket(w http.ResponseWriter, r *http.Request, query *logcore.QueryNode) {
+	conn, err := wwwTailUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has already sent an HTTP error
+		log.Println("WebSocket upgrade failed:", err)
+		return
+	}
+	defer conn.Close()
+
+	// Read (and discard) the client's messages, to handle pings and the close handshake
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	sub := instance.Subscribe(query)
+	defer instance.Unsubscribe(sub)
+	err = wwwTailLoop(closed, sub, func(ev WwwTailEvent) error {
+		conn.SetWriteDeadline(time.Now().Add(wwwTailWriteTimeout))
+		if ev.Type == "keepalive" {
+			return conn.WriteMessage(websocket.PingMessage, nil)
+		}
+		data, err := json.Marshal(ev)
+		if err != nil {
+			return err
+		}
+		return conn.WriteMessage(websocket.TextMessage, data)
+	})
+	if err != nil {
+		log.Println("Tail ended:", err)
+	}
+	conn.SetWriteDeadline(time.Now().Add(wwwTailWriteTimeout))
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+}
+
+// wwwTailLoop sends the subscriber's messages, and the number of dropped
+// messages, until done is closed (when the client goes away), the server is
+// shut down, or send returns an error.
+func wwwTailLoop(done <-chan struct{}, sub *logcore.TailSubscriber, send func(ev WwwTailEvent) error) (err error) {
+	droppedTicker := time.NewTicker(wwwTailDroppedInterval)
+	defer droppedTicker.Stop()
+	lastSend := time.Now()
+	for {
+		var ev WwwTailEvent
+		select {
+		case msg, ok := <-sub.Messages:
+			if !ok {
+				return nil
+			}
+			ev = WwwTailEvent{Type: "message", Message: logcore.MessageToRow(&msg)}
+		case <-droppedTicker.C:
+			if dropped := sub.TakeDropped(); dropped > 0 {
+				ev = WwwTailEvent{Type: "dropped", Dropped: dropped}
+			} else if time.Since(lastSend) >= wwwTailKeepaliveInterval {
+				ev = WwwTailEvent{Type: "keepalive"}
+			} else {
+				continue
+			}
+		case <-done:
+			return nil
+		case <-wwwShuttingDown:
+			return nil
+		}
+		if err = send(ev); err != nil {
+			return
+		}
+		lastSend = time.Now()
+	}
+}
@@ -1,11 +1,83 @@
 package main
 
+import "github.com/ivoras/ceruleanlog/logcore"
+
 type WwwRespDefault struct {
 	Ok      bool   `json:"ok"`
 	Message string `json:"message"`
 }
 
+type WwwGelfRejectedLine struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+type WwwRespGelf struct {
+	Ok       bool                  `json:"ok"`
+	Message  string                `json:"message"`
+	Accepted int                   `json:"accepted"`
+	Rejected []WwwGelfRejectedLine `json:"rejected"`
+}
+
+// WwwRespQuery is the result of a query. If the query didn't complete, e.g.
+// it timed out, partial is true and partial_reason says why.
 type WwwRespQuery struct {
+	Ok               bool                     `json:"ok"`
+	Result           []map[string]interface{} `json:"result"`
+	Partial          bool                     `json:"partial"`
+	PartialReason    string                   `json:"partial_reason,omitempty"` // timeout, cancelled, max_rows_scanned or error
+	IncompleteShards []string                 `json:"incomplete_shards,omitempty"`
+	RowsScanned      uint64                   `json:"rows_scanned,omitempty"`
+	NextCursor       string                   `json:"next_cursor,omitempty"`
+}
+
+// WwwTailEvent is sent by /tail over WebSocket.
+type WwwTailEvent struct {
+	Type    string                 `json:"type"` // message or dropped
+	Message map[string]interface{} `json:"message,omitempty"`
+	Dropped uint64                 `json:"dropped,omitempty"`
+}
+
+// WwwRespAggregate is the result of an aggregation. If it had more rows than
+// the limit, truncated is true (see wwwAggregate).
+type WwwRespAggregate struct {
+	Ok        bool                    `json:"ok"`
+	Result    logcore.AggregateResult `json:"result"`
+	Truncated bool                    `json:"truncated"`
+}
+
+type WwwRespContext struct {
+	Ok     bool                  `json:"ok"`
+	Result logcore.ContextResult `json:"result"`
+}
+
+type WwwRespFields struct {
+	Ok     bool                 `json:"ok"`
+	Result logcore.FieldsResult `json:"result"`
+}
+
+type WwwRespSavedSearches struct {
+	Ok     bool                  `json:"ok"`
+	Result []logcore.SavedSearch `json:"result"`
+}
+
+type WwwRespSavedSearch struct {
+	Ok     bool                `json:"ok"`
+	Result logcore.SavedSearch `json:"result"`
+}
+
+type WwwRespIndexes struct {
+	Ok      bool               `json:"ok"`
+	Indexes []string           `json:"indexes"`
+	Jobs    []logcore.IndexJob `json:"jobs"`
+}
+
+type WwwRespIndexJob struct {
+	Ok  bool             `json:"ok"`
+	Job logcore.IndexJob `json:"job"`
+}
+
+type WwwRespRetention struct {
 	Ok     bool                     `json:"ok"`
-	Result []map[string]interface{} `json:"result"`
+	Report *logcore.RetentionReport `json:"report"`
 }